@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActivityPub, https://www.w3.org/TR/activitypub/
+//
+// every collection is an actor at /feed/{uuid}/actor, with an outbox of
+// its entries as Note objects, and an inbox which accepts Follow and Undo
+
+const (
+	activitystreams_context = "https://www.w3.org/ns/activitystreams"
+	security_context        = "https://w3id.org/security/v1"
+	activitystreams_public  = "https://www.w3.org/ns/activitystreams#Public"
+	activity_json           = "application/activity+json"
+
+	max_activity_body = 1 << 20
+
+	// requests signed longer ago are refused
+	max_signature_age = 12 * time.Hour
+)
+
+type ActivityPub struct {
+	b        *Backend
+	base_URL string      // public URL of the server, without trailing slash
+	host     string      // of base_URL, for WebFinger
+	mutex    sync.Locker // the lock of the Handler
+	key      *rsa.PrivateKey
+	client   *http.Client
+	pending  sync.WaitGroup
+}
+
+// creates the actors of the collections of b, signing with key;
+// mutex must be the one held by the Handler serving b
+func NewActivityPub(b *Backend, base_URL string, mutex sync.Locker, key *rsa.PrivateKey) (ap *ActivityPub, err error) {
+	u, e := url.Parse(base_URL)
+	if e != nil {
+		return nil, e
+	}
+	ap = &ActivityPub{
+		b:        b,
+		base_URL: strings.TrimSuffix(base_URL, "/"),
+		host:     u.Host,
+		mutex:    mutex,
+		key:      key,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	b.Observe(ap)
+	return
+}
+
+// reads the PEM encoded private key at key_path, creating it if missing
+func LoadOrCreateKey(key_path string) (key *rsa.PrivateKey, err error) {
+	if p, e := os.ReadFile(key_path); e == nil {
+		if block, _ := pem.Decode(p); block == nil {
+			err = fmt.Errorf("no PEM block in %s", key_path)
+		} else {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+		return
+	} else if !os.IsNotExist(e) {
+		return nil, e
+	}
+
+	if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return
+	}
+	p := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	err = os.WriteFile(key_path, p, 0600)
+	return
+}
+
+func (ap *ActivityPub) actorURL(feed_URL string) string {
+	return ap.base_URL + feed_URL + "/actor"
+}
+
+func (ap *ActivityPub) publicKeyPEM() string {
+	p, _ := x509.MarshalPKIXPublicKey(&ap.key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: p}))
+}
+
+// the actor document of the collection at feed_URL
+func (ap *ActivityPub) actor(feed_URL string, source *Source) map[string]interface{} {
+	id := ap.actorURL(feed_URL)
+	actor := map[string]interface{}{
+		"@context":          []string{activitystreams_context, security_context},
+		"id":                id,
+		"type":              "Service",
+		"preferredUsername": path.Base(feed_URL),
+		"name":              source.Title.Text,
+		"url":               ap.base_URL + feed_URL,
+		"inbox":             ap.base_URL + feed_URL + "/inbox",
+		"outbox":            ap.base_URL + feed_URL + "/outbox",
+		"followers":         ap.base_URL + feed_URL + "/followers",
+		"publicKey": map[string]string{
+			"id":           id + "#main-key",
+			"owner":        id,
+			"publicKeyPem": ap.publicKeyPEM(),
+		},
+	}
+	if source.Subtitle != nil {
+		actor["summary"] = source.Subtitle.Text
+	}
+	return actor
+}
+
+// the Note object of an entry
+func (ap *ActivityPub) note(feed_URL string, entry_URL string, entry *Entry) map[string]interface{} {
+	note := map[string]interface{}{
+		"id":           ap.base_URL + entry_URL,
+		"type":         "Note",
+		"attributedTo": ap.actorURL(feed_URL),
+		"url":          ap.base_URL + entry_URL,
+		"content":      string(entry.Content.Body),
+		"updated":      entry.Updated.T.UTC().Format(time.RFC3339),
+		"to":           []string{activitystreams_public},
+		"cc":           []string{ap.base_URL + feed_URL + "/followers"},
+	}
+	if entry.Title.Text != "" && entry.Title.Text != "Untitled" {
+		note["name"] = entry.Title.Text
+	}
+	if entry.Published != nil {
+		note["published"] = entry.Published.T.UTC().Format(time.RFC3339)
+	} else {
+		note["published"] = entry.Updated.T.UTC().Format(time.RFC3339)
+	}
+	for _, irt := range entry.InReplyTo {
+		note["inReplyTo"] = ap.base_URL + irt.Href
+		break
+	}
+	if len(entry.Categories) != 0 {
+		tags := make([]map[string]string, 0, len(entry.Categories))
+		for _, c := range entry.Categories {
+			tags = append(tags, map[string]string{"type": "Hashtag", "name": "#" + c.Term})
+		}
+		note["tag"] = tags
+	}
+	return note
+}
+
+// wraps object in an activity of the collection at feed_URL
+func (ap *ActivityPub) activity(feed_URL string, kind string, object interface{}, id string) map[string]interface{} {
+	return map[string]interface{}{
+		"@context": activitystreams_context,
+		"id":       id,
+		"type":     kind,
+		"actor":    ap.actorURL(feed_URL),
+		"object":   object,
+		"to":       []string{activitystreams_public},
+		"cc":       []string{ap.base_URL + feed_URL + "/followers"},
+	}
+}
+
+// the activity of an entry as it stands: a Create, or an Update once edited
+func (ap *ActivityPub) entryActivity(feed_URL string, entry_URL string, entry *Entry) map[string]interface{} {
+	note := ap.note(feed_URL, entry_URL, entry)
+	if entry.Published != nil && entry.Updated.T.After(entry.Published.T) {
+		return ap.activity(feed_URL, "Update", note, fmt.Sprintf("%s#update-%d", note["id"], entry.Updated.T.Unix()))
+	}
+	return ap.activity(feed_URL, "Create", note, note["id"].(string)+"#create")
+}
+
+// delivers the activities of changed entries to the followers
+func (ap *ActivityPub) Notify(b *Backend, c *Change) {
+	if c.Entry == nil || c.EntryURL == "" || c.Mention {
+		return
+	}
+	var act map[string]interface{}
+	switch c.Type {
+	case change_created:
+		note := ap.note(c.FeedURL, c.EntryURL, c.Entry)
+		act = ap.activity(c.FeedURL, "Create", note, note["id"].(string)+"#create")
+	case change_updated:
+		note := ap.note(c.FeedURL, c.EntryURL, c.Entry)
+		act = ap.activity(c.FeedURL, "Update", note, fmt.Sprintf("%s#update-%d", note["id"], c.Entry.Updated.T.Unix()))
+	case change_deleted:
+		id := ap.base_URL + c.EntryURL
+		act = ap.activity(c.FeedURL, "Delete", map[string]string{"id": id, "type": "Tombstone"}, id+"#delete")
+	default:
+		return
+	}
+	ap.deliverAll(b, c.FeedURL, act)
+}
+
+// posts act to the inbox of every follower of the collection at feed_URL;
+// the caller holds the lock
+func (ap *ActivityPub) deliverAll(b *Backend, feed_URL string, act map[string]interface{}) {
+	body, e := json.Marshal(act)
+	if e != nil {
+		log.Printf("activitypub: %s", e)
+		return
+	}
+	actor_URL := ap.actorURL(feed_URL)
+	for _, sub := range b.subscriptionmap {
+		if sub.Topic != actor_URL || sub.Follower == "" {
+			continue
+		}
+		ap.pending.Add(1)
+		go func(inbox string) {
+			defer ap.pending.Done()
+			if e := ap.deliver(actor_URL, inbox, body); e != nil {
+				log.Printf("activitypub: delivery to %s: %s", inbox, e)
+			}
+		}(sub.Callback)
+	}
+}
+
+func (ap *ActivityPub) deliver(actor_URL string, inbox string, body []byte) (err error) {
+	req, e := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", activity_json)
+	if e := signRequest(req, body, actor_URL+"#main-key", ap.key); e != nil {
+		return e
+	}
+	res, e := ap.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, max_activity_body))
+	if res.StatusCode/100 != 2 {
+		err = fmt.Errorf("inbox responded %s", res.Status)
+	}
+	return
+}
+
+// HTTP Signatures, draft-cavage-http-signatures, as used in the fediverse
+func signRequest(req *http.Request, body []byte, key_id string, key *rsa.PrivateKey) (err error) {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", req.URL.Host)
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, e := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		key_id, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "host":
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines = append(lines, "host: "+host)
+		default:
+			lines = append(lines, h+": "+req.Header.Get(h))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checks the signature of req by the actor at actor_URL, with the key of
+// the document of that actor, which is returned; the document keyId
+// points to is not trusted, as the sender may host it for any owner
+func (ap *ActivityPub) verifyRequest(req *http.Request, body []byte, actor_URL string) (actor *remoteActor, err error) {
+	params := make(map[string]string)
+	for _, p := range strings.Split(req.Header.Get("Signature"), ",") {
+		if k, v, found := strings.Cut(p, "="); found {
+			params[strings.TrimSpace(k)] = strings.Trim(v, `"`)
+		}
+	}
+	headers := strings.Fields(params["headers"])
+	required := map[string]bool{"(request-target)": true, "host": true, "date": true, "digest": true}
+	for _, h := range headers {
+		delete(required, h)
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, fmt.Errorf("request is not signed")
+	} else if len(required) != 0 {
+		return nil, fmt.Errorf("signature must cover (request-target), host, date and digest")
+	} else if date, e := http.ParseTime(req.Header.Get("Date")); e != nil || time.Since(date).Abs() > max_signature_age {
+		return nil, fmt.Errorf("signature date is missing or stale")
+	}
+	digest := sha256.Sum256(body)
+	if req.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return nil, fmt.Errorf("digest does not match the body")
+	}
+	sig, e := base64.StdEncoding.DecodeString(params["signature"])
+	if e != nil {
+		return nil, fmt.Errorf("cannot decode signature")
+	}
+
+	actor, e = ap.fetchActor(actor_URL)
+	if e != nil {
+		return nil, e
+	} else if actor.Id != actor_URL {
+		return nil, fmt.Errorf("%s is the document of %s", actor_URL, actor.Id)
+	}
+	key, e := actor.key(params["keyId"])
+	if e != nil {
+		return nil, e
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	if e := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); e != nil {
+		return nil, fmt.Errorf("bad signature")
+	}
+	return actor, nil
+}
+
+// a remote actor, as far as needed here
+type remoteActor struct {
+	Id        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		Id           string `json:"id"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+func (ap *ActivityPub) fetchActor(actor_URL string) (actor *remoteActor, err error) {
+	req, e := http.NewRequest("GET", actor_URL, nil)
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Accept", activity_json)
+	res, e := ap.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s responded %s", actor_URL, res.Status)
+	}
+	actor = &remoteActor{}
+	if e := json.NewDecoder(io.LimitReader(res.Body, max_activity_body)).Decode(actor); e != nil {
+		return nil, e
+	}
+	return
+}
+
+// the key of the actor, which must have the id key_id
+func (actor *remoteActor) key(key_id string) (key *rsa.PublicKey, err error) {
+	if actor.PublicKey.Id != key_id {
+		return nil, fmt.Errorf("%s is not the key of %s", key_id, actor.Id)
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("no public key for %s", key_id)
+	}
+	pub, e := x509.ParsePKIXPublicKey(block.Bytes)
+	if e != nil {
+		return nil, e
+	} else if k, ok := pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("key %s is not RSA", key_id)
+	} else {
+		key = k
+	}
+	return
+}
+
+// GET /feed/{uuid}/{actor,outbox,followers}; the caller holds the lock
+func (ap *ActivityPub) serve(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	feed_URL := path.Dir(r.URL.Path)
+	source, ok := ap.b.sourcemap[feed_URL]
+	if !ok {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+
+	var v interface{}
+	switch path.Base(r.URL.Path) {
+	case "actor":
+		v = ap.actor(feed_URL, source)
+	case "outbox":
+		entry_ptrs := make([]*Entry, 0, 128)
+		entry_URLs := make(map[*Entry]string)
+		for k, e := range ap.b.entrymap {
+			if source.Id.Consumes(e.Source.Id) {
+				entry_ptrs = append(entry_ptrs, e)
+				entry_URLs[e] = k
+			}
+		}
+		sortEntries(entry_ptrs)
+		items := make([]interface{}, 0, len(entry_ptrs))
+		for _, e := range entry_ptrs {
+			if loaded, err := ap.b.full(e); err != nil {
+				return nil, &HTTPError{code: http.StatusInternalServerError, message: err.Error()}
+			} else {
+				items = append(items, ap.entryActivity(feed_URL, entry_URLs[e], loaded))
+			}
+		}
+		v = map[string]interface{}{
+			"@context":     activitystreams_context,
+			"id":           ap.base_URL + r.URL.Path,
+			"type":         "OrderedCollection",
+			"totalItems":   len(items),
+			"orderedItems": items,
+		}
+	case "followers":
+		n := 0
+		for _, sub := range ap.b.subscriptionmap {
+			if sub.Topic == ap.actorURL(feed_URL) && sub.Follower != "" {
+				n++
+			}
+		}
+		v = map[string]interface{}{
+			"@context":   activitystreams_context,
+			"id":         ap.base_URL + r.URL.Path,
+			"type":       "OrderedCollection",
+			"totalItems": n,
+		}
+	default:
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+
+	if body, e := json.Marshal(v); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		w.Header().Set("Content-Type", activity_json)
+		return body, nil
+	}
+	return
+}
+
+// an incoming activity, as far as needed here
+type inboxActivity struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// POST /feed/{uuid}/inbox; the caller holds the lock
+func (ap *ActivityPub) postInbox(w http.ResponseWriter, r *http.Request) (err error) {
+	feed_URL := path.Dir(r.URL.Path)
+	if _, ok := ap.b.sourcemap[feed_URL]; !ok {
+		return &HTTPError{code: http.StatusNotFound}
+	}
+	body, e := io.ReadAll(io.LimitReader(r.Body, max_activity_body))
+	if e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	}
+	act := &inboxActivity{}
+	if e := json.Unmarshal(body, act); e != nil || act.Actor == "" {
+		return &HTTPError{code: http.StatusBadRequest, message: "could not unmarshal activity"}
+	}
+
+	var object string
+	switch act.Type {
+	case "Follow":
+		json.Unmarshal(act.Object, &object)
+	case "Undo":
+		// the object is the Follow being undone
+		inner := &inboxActivity{}
+		if json.Unmarshal(act.Object, inner) != nil || inner.Type != "Follow" {
+			return &HTTPError{code: http.StatusNotImplemented, message: "only Follow can be undone"}
+		}
+		json.Unmarshal(inner.Object, &object)
+	default:
+		return &HTTPError{code: http.StatusNotImplemented, message: "unsupported activity " + act.Type}
+	}
+	if object != ap.actorURL(feed_URL) {
+		return &HTTPError{code: http.StatusBadRequest, message: "object must be the actor of the collection"}
+	}
+
+	// the signature needs the key of the remote actor,
+	// and is checked after the response like a WebSub intent
+	req := r.Clone(r.Context())
+	ap.pending.Add(1)
+	go func() {
+		defer ap.pending.Done()
+		if e := ap.follow(req, body, feed_URL, act); e != nil {
+			log.Printf("activitypub: %s from %s: %s", act.Type, act.Actor, e)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// verifies and applies a Follow or an Undo of one
+func (ap *ActivityPub) follow(r *http.Request, body []byte, feed_URL string, act *inboxActivity) (err error) {
+	actor, e := ap.verifyRequest(r, body, act.Actor)
+	if e != nil {
+		return e
+	} else if actor.Inbox == "" {
+		return fmt.Errorf("actor without inbox")
+	}
+
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	sub := &Subscription{
+		Topic:    ap.actorURL(feed_URL),
+		Callback: actor.Inbox,
+		Follower: actor.Id,
+	}
+	if e := ap.store(act, sub); e != nil {
+		return e
+	}
+
+	if act.Type == "Follow" {
+		accept := ap.activity(feed_URL, "Accept", act, act.Id+"#accept")
+		delete(accept, "to")
+		delete(accept, "cc")
+		if p, e := json.Marshal(accept); e != nil {
+			return e
+		} else {
+			return ap.deliver(sub.Topic, sub.Callback, p)
+		}
+	}
+	return nil
+}
+
+// stores the subscription of a Follow, or deletes it for an Undo, as one
+// operation
+func (ap *ActivityPub) store(act *inboxActivity, sub *Subscription) (err *HTTPError) {
+	if e := ap.b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = ap.b.finish(err) }()
+
+	if act.Type == "Follow" {
+		if e := ap.b.addSubscription(sub); e != nil {
+			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		}
+	} else if _, ok := ap.b.subscriptionmap[sub.Key()]; !ok {
+		return nil
+	} else if e := ap.b.deleteSubscription(sub.Key()); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	if e := ap.b.commit(fmt.Sprintf("activitypub %s %s", act.Type, act.Actor)); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	return nil
+}
+
+// WebFinger, RFC 7033, for acct:{uuid}@host; the caller holds the lock
+func (ap *ActivityPub) serveWebFinger(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	resource := r.URL.Query().Get("resource")
+	var feed_URL string
+	if acct, ok := strings.CutPrefix(resource, "acct:"); ok {
+		user, host, _ := strings.Cut(acct, "@")
+		if host != ap.host {
+			return nil, &HTTPError{code: http.StatusNotFound}
+		}
+		feed_URL = "/feed/" + user
+	} else if actor, ok := strings.CutPrefix(resource, ap.base_URL); ok && path.Base(actor) == "actor" {
+		feed_URL = path.Dir(actor)
+	} else if resource == "" {
+		return nil, &HTTPError{code: http.StatusBadRequest, message: "missing resource"}
+	}
+	if _, ok := ap.b.sourcemap[feed_URL]; !ok {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+
+	jrd := map[string]interface{}{
+		"subject": "acct:" + path.Base(feed_URL) + "@" + ap.host,
+		"aliases": []string{ap.actorURL(feed_URL)},
+		"links": []map[string]string{{
+			"rel":  "self",
+			"type": activity_json,
+			"href": ap.actorURL(feed_URL),
+		}},
+	}
+	if body, e := json.Marshal(jrd); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		w.Header().Set("Content-Type", "application/jrd+json")
+		return body, nil
+	}
+	return
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestActivityPub(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	b := NewBackend(NewBillyStorer(tmpdir))
+	h := &Handler{
+		B:     b,
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	key, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if h.ActivityPub, e = NewActivityPub(b, "https://example.org", h.mutex, key); e != nil {
+		t.Fatal(e)
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	// a stand-in for a remote server, with one actor, and an attacker whose
+	// key claims to be owned by it
+	remote_key, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p, _ := x509.MarshalPKIXPublicKey(&remote_key.PublicKey)
+	remote_pem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: p}))
+	attacker_key, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatal(e)
+	}
+	p, _ = x509.MarshalPKIXPublicKey(&attacker_key.PublicKey)
+	attacker_pem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: p}))
+	received := make(chan map[string]interface{}, 4)
+	var remote *httptest.Server
+	remote = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/actor":
+			w.Header().Set("Content-Type", activity_json)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":    remote.URL + "/actor",
+				"type":  "Person",
+				"inbox": remote.URL + "/inbox",
+				"publicKey": map[string]string{
+					"id":           remote.URL + "/actor#main-key",
+					"owner":        remote.URL + "/actor",
+					"publicKeyPem": remote_pem,
+				},
+			})
+		case "/attacker":
+			w.Header().Set("Content-Type", activity_json)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":    remote.URL + "/attacker",
+				"type":  "Person",
+				"inbox": remote.URL + "/inbox",
+				"publicKey": map[string]string{
+					"id":           remote.URL + "/attacker#main-key",
+					"owner":        remote.URL + "/actor",
+					"publicKeyPem": attacker_pem,
+				},
+			})
+		case "/inbox":
+			body, _ := io.ReadAll(r.Body)
+			params := make(map[string]string)
+			for _, p := range strings.Split(r.Header.Get("Signature"), ",") {
+				k, v, _ := strings.Cut(p, "=")
+				params[k] = strings.Trim(v, `"`)
+			}
+			sig, _ := base64.StdEncoding.DecodeString(params["signature"])
+			hashed := sha256.Sum256([]byte(signingString(r, strings.Fields(params["headers"]))))
+			digest := sha256.Sum256(body)
+			if e := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], sig); e != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			} else if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			v := make(map[string]interface{})
+			json.Unmarshal(body, &v)
+			received <- v
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer remote.Close()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	actor_URL := "https://example.org" + feed_URL + "/actor"
+
+	get := func(target string) (v map[string]interface{}) {
+		req := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if e := json.NewDecoder(res.Body).Decode(&v); e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+	inbox_signed := func(v map[string]interface{}, key_id string, key *rsa.PrivateKey) int {
+		body, _ := json.Marshal(v)
+		req, _ := http.NewRequest("POST", "https://example.org"+feed_URL+"/inbox", bytes.NewReader(body))
+		req.Header.Set("Content-Type", activity_json)
+		if e := signRequest(req, body, key_id, key); e != nil {
+			t.Fatal(e)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		h.ActivityPub.pending.Wait()
+		return w.Result().StatusCode
+	}
+	inbox := func(v map[string]interface{}) int {
+		return inbox_signed(v, remote.URL+"/actor#main-key", remote_key)
+	}
+
+	// discovery
+	user := strings.TrimPrefix(feed_URL, "/feed/")
+	jrd := get("/.well-known/webfinger?resource=" + url.QueryEscape("acct:"+user+"@example.org"))
+	if links := jrd["links"].([]interface{}); links[0].(map[string]interface{})["href"] != actor_URL {
+		t.Fatalf("unexpected webfinger %v", jrd)
+	}
+	actor := get(feed_URL + "/actor")
+	if actor["id"] != actor_URL || actor["name"] != "test microblog" {
+		t.Fatalf("unexpected actor %v", actor)
+	} else if pk := actor["publicKey"].(map[string]interface{}); !strings.Contains(pk["publicKeyPem"].(string), "PUBLIC KEY") {
+		t.Fatalf("unexpected public key %v", pk)
+	}
+
+	// follow, which is accepted
+	follow := map[string]interface{}{
+		"@context": activitystreams_context,
+		"id":       remote.URL + "/follow/1",
+		"type":     "Follow",
+		"actor":    remote.URL + "/actor",
+		"object":   actor_URL,
+	}
+	if code := inbox(follow); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if v := <-received; v["type"] != "Accept" || v["actor"] != actor_URL {
+		t.Fatalf("unexpected activity %v", v)
+	} else if v := get(feed_URL + "/followers"); v["totalItems"] != float64(1) {
+		t.Fatalf("unexpected followers %v", v)
+	}
+
+	// posting delivers a Create to the follower, and fills the outbox
+	req = httptest.NewRequest("POST", feed_URL, bytes.NewBufferString("Hello, fediverse."))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res = w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URL := res.Header.Get("Location")
+	h.ActivityPub.pending.Wait()
+	if v := <-received; v["type"] != "Create" {
+		t.Fatalf("unexpected activity %v", v)
+	} else if note := v["object"].(map[string]interface{}); note["id"] != "https://example.org"+entry_URL {
+		t.Fatalf("unexpected object %v", note)
+	}
+	outbox := get(feed_URL + "/outbox")
+	if outbox["totalItems"] != float64(1) {
+		t.Fatalf("unexpected outbox %v", outbox)
+	}
+
+	// editing it delivers an Update
+	req = httptest.NewRequest("GET", entry_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+	req = httptest.NewRequest("PUT", entry_URL, strings.NewReader(strings.Replace(string(body), "Hello, fediverse.", "Hello again, fediverse.", 1)))
+	req.Header.Set("Content-Type", "application/atom+xml;type=entry")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res = w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	h.ActivityPub.pending.Wait()
+	if v := <-received; v["type"] != "Update" {
+		t.Fatalf("unexpected activity %v", v)
+	} else if note := v["object"].(map[string]interface{}); note["id"] != "https://example.org"+entry_URL || !strings.Contains(note["content"].(string), "Hello again") || note["published"] == nil {
+		t.Fatalf("unexpected object %v", note)
+	}
+
+	// an unsigned request changes nothing
+	req = httptest.NewRequest("POST", feed_URL+"/inbox", strings.NewReader(`{"type":"Follow","actor":"https://elsewhere.example/actor","object":"`+actor_URL+`"}`))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	h.ActivityPub.pending.Wait()
+	if v := get(feed_URL + "/followers"); v["totalItems"] != float64(1) {
+		t.Fatalf("unexpected followers %v", v)
+	}
+
+	// nor does one signed by a key which only claims the actor as owner
+	forged := map[string]interface{}{
+		"id":     remote.URL + "/follow/1#forged",
+		"type":   "Undo",
+		"actor":  remote.URL + "/actor",
+		"object": follow,
+	}
+	if code := inbox_signed(forged, remote.URL+"/attacker#main-key", attacker_key); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if v := get(feed_URL + "/followers"); v["totalItems"] != float64(1) {
+		t.Fatalf("forged undo applied, followers %v", v)
+	}
+
+	// undo the follow, after which deletions are not delivered
+	undo := map[string]interface{}{
+		"id":     remote.URL + "/follow/1#undo",
+		"type":   "Undo",
+		"actor":  remote.URL + "/actor",
+		"object": follow,
+	}
+	if code := inbox(undo); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if v := get(feed_URL + "/followers"); v["totalItems"] != float64(0) {
+		t.Fatalf("unexpected followers %v", v)
+	}
+	req = httptest.NewRequest("DELETE", entry_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	h.ActivityPub.pending.Wait()
+	if len(received) != 0 {
+		t.Fatalf("unexpected delivery %v", <-received)
+	}
+}
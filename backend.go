@@ -5,9 +5,11 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"sort"
 	"strings"
 	"time"
@@ -15,39 +17,59 @@ import (
 	"github.com/google/uuid"
 )
 
+// the aggregate feed never changes its id
+var aggregate_id = "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte("/all")).String()
+
 type Backend struct {
 	serviceDocument *Service
 	sourcemap       map[string]*Source
 	entrymap        map[string]*Entry
+	workspacemap    map[string]*Workspace
 	storer          Storer
+	index           *SearchIndex
+	observers       []Observer
+	subscriptionmap map[string]*Subscription
+	hub             *Hub
+	contents        *contentCache // nil if every entry is kept with its content
+	journal         *journal      // nil unless an operation is running
+	skipped         []Skipped     // objects the storer could not load
+	snapshot        *snapshot     // the last one served, if any
 }
 
 func NewBackend(storer Storer) *Backend {
-	b := &Backend{
-		serviceDocument: &Service{
-			Workspaces: []Workspace{
-				{
-					Title: TextConstruct{
-						XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
-						Text:    "default workspace",
-					},
-					Collections: make([]*Collection, 0, 32),
-				},
-			},
-		},
-		entrymap:  make(map[string]*Entry),
-		sourcemap: make(map[string]*Source),
-		storer:    storer,
-	}
-	if e := storer.Populate(b.entrymap, b.sourcemap); e != nil {
+	b := &Backend{storer: storer}
+	if e := b.load(); e != nil {
 		panic(e)
 	}
-	// now build the serviceDocument
+	return b
+}
+
+// reads the maps from the storer, and builds the search index, the
+// collections and the service document
+func (b *Backend) load() error {
+	b.entrymap = make(map[string]*Entry)
+	b.sourcemap = make(map[string]*Source)
+	b.workspacemap = make(map[string]*Workspace)
+	b.subscriptionmap = make(map[string]*Subscription)
+	b.index = NewSearchIndex()
+	if e := b.storer.Populate(b.entrymap, b.sourcemap, b.workspacemap, b.subscriptionmap, b.skip, b.loaded); e != nil {
+		return e
+	}
+	if len(b.workspacemap) == 0 {
+		ws := newWorkspace(uuid.NewSHA1(uuid.NameSpaceURL, []byte("/workspace")).String(), &TextConstruct{Text: default_workspace_title})
+		markDefaultWorkspace(ws)
+		b.workspacemap[workspaceURL(ws)] = ws
+	}
+	// now build the collections
+	invalid := make(map[*Source]string)
 	for k, v := range b.sourcemap {
 		if v.Title == nil || v.Title.XMLName.Space != atom_xmlns || v.Title.XMLName.Local != "title" {
-			panic("invalid source title")
+			b.skip(Skipped{Name: "source/" + path.Base(k), FeedURL: k, Reason: "invalid source title"})
+			delete(b.sourcemap, k)
+			invalid[v] = k
+			continue
 		}
-		collection := &Collection{
+		v.Collection = &Collection{
 			Href:  k,
 			Title: v.Title,
 			Accepts: []Accept{{
@@ -57,11 +79,56 @@ func NewBackend(storer Storer) *Backend {
 				Categories: v.Categories,
 			}},
 		}
-		v.Collection = collection
-		b.serviceDocument.Workspaces[0].Collections = append(b.serviceDocument.Workspaces[0].Collections, collection)
 	}
+	for k, v := range b.entrymap {
+		if feed_URL, ok := invalid[v.Source]; ok {
+			b.skip(Skipped{Name: "entry/" + path.Base(k), FeedURL: feed_URL, Reason: "source skipped"})
+			delete(b.entrymap, k)
+			b.index.Remove(k)
+		}
+	}
+	// replace the persisted hrefs by the collections
+	assigned := make(map[string]bool)
+	for _, ws := range b.workspacemap {
+		collections := make([]*Collection, 0, len(ws.Collections))
+		for _, c := range ws.Collections {
+			if c == nil || assigned[c.Href] {
+				continue
+			} else if v, ok := b.sourcemap[c.Href]; ok {
+				collections = append(collections, v.Collection)
+				assigned[c.Href] = true
+			}
+		}
+		ws.Collections = collections
+	}
+	// collections without a workspace go to the default one, which was
+	// the first by title before it was marked
+	b.buildServiceDocument()
+	first := b.defaultWorkspace()
+	if !isDefaultWorkspace(first) {
+		markDefaultWorkspace(first)
+	}
+	unassigned := make([]string, 0, len(b.sourcemap))
+	for k := range b.sourcemap {
+		if !assigned[k] {
+			unassigned = append(unassigned, k)
+		}
+	}
+	sort.Strings(unassigned)
+	for _, k := range unassigned {
+		first.Collections = append(first.Collections, b.sourcemap[k].Collection)
+	}
+	b.buildServiceDocument()
 
-	return b
+	return nil
+}
+
+// indexes an entry as the storer reads it, and drops its content if lazy
+func (b *Backend) loaded(entry_URL string, entry *Entry) {
+	b.index.Add(entry_URL, entry)
+	if b.contents != nil {
+		entry.Content.Body = nil
+	}
 }
 
 func (b *Backend) GetRoot(r *http.Request) (sd *Service, err *HTTPError) {
@@ -69,6 +136,11 @@ func (b *Backend) GetRoot(r *http.Request) (sd *Service, err *HTTPError) {
 }
 
 func (b *Backend) PostToRoot(r *http.Request, new_feed *Feed) (feed *Feed, feed_URL string, err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return nil, "", &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	feed = new_feed
 	if new_feed.Title == nil || new_feed.Authors == nil {
 		err = &HTTPError{code: http.StatusBadRequest, message: "need to set <title> and <author> for new feeds"}
@@ -91,6 +163,25 @@ func (b *Backend) PostToRoot(r *http.Request, new_feed *Feed) (feed *Feed, feed_
 		return
 	}
 
+	// the workspace is selected by a category with the workspace scheme,
+	// which is not kept among the categories of the feed
+	ws := b.defaultWorkspace()
+	categories := make([]Category, 0, len(new_feed.Categories))
+	for _, c := range new_feed.Categories {
+		if c.Scheme != workspace_scheme {
+			categories = append(categories, c)
+		} else if u, e := uuid.Parse(c.Term); e != nil {
+			err = &HTTPError{code: http.StatusBadRequest, message: "cannot parse workspace as uuid"}
+			return
+		} else if w, ok := b.workspacemap["/workspace/"+u.String()]; !ok {
+			err = &HTTPError{code: http.StatusBadRequest, message: "unknown workspace"}
+			return
+		} else {
+			ws = w
+		}
+	}
+	new_feed.Categories = categories
+
 	new_feed.Id = &URI{
 		XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
 		Target:  "urn:uuid:" + uuid_string,
@@ -134,33 +225,48 @@ func (b *Backend) PostToRoot(r *http.Request, new_feed *Feed) (feed *Feed, feed_
 		Collection:   new_feed.Collection,
 	}
 
+	b.touchURLs("", feed_URL, "")
+	b.touchWorkspace(ws)
 	b.sourcemap[feed_URL] = source
 
+	func() {
+		for k, v := range ws.Collections {
+			if v == nil {
+				ws.Collections[k] = new_feed.Collection
+				return
+			}
+		}
+		ws.Collections = append(ws.Collections, new_feed.Collection)
+	}()
+	b.buildServiceDocument()
+
 	if e := b.storer.AddSource(source); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
-		return
-	} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+	} else if e := b.storer.AddWorkspace(ws); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
-		return
-	}
-
-	for k, v := range b.serviceDocument.Workspaces[0].Collections {
-		if v == nil {
-			b.serviceDocument.Workspaces[0].Collections[k] = new_feed.Collection
-			return
-		}
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		b.notify(&Change{Type: change_created, FeedURL: feed_URL})
 	}
-
-	b.serviceDocument.Workspaces[0].Collections = append(b.serviceDocument.Workspaces[0].Collections, new_feed.Collection)
 	return
 }
 
 func (b *Backend) PutFeed(r *http.Request, new_feed *Feed) (err *HTTPError) {
+	if e := b.degraded(r.URL.Path); e != nil {
+		return e
+	}
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	if v, ok := b.sourcemap[r.URL.Path]; !ok {
 		err = &HTTPError{code: http.StatusNotFound}
 	} else if !v.Id.Consumes(new_feed.Id) {
 		return &HTTPError{code: http.StatusBadRequest, message: "cannot change the URI of the feed"}
 	} else {
+		b.touch(nil, v)
 		v.Collection.Title = new_feed.Title
 		v.Collection.Categories = []Categories{{
 			Categories: new_feed.Categories,
@@ -180,14 +286,24 @@ func (b *Backend) PutFeed(r *http.Request, new_feed *Feed) (err *HTTPError) {
 
 		if e := b.storer.AddSource(v); e != nil {
 			err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
-		} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
 			err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		} else {
+			b.notify(&Change{Type: change_updated, FeedURL: r.URL.Path})
 		}
 	}
 	return
 }
 
 func (b *Backend) DeleteFeed(r *http.Request) (err *HTTPError) {
+	if e := b.degraded(r.URL.Path); e != nil {
+		return e
+	}
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	if source, ok := b.sourcemap[r.URL.Path]; !ok {
 		err = &HTTPError{code: http.StatusNotFound}
 	} else if source == nil {
@@ -195,7 +311,9 @@ func (b *Backend) DeleteFeed(r *http.Request) (err *HTTPError) {
 	} else if e := b.storer.DeleteSource(source); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
 	} else {
+		b.touchURLs("", r.URL.Path, "")
 		delete(b.sourcemap, r.URL.Path)
+		refs := make([]string, 0, 8)
 		for k, v := range b.entrymap {
 			if v == nil || v.Source == nil || v.Source.Id == nil {
 				err = &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
@@ -205,25 +323,36 @@ func (b *Backend) DeleteFeed(r *http.Request) (err *HTTPError) {
 			} else if e := b.storer.DeleteEntry(v); e != nil {
 				err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 			} else {
+				refs = append(refs, inReplyToRefs(v)...)
+				b.touchURLs(k, "", "")
 				delete(b.entrymap, k)
+				b.index.Remove(k)
 			}
 		}
-		for k, v := range b.serviceDocument.Workspaces[0].Collections {
-			if v == nil {
-				continue
-			} else if u, e := url.Parse(v.Href); e != nil {
-				err = &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
-				return
-			} else if u.Path == r.URL.Path {
-				b.serviceDocument.Workspaces[0].Collections[k] = nil
+		// replies to entries in other collections
+		if e := b.refreshReplies(refs...); e != nil {
+			err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		}
+		if ws := b.workspaceOf(r.URL.Path); ws == nil {
+			//
+		} else {
+			b.touchWorkspace(ws)
+			for k, v := range ws.Collections {
+				if v != nil && v.Href == r.URL.Path {
+					ws.Collections[k] = nil
+				}
+			}
+			if e := b.storer.AddWorkspace(ws); e != nil {
+				err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 			}
 		}
-
 	}
 	if err != nil {
 		return
-	} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		b.notify(&Change{Type: change_deleted, FeedURL: r.URL.Path})
 	}
 	return
 }
@@ -251,20 +380,37 @@ func (b *Backend) GetFeed(r *http.Request) (feed *Feed, err *HTTPError) {
 		}
 	}
 
-	// sort the entries
-	sort.Slice(entry_ptrs, func(i int, j int) bool {
-		// do not check error; the nil pointers will be sorted last
-		ti, _ := entry_ptrs[i].UpdatedTime()
-		tj, _ := entry_ptrs[j].UpdatedTime()
-		return ti.After(tj)
-	})
+	sortEntries(entry_ptrs)
+
+	links := source.Links
+	if filter, e := ParseFeedFilter(r.URL.Query()); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+		return
+	} else if !filter.IsZero() {
+		// the self link reflects the query, replacing that of the source
+		var paging []Link
+		entry_ptrs, paging = filter.Apply(r.URL.Path, entry_ptrs)
+		links = make([]Link, 0, len(source.Links)+len(paging))
+		for _, l := range source.Links {
+			if l.Relation != "self" {
+				links = append(links, l)
+			}
+		}
+		links = append(links, paging...)
+	} else if b.hub != nil {
+		// WebSub discovery
+		links = b.hub.Links(r.URL.Path, source.Links)
+	}
+	if entry_ptrs, err = b.withContent(entry_ptrs); err != nil {
+		return
+	}
 
 	return &Feed{
 		Id:         source.Id,
 		Authors:    source.Authors,
 		Updated:    source.Updated,
 		Rights:     source.Rights,
-		Links:      source.Links,
+		Links:      links,
 		Title:      source.Title,
 		Subtitle:   source.Subtitle,
 		Icon:       source.Icon,
@@ -274,7 +420,175 @@ func (b *Backend) GetFeed(r *http.Request) (feed *Feed, err *HTTPError) {
 	}, nil
 }
 
+// newest first
+func sortEntries(entry_ptrs []*Entry) {
+	sort.Slice(entry_ptrs, func(i int, j int) bool {
+		// do not check error; the nil pointers will be sorted last
+		ti, _ := entry_ptrs[i].UpdatedTime()
+		tj, _ := entry_ptrs[j].UpdatedTime()
+		if ti.Equal(tj) {
+			// updated has second precision; keep the order stable for paging
+			return entry_ptrs[i].Id.Target < entry_ptrs[j].Id.Target
+		}
+		return ti.After(tj)
+	})
+}
+
+// a hash of the ids and updated times of the sources, or of source alone
+// if not nil; unlike the latest updated time, it changes when a source is
+// deleted
+func (b *Backend) sourcesHash(source *Source) string {
+	feed_URLs := make([]string, 0, len(b.sourcemap))
+	for k, v := range b.sourcemap {
+		if source == nil || source == v {
+			feed_URLs = append(feed_URLs, k)
+		}
+	}
+	sort.Strings(feed_URLs)
+	hasher := fnv.New64a()
+	for _, k := range feed_URLs {
+		if v := b.sourcemap[k]; v.Updated != nil {
+			fmt.Fprintf(hasher, "%s %s\n", k, v.Updated.T.Format(time.RFC3339Nano))
+		}
+	}
+	return fmt.Sprintf("%x", hasher.Sum64())
+}
+
+// merges the entries of every collection, each carrying its atom:source
+func (b *Backend) GetAggregate(r *http.Request) (feed *Feed, err *HTTPError) {
+	updated := time.Time{}
+	for _, v := range b.sourcemap {
+		if v == nil || v.Updated == nil {
+			err = &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
+			return
+		} else if v.Updated.T.After(updated) {
+			updated = v.Updated.T
+		}
+	}
+
+	entry_ptrs := make([]*Entry, 0, len(b.entrymap))
+	for _, v := range b.entrymap {
+		if v == nil || v.Source == nil {
+			err = &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
+			return
+		}
+		entry_ptrs = append(entry_ptrs, v)
+	}
+	sortEntries(entry_ptrs)
+
+	filter, e := ParseFeedFilter(r.URL.Query())
+	if e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+		return
+	}
+	entry_ptrs, links := filter.Apply(r.URL.Path, entry_ptrs)
+	if entry_ptrs, err = b.withContent(entry_ptrs); err != nil {
+		return
+	}
+
+	return &Feed{
+		Id: &URI{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
+			Target:  aggregate_id,
+		},
+		Title: &TextConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
+			Text:    "all collections",
+		},
+		Updated: &DateConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
+			T:       updated,
+		},
+		Links:   links,
+		Entries: entry_ptrs,
+		sources: b.sourcesHash(nil),
+	}, nil
+}
+
+// results are returned as a feed, ranked by relevance
+// the optional feed parameter restricts the search to one collection
+func (b *Backend) Search(r *http.Request) (feed *Feed, err *HTTPError) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if strings.TrimSpace(q) == "" {
+		err = &HTTPError{code: http.StatusBadRequest, message: "missing search query q"}
+		return
+	}
+
+	var source *Source
+	if f := query.Get("feed"); f == "" {
+		//
+	} else if u, e := uuid.Parse(path.Base(f)); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: "cannot parse feed as uuid"}
+		return
+	} else if s, ok := b.sourcemap["/feed/"+u.String()]; !ok {
+		err = &HTTPError{code: http.StatusNotFound}
+		return
+	} else {
+		source = s
+	}
+
+	// the updated time of the feed is the latest of the sources searched;
+	// the ETag does not depend on it, but on sourcesHash
+	updated := time.Time{}
+	for _, v := range b.sourcemap {
+		if v == nil || v.Updated == nil {
+			continue
+		} else if source != nil && source != v {
+			continue
+		} else if v.Updated.T.After(updated) {
+			updated = v.Updated.T
+		}
+	}
+
+	entry_ptrs := make([]*Entry, 0, 32)
+	for _, k := range b.index.Search(q) {
+		if v, ok := b.entrymap[k]; !ok || v.Source == nil {
+			continue
+		} else if source != nil && !source.Id.Consumes(v.Source.Id) {
+			continue
+		} else {
+			entry_ptrs = append(entry_ptrs, v)
+		}
+	}
+	if entry_ptrs, err = b.withContent(entry_ptrs); err != nil {
+		return
+	}
+
+	// the id is stable for a given query
+	self := r.URL.RequestURI()
+	return &Feed{
+		Id: &URI{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
+			Target:  "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte(self)).String(),
+		},
+		Title: &TextConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
+			Text:    "search results",
+		},
+		Updated: &DateConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
+			T:       updated,
+		},
+		Links: []Link{{
+			Href:     self,
+			Relation: "self",
+			Type:     "application/atom+xml",
+		}},
+		Entries: entry_ptrs,
+		sources: b.sourcesHash(source),
+	}, nil
+}
+
 func (b *Backend) PostToFeed(r *http.Request) (entry *Entry, entry_URL string, err *HTTPError) {
+	if e := b.degraded(r.URL.Path); e != nil {
+		return nil, "", e
+	}
+	if e := b.begin(); e != nil {
+		return nil, "", &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	var source *Source
 	if sd := b.serviceDocument; false {
 		//
@@ -322,12 +636,33 @@ jump:
 			}
 		}
 	}
+	if ref := r.Header.Get("In-Reply-To"); ref != "" {
+		entry.InReplyTo = []InReplyTo{{Ref: ref}}
+	}
 
 	if err != nil {
 		return
-	} else if _, e := entry.Validate(nil); e != nil {
+	} else if entry_URL, err = b.addEntry(source, entry, uuid_string); err != nil {
+		return
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		return
+	}
+	return
+}
+
+// validates and stages a new entry of source, with its id set, and puts it
+// into the maps; the caller commits
+func (b *Backend) addEntry(source *Source, entry *Entry, uuid_string string) (entry_URL string, err *HTTPError) {
+	entry_relative := "/entry/" + uuid_string
+	if _, e := entry.Validate(nil); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+		return
+	} else if e := b.validateInReplyTo(entry, nil); e != nil {
 		err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
 		return
+	} else if b.touch(nil, source); false {
+		//
 	} else if e := source.Updated.Set(time.Now().Round(time.Microsecond)); e != nil {
 		panic(e)
 	} else if e := b.storer.AddEntry(entry); e != nil {
@@ -336,14 +671,19 @@ jump:
 	} else if e := b.storer.AddSource(source); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 		return
-	} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+	} else if b.touchURLs(entry_relative, "", ""); false {
+		//
+	} else if b.entrymap[entry_relative] = entry; false {
+		// the parents count their replies from the entrymap
+	} else if e := b.refreshReplies(inReplyToRefs(entry)...); e != nil {
 		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 		return
 	}
 
-	entry_relative := "/entry/" + uuid_string
-	b.entrymap[entry_relative] = entry
+	b.index.Add(entry_relative, entry)
 	entry_URL = entry_relative
+	b.notifyEntry(change_created, entry_URL, entry)
+	b.keep(entry_URL, entry)
 
 	return
 }
@@ -475,6 +815,10 @@ func plainTextPost(body io.Reader, slug string) (entry *Entry, cats []string, uu
 		XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
 		T:       time.Now().Round(time.Second),
 	}
+	entry.Published = &DateConstruct{
+		XMLName: xml.Name{Space: atom_xmlns, Local: "published"},
+		T:       entry.Updated.T,
+	}
 
 	entry.Id = URI{
 		XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
@@ -488,35 +832,71 @@ func (b *Backend) GetEntry(r *http.Request) (entry *Entry, err *HTTPError) {
 	if ent, ok := b.entrymap[r.URL.Path]; !ok {
 		err = &HTTPError{code: http.StatusNotFound}
 		return
+	} else if loaded, e := b.full(ent); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		return
 	} else {
-		return ent, nil
+		return loaded, nil
 	}
 }
 
 func (b *Backend) DeleteEntry(r *http.Request) (err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	if entry, ok := b.entrymap[r.URL.Path]; !ok {
 		return &HTTPError{code: http.StatusNotFound}
 	} else if entry.Source == nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
+	} else if e := b.degradedEntry(entry); e != nil {
+		return e
+	} else if deleted, e := b.full(entry); e != nil {
+		// the content goes to the observers, and cannot be read once deleted
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if b.touch(entry, entry.Source); false {
+		//
 	} else if e := entry.Source.Updated.Set(time.Now().Round(time.Microsecond)); e != nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 	} else if e := b.storer.DeleteEntry(entry); e != nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
-	} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+	} else if b.touchURLs(r.URL.Path, "", ""); false {
+		//
+	} else if delete(b.entrymap, r.URL.Path); false {
+		// the parents count their replies from the entrymap
+	} else if e := b.refreshReplies(inReplyToRefs(entry)...); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 	} else {
-		delete(b.entrymap, r.URL.Path)
+		b.index.Remove(r.URL.Path)
+		b.notifyEntry(change_deleted, r.URL.Path, deleted)
+		if b.contents != nil {
+			b.contents.Remove(r.URL.Path)
+		}
 	}
 	return
 }
 
 func (b *Backend) PutEntry(r *http.Request, new_entry *Entry) (err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
 	if entry, ok := b.entrymap[r.URL.Path]; !ok {
 		return &HTTPError{code: http.StatusNotFound}
 	} else if entry.Source == nil || entry.Source.Updated == nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: "nil pointer dereference"}
+	} else if e := b.degradedEntry(entry); e != nil {
+		return e
 	} else if !entry.Id.Consumes(&new_entry.Id) {
 		return &HTTPError{code: http.StatusBadRequest, message: "cannot change the URI of the entry"}
+	} else if e := b.validateInReplyTo(new_entry, entry.InReplyTo); e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	} else if b.touch(entry, entry.Source); false {
+		//
 	} else if e := entry.Updated.Set(time.Now().Round(time.Second)); e != nil {
 		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 	} else if e := entry.Source.Updated.Set(time.Now().Round(time.Microsecond)); e != nil {
@@ -545,9 +925,24 @@ func (b *Backend) PutEntry(r *http.Request, new_entry *Entry) (err *HTTPError) {
 		entry.Authors = new_entry.Authors
 		entry.Contributors = new_entry.Contributors
 		entry.Control = new_entry.Control
-		entry.Links = new_entry.Links
 		entry.Categories = new_entry.Categories
 
+		// the replies link and the mentions are maintained by the server
+		links := make([]Link, 0, len(new_entry.Links)+1)
+		for _, l := range new_entry.Links {
+			if l.Relation != "replies" && !isWebmentionLink(l) {
+				links = append(links, l)
+			}
+		}
+		for _, l := range entry.Links {
+			if l.Relation == "replies" || isWebmentionLink(l) {
+				links = append(links, l)
+			}
+		}
+		entry.Links = links
+		refs := inReplyToRefs(entry, new_entry)
+		entry.InReplyTo = new_entry.InReplyTo
+
 		if new_entry.Content.Type != "xhtml" {
 			return &HTTPError{code: http.StatusBadRequest, message: "cannot change content type from xhtml"}
 		} else if new_entry.Content.Src != "" {
@@ -559,11 +954,16 @@ func (b *Backend) PutEntry(r *http.Request, new_entry *Entry) (err *HTTPError) {
 		entry.Content = new_entry.Content
 		if e := b.storer.AddEntry(entry); e != nil {
 			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		} else if e := b.refreshReplies(refs...); e != nil {
+			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 		} else if e := b.storer.AddSource(entry.Source); e != nil {
 			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
-		} else if e := b.storer.Commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
 			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
 		}
+		b.index.Add(r.URL.Path, entry)
+		b.notifyEntry(change_updated, r.URL.Path, entry)
+		b.keep(r.URL.Path, entry)
 	}
 
 	return
@@ -612,3 +1012,117 @@ func (b *Backend) GetMedia(r *http.Request) (media []byte, mediatype string, err
 	err = &HTTPError{code: http.StatusNotImplemented}
 	return
 }
+
+func (b *Backend) PostMedia(r *http.Request) (media_URL string, err *HTTPError) {
+	err = &HTTPError{code: http.StatusNotImplemented}
+	return
+}
+
+func (b *Backend) GetWorkspace(r *http.Request) (ws *Workspace, err *HTTPError) {
+	if v, ok := b.workspacemap[r.URL.Path]; !ok {
+		err = &HTTPError{code: http.StatusNotFound}
+	} else {
+		ws = v
+	}
+	return
+}
+
+func (b *Backend) PostWorkspace(r *http.Request, new_ws *Workspace) (ws *Workspace, ws_URL string, err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return nil, "", &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
+	if new_ws.Title.Text == "" {
+		err = &HTTPError{code: http.StatusBadRequest, message: "need to set <atom:title> for new workspaces"}
+		return
+	}
+
+	ws = newWorkspace(uuid.NewString(), &new_ws.Title)
+	ws_URL = workspaceURL(ws)
+	b.touchURLs("", "", ws_URL)
+	b.workspacemap[ws_URL] = ws
+	b.buildServiceDocument()
+
+	// persist every workspace, the mark of the default one included, so
+	// that the layout no longer depends on the titles
+	for _, v := range b.workspacemap {
+		if e := b.storer.AddWorkspace(v); e != nil {
+			err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+			return
+		}
+	}
+	if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	return
+}
+
+// renames the workspace; the collections are not changed
+func (b *Backend) PutWorkspace(r *http.Request, new_ws *Workspace) (err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
+	if ws, ok := b.workspacemap[r.URL.Path]; !ok {
+		err = &HTTPError{code: http.StatusNotFound}
+	} else if new_ws.Title.Text == "" {
+		err = &HTTPError{code: http.StatusBadRequest, message: "empty workspace title"}
+	} else if b.touchWorkspace(ws); false {
+		//
+	} else if ws.Title.Text, ws.Title.Type = new_ws.Title.Text, new_ws.Title.Type; false {
+		//
+	} else if b.buildServiceDocument(); false {
+		//
+	} else if e := b.storer.AddWorkspace(ws); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := b.storer.AddWorkspace(b.defaultWorkspace()); e != nil {
+		// the mark may not be stored yet, and the new title may sort first
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	return
+}
+
+// only empty workspaces can be deleted, and the last one is kept
+func (b *Backend) DeleteWorkspace(r *http.Request) (err *HTTPError) {
+	if e := b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+
+	ws, ok := b.workspacemap[r.URL.Path]
+	if !ok {
+		return &HTTPError{code: http.StatusNotFound}
+	} else if len(b.workspacemap) == 1 {
+		return &HTTPError{code: http.StatusConflict, message: "cannot delete the last workspace"}
+	}
+	for _, c := range ws.Collections {
+		if c != nil {
+			return &HTTPError{code: http.StatusConflict, message: "workspace still contains collections"}
+		}
+	}
+
+	b.touchURLs("", "", r.URL.Path)
+	delete(b.workspacemap, r.URL.Path)
+	b.buildServiceDocument()
+	if first := b.defaultWorkspace(); isDefaultWorkspace(first) {
+		//
+	} else if b.touchWorkspace(first); false {
+		// the default is passed on to the first by title
+	} else if markDefaultWorkspace(first); false {
+		//
+	} else if b.buildServiceDocument(); false {
+		//
+	} else if e := b.storer.AddWorkspace(first); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	if e := b.storer.DeleteWorkspace(ws); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := b.commit(fmt.Sprintf("%s %s", r.Method, r.URL.Path)); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	return
+}
@@ -5,17 +5,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/xml"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"sync"
 
 	"strconv"
+	"strings"
 
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 func TestBackend1(t *testing.T) {
@@ -575,3 +580,560 @@ func TestBackend2(t *testing.T) {
 		}
 	}()
 }
+
+func TestFeedFilter(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+<uri>mailto:janedoe@example.org</uri>
+</author>
+<category term="golang"/>
+<category term="gardening"/>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	for _, post := range []string{
+		"Generics are here. cat:golang",
+		"Tomatoes need sun. cat:gardening",
+		"Fuzzing in the standard library. cat:golang",
+	} {
+		req := httptest.NewRequest("POST", feed_URL, bytes.NewBufferString(post))
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if res := w.Result(); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+
+	get := func(query string) (feed *Feed, etag string) {
+		req := httptest.NewRequest("GET", feed_URL+query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed = &Feed{}
+		if e := xml.NewDecoder(res.Body).Decode(feed); e != nil {
+			t.Fatal(e)
+		}
+		return feed, res.Header.Get("ETag")
+	}
+
+	self := func(feed *Feed) string {
+		for _, l := range feed.Links {
+			if l.Relation == "self" {
+				return l.Href
+			}
+		}
+		return ""
+	}
+
+	all, all_etag := get("")
+	golang, golang_etag := get("?category=golang")
+	if len(all.Entries) != 3 || len(golang.Entries) != 2 {
+		t.Fatalf("unexpected number of entries %d %d", len(all.Entries), len(golang.Entries))
+	} else if all_etag == golang_etag {
+		t.Fatalf("filtered feed should have a distinct etag")
+	} else if self(golang) != feed_URL+"?category=golang" {
+		t.Fatalf("unexpected self link %s", self(golang))
+	}
+
+	if feed, _ := get("?category=golang&scheme=https://example.org/tags"); len(feed.Entries) != 0 {
+		t.Fatalf("scheme should be honored")
+	} else if feed, _ := get("?author=jane+doe"); len(feed.Entries) != 3 {
+		t.Fatalf("unexpected number of entries by author")
+	} else if feed, _ := get("?author=john"); len(feed.Entries) != 0 {
+		t.Fatalf("unexpected number of entries by author")
+	} else if feed, _ := get("?until=2000-01-01T00:00:00Z"); len(feed.Entries) != 0 {
+		t.Fatalf("unexpected number of entries until")
+	} else if feed, _ := get("?since=2000-01-01T00:00:00Z&category=golang"); len(feed.Entries) != 2 {
+		t.Fatalf("unexpected number of entries since")
+	}
+
+	// paging combines with the filters
+	page1, _ := get("?category=golang&limit=1")
+	var next string
+	for _, l := range page1.Links {
+		if l.Relation == "next" {
+			next = l.Href
+		}
+	}
+	if len(page1.Entries) != 1 || next == "" {
+		t.Fatalf("expected a next page")
+	}
+	u, e := url.Parse(next)
+	if e != nil {
+		t.Fatal(e)
+	}
+	page2, _ := get("?" + u.RawQuery)
+	if len(page2.Entries) != 1 || page2.Entries[0].Id.Target == page1.Entries[0].Id.Target {
+		t.Fatalf("unexpected second page")
+	}
+	for _, l := range page2.Links {
+		if l.Relation == "next" {
+			t.Fatalf("unexpected next link on last page")
+		}
+	}
+
+	req = httptest.NewRequest("GET", feed_URL+"?since=yesterday", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+}
+
+func TestAggregateFeed(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">%s</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	source_ids := make(map[string]bool)
+	feed_URLs := make([]string, 0, 2)
+	for _, title := range []string{"microblog", "photos"} {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(fmt.Sprintf(feed_to_post_to_root, title)))
+		req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed := &Feed{}
+		if e := xml.NewDecoder(res.Body).Decode(feed); e != nil {
+			t.Fatal(e)
+		}
+		source_ids[feed.Id.Target] = true
+		feed_URLs = append(feed_URLs, res.Header.Get("Location"))
+
+		req = httptest.NewRequest("POST", res.Header.Get("Location"), bytes.NewBufferString("posted to "+title))
+		req.Header.Set("Content-Type", "text/plain")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if res := w.Result(); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+
+	get := func() (feed *Feed, etag string) {
+		req := httptest.NewRequest("GET", "/all", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed = &Feed{}
+		if e := xml.NewDecoder(res.Body).Decode(feed); e != nil {
+			t.Fatal(e)
+		}
+		return feed, res.Header.Get("ETag")
+	}
+
+	feed, etag := get()
+	if feed.Id.Target != aggregate_id {
+		t.Fatalf("unexpected aggregate id %s", feed.Id.Target)
+	} else if len(feed.Entries) != 2 {
+		t.Fatalf("unexpected number of entries %d", len(feed.Entries))
+	}
+	for _, entry := range feed.Entries {
+		if entry.Source == nil || entry.Source.Id == nil {
+			t.Fatalf("entry is missing atom:source")
+		} else if !source_ids[entry.Source.Id.Target] {
+			t.Fatalf("unexpected source id %s", entry.Source.Id.Target)
+		}
+		delete(source_ids, entry.Source.Id.Target)
+	}
+
+	if _, etag2 := get(); etag != etag2 {
+		t.Fatalf("aggregate etag is not stable")
+	}
+
+	// deleting the older collection leaves the latest updated time
+	req := httptest.NewRequest("DELETE", feed_URLs[0], nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if feed, etag2 := get(); len(feed.Entries) != 1 {
+		t.Fatalf("unexpected number of entries %d", len(feed.Entries))
+	} else if etag == etag2 {
+		t.Fatalf("aggregate etag unchanged by a deleted collection")
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	newHandler := func() *Handler {
+		return &Handler{
+			B:     NewBackend(NewBillyStorer(tmpdir)),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler()
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	do := func(method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	service := func() *Service {
+		res := do("GET", "/", "", "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		sd := &Service{}
+		if e := xml.NewDecoder(res.Body).Decode(sd); e != nil {
+			t.Fatal(e)
+		}
+		return sd
+	}
+
+	res := do("POST", "/workspace", "application/atomsvc+xml", `<workspace xmlns="http://www.w3.org/2007/app" xmlns:atom="http://www.w3.org/2005/Atom"><atom:title>photos</atom:title></workspace>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	ws_URL := res.Header.Get("Location")
+	ws_uuid := path.Base(ws_URL)
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">holidays</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<category term="%s" scheme="urn:atompub-server:workspace"/>
+<category term="travel"/>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+	res = do("POST", "/", "application/atom+xml;type=feed", fmt.Sprintf(feed_to_post_to_root, ws_uuid))
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	check := func(title string) {
+		sd := service()
+		if len(sd.Workspaces) != 2 {
+			t.Fatalf("unexpected number of workspaces %d", len(sd.Workspaces))
+		}
+		for _, ws := range sd.Workspaces {
+			if workspaceURL(&ws) != ws_URL {
+				if len(ws.Collections) != 0 {
+					t.Fatalf("collection assigned to the wrong workspace")
+				}
+				continue
+			}
+			if ws.Title.Text != title {
+				t.Fatalf("unexpected workspace title %s", ws.Title.Text)
+			} else if len(ws.Collections) != 1 || ws.Collections[0].Href != feed_URL {
+				t.Fatalf("collection not assigned to workspace")
+			} else if cats := ws.Collections[0].Categories[0].Categories; len(cats) != 1 || cats[0].Term != "travel" {
+				t.Fatalf("workspace category should not be kept")
+			}
+			return
+		}
+		t.Fatalf("did not find the workspace")
+	}
+	check("photos")
+
+	res = do("PUT", ws_URL, "application/atomsvc+xml", `<workspace xmlns="http://www.w3.org/2007/app" xmlns:atom="http://www.w3.org/2005/Atom"><atom:title>pictures</atom:title></workspace>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// simulate restart the handler
+	h = newHandler()
+	check("pictures")
+
+	if res := do("DELETE", ws_URL, "", ""); res.StatusCode != http.StatusConflict {
+		t.Fatal(res.Status)
+	} else if res := do("DELETE", feed_URL, "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res := do("DELETE", ws_URL, "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	h = newHandler()
+	if sd := service(); len(sd.Workspaces) != 1 {
+		t.Fatalf("unexpected number of workspaces %d", len(sd.Workspaces))
+	} else if res := do("DELETE", workspaceURL(&sd.Workspaces[0]), "", ""); res.StatusCode != http.StatusConflict {
+		t.Fatal(res.Status)
+	}
+
+	// the default workspace stays so, whatever the title of a new one
+	res = do("POST", "/workspace", "application/atomsvc+xml", `<workspace xmlns="http://www.w3.org/2007/app" xmlns:atom="http://www.w3.org/2005/Atom"><atom:title>albums</atom:title></workspace>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	h = newHandler()
+	res = do("POST", "/", "application/atom+xml;type=feed", strings.Replace(feed_to_post_to_root, `<category term="%s" scheme="urn:atompub-server:workspace"/>`, "", 1))
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if sd := service(); len(sd.Workspaces) != 2 || sd.Workspaces[0].Title.Text != default_workspace_title {
+		t.Fatalf("unexpected default workspace %v", sd.Workspaces)
+	} else if len(sd.Workspaces[0].Collections) != 1 || len(sd.Workspaces[1].Collections) != 0 {
+		t.Fatalf("collection not assigned to the default workspace")
+	}
+}
+
+func TestThreadedReplies(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	newHandler := func() *Handler {
+		return &Handler{
+			B:     NewBackend(NewBillyStorer(tmpdir)),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler()
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">comments</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	post := func(body string, in_reply_to string) (res *http.Response, entry *Entry) {
+		req := httptest.NewRequest("POST", feed_URL, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "text/plain")
+		if in_reply_to != "" {
+			req.Header.Set("In-Reply-To", in_reply_to)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res = w.Result()
+		if res.StatusCode == http.StatusOK {
+			entry = &Entry{}
+			if e := xml.NewDecoder(res.Body).Decode(entry); e != nil {
+				t.Fatal(e)
+			}
+		}
+		return
+	}
+
+	replies := func(parent_URL string) (count uint64) {
+		req := httptest.NewRequest("GET", parent_URL, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry := &Entry{}
+		if e := xml.NewDecoder(res.Body).Decode(entry); e != nil {
+			t.Fatal(e)
+		}
+		for _, l := range entry.Links {
+			if l.Relation == "replies" {
+				if l.Href != parent_URL+"/replies" || l.ThreadUpdated == "" {
+					t.Fatalf("unexpected replies link %v", l)
+				}
+				return l.ThreadCount
+			}
+		}
+		return 0
+	}
+
+	res, parent := post("What do you think?", "")
+	parent_URL := res.Header.Get("Location")
+
+	res, reply := post("I agree.", parent.Id.Target)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if len(reply.InReplyTo) != 1 || reply.InReplyTo[0].Ref != parent.Id.Target || reply.InReplyTo[0].Href != parent_URL {
+		t.Fatalf("unexpected in-reply-to %v", reply.InReplyTo)
+	}
+	reply_URL := res.Header.Get("Location")
+	if res, _ := post("Me too.", parent_URL); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res, _ := post("Nobody asked.", "/entry/"+uuid.NewString()); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+
+	if count := replies(parent_URL); count != 2 {
+		t.Fatalf("unexpected thr:count %d", count)
+	}
+
+	func() {
+		req := httptest.NewRequest("GET", parent_URL+"/replies", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed := &Feed{}
+		if e := xml.NewDecoder(res.Body).Decode(feed); e != nil {
+			t.Fatal(e)
+		} else if len(feed.Entries) != 2 {
+			t.Fatalf("unexpected number of replies %d", len(feed.Entries))
+		}
+	}()
+
+	req = httptest.NewRequest("DELETE", reply_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// a reply from another collection changes the feed of the parent
+	feed_ETag := func(feed_URL string) string {
+		req := httptest.NewRequest("GET", feed_URL, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().Header.Get("ETag")
+	}
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	etag := feed_ETag(feed_URL)
+	req = httptest.NewRequest("POST", w.Result().Header.Get("Location"), bytes.NewBufferString("From elsewhere."))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("In-Reply-To", parent_URL)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if count := replies(parent_URL); count != 2 {
+		t.Fatalf("unexpected thr:count %d", count)
+	} else if feed_ETag(feed_URL) == etag {
+		t.Fatalf("feed etag unchanged by a reply from another collection")
+	}
+
+	// simulate restart the handler
+	h = newHandler()
+	if count := replies(parent_URL); count != 2 {
+		t.Fatalf("unexpected thr:count after restart %d", count)
+	}
+
+	// a reply whose parent is gone can still be edited, but not be made a
+	// reply to another unknown entry
+	res, gone := post("Soon gone.", "")
+	gone_URL := res.Header.Get("Location")
+	res, _ = post("Replying to what?", gone_URL)
+	orphan_URL := res.Header.Get("Location")
+	req = httptest.NewRequest("DELETE", gone_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	put := func(body string) *http.Response {
+		req := httptest.NewRequest("PUT", orphan_URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/atom+xml;type=entry")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	req = httptest.NewRequest("GET", orphan_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+	edited := strings.Replace(string(body), "Replying to what?", "Replying to nothing.", 1)
+	if res := put(edited); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if v := h.B.(*Backend).entrymap[orphan_URL].InReplyTo; len(v) != 1 || v[0].Ref != gone.Id.Target || v[0].Href != gone_URL {
+		t.Fatalf("unexpected in-reply-to %v", v)
+	}
+	other := `<thr:in-reply-to xmlns:thr="` + thr_xmlns + `" ref="urn:uuid:` + uuid.NewString() + `"></thr:in-reply-to></entry>`
+	if res := put(strings.Replace(edited, "</entry>", other, 1)); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// a batch is a feed of entries and deleted entries, applied as one commit:
+// entries with the id of an existing entry replace it, and entries without
+// an id are created in the collection given by their atom:source id;
+// deletions are marked by Atom Tombstones, RFC 6721
+type Batch struct {
+	XMLName xml.Name       `xml:"http://www.w3.org/2005/Atom feed"`
+	Entries []*Entry       `xml:"http://www.w3.org/2005/Atom entry"`
+	Deleted []DeletedEntry `xml:"http://purl.org/atompub/tombstones/1.0 deleted-entry"`
+}
+
+type DeletedEntry struct {
+	Ref string `xml:"ref,attr"`
+}
+
+// applies every change of the batch, or none; returns the created and
+// replaced entries
+func (b *Backend) Batch(r *http.Request, batch *Batch) (feed *Feed, err *HTTPError) {
+	if len(batch.Entries)+len(batch.Deleted) == 0 {
+		return nil, &HTTPError{code: http.StatusBadRequest, message: "empty batch"}
+	}
+
+	// validate all, before changing anything
+	creates := make(map[*Entry]string)
+	updates := make(map[*Entry]string)
+	seen := make(map[string]bool)
+	for k, v := range batch.Entries {
+		if v.Id.Target == "" {
+			if v.Source == nil || v.Source.Id == nil {
+				return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("entry %d: new entries need the source id of their collection", k+1)}
+			} else if u, e := uuid.Parse(v.Source.Id.Target); e != nil {
+				return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("entry %d: cannot parse source id as urn:uuid", k+1)}
+			} else if _, ok := b.sourcemap["/feed/"+u.String()]; !ok {
+				return nil, &HTTPError{code: http.StatusNotFound, message: fmt.Sprintf("entry %d: no collection %s", k+1, v.Source.Id.Target)}
+			} else if e := b.degraded("/feed/" + u.String()); e != nil {
+				return nil, e
+			} else {
+				creates[v] = "/feed/" + u.String()
+			}
+			continue
+		}
+		u, e := uuid.Parse(v.Id.Target)
+		if e != nil {
+			return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("entry %d: cannot parse id as urn:uuid", k+1)}
+		}
+		entry_URL := "/entry/" + u.String()
+		if entry, ok := b.entrymap[entry_URL]; !ok {
+			return nil, &HTTPError{code: http.StatusNotFound, message: fmt.Sprintf("entry %d: no entry %s", k+1, v.Id.Target)}
+		} else if seen[entry_URL] {
+			return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("entry %d: %s changed twice", k+1, v.Id.Target)}
+		} else if v.Source = entry.Source; false {
+			// cannot change the source
+		} else if _, e := v.Validate(nil); e != nil {
+			return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("entry %d: invalid atom entry", k+1)}
+		} else {
+			updates[v] = entry_URL
+			seen[entry_URL] = true
+		}
+	}
+	deletes := make([]string, 0, len(batch.Deleted))
+	for k, v := range batch.Deleted {
+		if u, e := uuid.Parse(strings.TrimPrefix(v.Ref, "urn:uuid:")); e != nil {
+			return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("deleted-entry %d: cannot parse ref as urn:uuid", k+1)}
+		} else if _, ok := b.entrymap["/entry/"+u.String()]; !ok {
+			return nil, &HTTPError{code: http.StatusNotFound, message: fmt.Sprintf("deleted-entry %d: no entry %s", k+1, v.Ref)}
+		} else if seen["/entry/"+u.String()] {
+			return nil, &HTTPError{code: http.StatusBadRequest, message: fmt.Sprintf("deleted-entry %d: %s changed twice", k+1, v.Ref)}
+		} else {
+			deletes = append(deletes, "/entry/"+u.String())
+			seen["/entry/"+u.String()] = true
+		}
+	}
+
+	// then apply, in document order, and the deletions last
+	if e := b.begin(); e != nil {
+		return nil, &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = b.finish(err) }()
+	fail := func(k int, e *HTTPError) (*Feed, *HTTPError) {
+		e.message = strings.TrimSpace(fmt.Sprintf("item %d: %s", k+1, e.message))
+		return nil, e
+	}
+	entry_ptrs := make([]*Entry, 0, len(batch.Entries))
+	for k, v := range batch.Entries {
+		if feed_URL, ok := creates[v]; ok {
+			uuid_string := uuid.NewString()
+			if batchEntry(v, b.sourcemap[feed_URL], uuid_string); false {
+				//
+			} else if _, e := b.addEntry(b.sourcemap[feed_URL], v, uuid_string); e != nil {
+				return fail(k, e)
+			} else {
+				entry_ptrs = append(entry_ptrs, v)
+			}
+		} else {
+			er := r.Clone(r.Context())
+			er.Method, er.URL.Path, er.URL.RawQuery = "PUT", updates[v], ""
+			if e := b.PutEntry(er, v); e != nil {
+				return fail(k, e)
+			} else if entry, e := b.GetEntry(er); e != nil {
+				return fail(k, e)
+			} else {
+				entry_ptrs = append(entry_ptrs, entry)
+			}
+		}
+	}
+	for k, v := range deletes {
+		dr := r.Clone(r.Context())
+		dr.Method, dr.URL.Path, dr.URL.RawQuery = "DELETE", v, ""
+		if e := b.DeleteEntry(dr); e != nil {
+			return fail(len(batch.Entries)+k, e)
+		}
+	}
+	if e := b.commit(fmt.Sprintf("%s %s: %d entries, %d deleted", r.Method, r.URL.Path, len(batch.Entries), len(deletes))); e != nil {
+		return nil, &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+
+	return &Feed{
+		Id: &URI{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
+			Target:  "urn:uuid:" + uuid.NewString(),
+		},
+		Title: &TextConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
+			Text:    "batch results",
+		},
+		Updated: &DateConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
+			T:       time.Now().Round(time.Second),
+		},
+		Links: []Link{{
+			Href:     r.URL.Path,
+			Relation: "self",
+			Type:     "application/atom+xml",
+		}},
+		Entries: entry_ptrs,
+	}, nil
+}
+
+// a new entry of the batch is stored as given, with the id, the times
+// and the source a POST sets
+func batchEntry(entry *Entry, source *Source, uuid_string string) {
+	entry.Id = URI{
+		XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
+		Target:  "urn:uuid:" + uuid_string,
+	}
+	entry.Updated = DateConstruct{
+		XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
+		T:       time.Now().Round(time.Second),
+	}
+	if entry.Published == nil {
+		entry.Published = &DateConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "published"},
+			T:       entry.Updated.T,
+		}
+	}
+	entry.Source = source
+}
+
+func (h *Handler) postBatch(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if r.Header.Get("Content-Type") != "application/atom+xml;type=feed" {
+		err = &HTTPError{code: http.StatusUnsupportedMediaType, message: "content-type must be application/atom+xml;type=feed"}
+		return
+	}
+
+	batch := &Batch{}
+	err = &HTTPError{code: http.StatusInternalServerError}
+	if e := xml.NewDecoder(r.Body).Decode(batch); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: "could not unmarshal request body"}
+	} else if feed, e := h.B.Batch(r, batch); e != nil {
+		err = e
+	} else if h.buf.Reset(); false {
+		//
+	} else if _, e := h.buf.WriteString(xml.Header); e != nil {
+		//
+	} else if h.bw.Reset(h.buf); false {
+		//
+	} else if e := feed.MarshalTo(h.bw); e != nil {
+		//
+	} else if e := h.bw.Flush(); e != nil {
+		//
+	} else if w.Header().Set("Content-Type", "application/atom+xml;type=feed"); false {
+		//
+	} else {
+		return h.buf.Bytes(), nil
+	}
+	return
+}
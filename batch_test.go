@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// counts the commits of the storer it wraps
+type countingStorer struct {
+	Storer
+	commits int
+}
+
+func (s *countingStorer) Commit(message string) error {
+	s.commits++
+	return s.Storer.Commit(message)
+}
+
+func TestBatch(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := &countingStorer{Storer: NewBillyStorer(tmpdir)}
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<category term="golang"/>
+<category term="go"/>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+
+	res, _ := do("POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	entries := make([]*Entry, 0, 3)
+	for _, text := range []string{"one cat:golang", "two cat:golang", "three"} {
+		res, body := do("POST", feed_URL, "text/plain", text)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry := &Entry{}
+		if e := xml.Unmarshal(body, entry); e != nil {
+			t.Fatal(e)
+		}
+		entries = append(entries, entry)
+	}
+	source_id := entries[0].Source.Id.Target
+
+	// renames the category of the first two entries
+	renamed := func(entry *Entry, content string) string {
+		return fmt.Sprintf(`<entry>
+<id>%s</id><title>%s</title><updated>%s</updated>
+<category term="go"/>
+<content type="xhtml">%s</content>
+</entry>`, entry.Id.Target, entry.Title.Text, entry.Updated.T.Format("2006-01-02T15:04:05Z07:00"), content)
+	}
+	batch := func(items ...string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:at="http://purl.org/atompub/tombstones/1.0">` +
+			strings.Join(items, "\n") + `</feed>`
+	}
+	categories := func(entry *Entry) string {
+		req := httptest.NewRequest("GET", "/entry/"+strings.TrimPrefix(entry.Id.Target, "urn:uuid:"), nil)
+		e, _ := h.B.GetEntry(req)
+		terms := make([]string, 0, 2)
+		for _, c := range e.Categories {
+			terms = append(terms, c.Term)
+		}
+		return strings.Join(terms, " ")
+	}
+	xhtml := `<div xmlns="http://www.w3.org/1999/xhtml"><p>renamed</p></div>`
+
+	// one bad item fails the whole batch
+	commits := s.commits
+	res, _ = do("POST", "/batch", "application/atom+xml;type=feed", batch(
+		renamed(entries[0], xhtml),
+		renamed(entries[1], `<div xmlns="http://www.w3.org/1999/xhtml"><script/></div>`),
+		`<at:deleted-entry ref="`+entries[2].Id.Target+`"/>`,
+	))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	} else if s.commits != commits {
+		t.Fatalf("failed batch committed")
+	} else if c := categories(entries[0]); c != "golang" {
+		t.Fatalf("failed batch changed categories to %q", c)
+	} else if res, _ := do("GET", "/entry/"+strings.TrimPrefix(entries[2].Id.Target, "urn:uuid:"), "", ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("failed batch deleted an entry")
+	}
+
+	// a good one commits once
+	res, body := do("POST", "/batch", "application/atom+xml;type=feed", batch(
+		renamed(entries[0], xhtml),
+		renamed(entries[1], xhtml),
+		`<entry><title>four</title><author><name>John Doe</name></author><summary>the fourth</summary>
+<category term="four" scheme="https://example.org/numbers"/>
+<content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>four</p></div></content>
+<source><id>`+source_id+`</id></source></entry>`,
+		`<at:deleted-entry ref="`+entries[2].Id.Target+`"/>`,
+	))
+	results := &Feed{}
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status, string(body))
+	} else if s.commits != commits+1 {
+		t.Fatalf("batch made %d commits", s.commits-commits)
+	} else if e := xml.Unmarshal(body, results); e != nil {
+		t.Fatal(e)
+	} else if len(results.Entries) != 3 {
+		t.Fatalf("unexpected results %s", body)
+	} else if created := results.Entries[2]; created.Content.Type != "xhtml" || created.Summary == nil || created.Summary.Text != "the fourth" || len(created.Authors) != 1 || created.Authors[0].Name != "John Doe" {
+		t.Fatalf("created entry not as given %s", body)
+	} else if len(created.Categories) != 1 || created.Categories[0].Scheme != "https://example.org/numbers" {
+		t.Fatalf("created entry without its category %s", body)
+	} else if categories(entries[0]) != "go" || categories(entries[1]) != "go" {
+		t.Fatalf("categories not renamed")
+	} else if res, _ := do("GET", "/entry/"+strings.TrimPrefix(entries[2].Id.Target, "urn:uuid:"), "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("entry not deleted")
+	} else if res, body := do("GET", "/search?q=four", "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title type=\"text\">four</title>") {
+		t.Fatalf("created entry not found %s", body)
+	}
+}
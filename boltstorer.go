@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// a Storer keeping the objects in a bbolt database, one bucket per
+// tree directory, so that startup does not walk a git tree
+//
+// entries are also indexed by source, under {source uuid}/{entry uuid},
+// and every Commit is a single bbolt transaction
+type BoltStorer struct {
+	db          *bolt.DB
+	staged      map[[2]string][]byte // bucket and key, nil to remove
+	index       map[string]bool      // index keys, false to remove
+	begun       map[[2]string][]byte // staged at Begin, nil if not begun
+	begun_index map[string]bool      // index at Begin
+	head        string
+	bw          *bufio.Writer
+	buf         *bytes.Buffer
+}
+
+// buckets besides the tree_dirs
+var (
+	bolt_index_bucket = []byte("entry-by-source")
+	bolt_meta_bucket  = []byte("meta")
+	bolt_head_key     = []byte("head")
+)
+
+func NewBoltStorer(db_path string) *BoltStorer {
+	s := &BoltStorer{
+		staged: make(map[[2]string][]byte),
+		index:  make(map[string]bool),
+		bw:     bufio.NewWriter(nil),
+		buf:    bytes.NewBuffer(nil),
+	}
+	if db, e := bolt.Open(db_path, 0600, &bolt.Options{Timeout: 5 * time.Second}); e != nil {
+		panic(e)
+	} else {
+		s.db = db
+	}
+	if e := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([]string{string(bolt_index_bucket), string(bolt_meta_bucket)}, tree_dirs...) {
+			if _, e := tx.CreateBucketIfNotExists([]byte(name)); e != nil {
+				return e
+			}
+		}
+		s.head = string(tx.Bucket(bolt_meta_bucket).Get(bolt_head_key))
+		return nil
+	}); e != nil {
+		panic(e)
+	} else if s.head != "" {
+		//
+	} else if e := s.Commit("init commit"); e != nil {
+		panic(e)
+	}
+	return s
+}
+
+// releases the database, which is locked while open
+func (s *BoltStorer) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped), loaded func(entry_URL string, entry *Entry)) (err error) {
+	return s.db.View(func(tx *bolt.Tx) (err error) {
+		entries := tx.Bucket([]byte("entry"))
+		skipped_entries := 0
+		if e := tx.Bucket([]byte("source")).ForEach(func(k, v []byte) (err error) {
+			if feed_URL, source, e := decodeSource(bytes.NewReader(v)); e != nil {
+				err = skipOrFail(skip, "source/"+string(k), nil, e)
+			} else {
+				sourcemap[feed_URL] = source
+			}
+			return
+		}); e != nil {
+			err = e
+		} else if e := tx.Bucket(bolt_index_bucket).ForEach(func(k, _ []byte) (err error) {
+			// the entries, source by source
+			name := "entry/" + string(k[bytes.IndexByte(k, '/')+1:])
+			if v := entries.Get(k[bytes.IndexByte(k, '/')+1:]); v == nil {
+				err = fmt.Errorf("index refers to a missing entry: %s", name)
+			} else if entry_URL, entry, e := decodeEntry(bytes.NewReader(v), name, sourcemap); e != nil {
+				skipped_entries++
+				err = skipOrFail(skip, name, entry, e)
+			} else if entrymap[entry_URL] = entry; loaded != nil {
+				loaded(entry_URL, entry)
+			}
+			return
+		}); e != nil {
+			err = e
+		} else if n := entries.Stats().KeyN; n != len(entrymap)+skipped_entries {
+			err = fmt.Errorf("%d entries are missing from the index", n-len(entrymap)-skipped_entries)
+		} else if e := tx.Bucket([]byte("workspace")).ForEach(func(k, v []byte) (err error) {
+			if ws_URL, ws, e := decodeWorkspace(bytes.NewReader(v), "workspace/"+string(k)); e != nil {
+				err = skipOrFail(skip, "workspace/"+string(k), nil, e)
+			} else {
+				workspacemap[ws_URL] = ws
+			}
+			return
+		}); e != nil {
+			err = e
+		} else if e := tx.Bucket([]byte("subscription")).ForEach(func(k, v []byte) (err error) {
+			if sub, e := decodeSubscription(bytes.NewReader(v), "subscription/"+string(k)); e != nil {
+				err = skipOrFail(skip, "subscription/"+string(k), nil, e)
+			} else {
+				subscriptionmap[sub.Key()] = sub
+			}
+			return
+		}); e != nil {
+			err = e
+		}
+		return
+	})
+}
+
+func (s *BoltStorer) stage(bucket string, key string, marshal func(bw *bufio.Writer) error) (err error) {
+	if p, e := marshalObject(s.buf, s.bw, marshal); e != nil {
+		err = e
+	} else {
+		s.staged[[2]string{bucket, key}] = p
+	}
+	return
+}
+
+// the index key of an entry
+func boltIndexKey(entry *Entry) (key string, err error) {
+	if entry.Source == nil || entry.Source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if source_uuid, e := uuid.Parse(entry.Source.Id.Target); e != nil {
+		err = fmt.Errorf("invalid source id: %w", e)
+	} else if entry_uuid, e := uuid.Parse(entry.Id.Target); e != nil {
+		err = fmt.Errorf("invalid entry id: %w", e)
+	} else {
+		key = source_uuid.String() + "/" + entry_uuid.String()
+	}
+	return
+}
+
+func (s *BoltStorer) AddEntry(entry *Entry) (err error) {
+	if entry == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if key, e := boltIndexKey(entry); e != nil {
+		err = e
+	} else if e := s.stage("entry", key[len(key)-36:], func(bw *bufio.Writer) error {
+		return entry.MarshalTo(bw, nil)
+	}); e != nil {
+		err = e
+	} else {
+		s.index[key] = true
+	}
+	return
+}
+
+func (s *BoltStorer) DeleteEntry(entry *Entry) (err error) {
+	if entry == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if key, e := boltIndexKey(entry); e != nil {
+		err = e
+	} else {
+		s.staged[[2]string{"entry", key[len(key)-36:]}] = nil
+		s.index[key] = false
+	}
+	return
+}
+
+// reads the entry staged or committed last
+func (s *BoltStorer) ReadEntry(entry_uuid string) (entry *Entry, err error) {
+	if p, ok := s.staged[[2]string{"entry", entry_uuid}]; ok && p == nil {
+		err = fmt.Errorf("entry not found: %s", entry_uuid)
+	} else if ok {
+		entry, err = decodeEntryXML(bytes.NewReader(p))
+	} else {
+		err = s.db.View(func(tx *bolt.Tx) (err error) {
+			if p := tx.Bucket([]byte("entry")).Get([]byte(entry_uuid)); p == nil {
+				err = fmt.Errorf("entry not found: %s", entry_uuid)
+			} else {
+				// p is only valid within the transaction
+				entry, err = decodeEntryXML(bytes.NewReader(p))
+			}
+			return
+		})
+	}
+	return
+}
+
+func (s *BoltStorer) AddSource(source *Source) (err error) {
+	if source == nil || source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
+		err = fmt.Errorf("invalid source id: %w", e)
+	} else {
+		err = s.stage("source", source_uuid.String(), func(bw *bufio.Writer) error {
+			return source.MarshalTo(bw, nil, nil)
+		})
+	}
+	return
+}
+
+func (s *BoltStorer) DeleteSource(source *Source) (err error) {
+	if source == nil || source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
+		err = fmt.Errorf("invalid source id: %w", e)
+	} else {
+		s.staged[[2]string{"source", source_uuid.String()}] = nil
+	}
+	return
+}
+
+func (s *BoltStorer) AddWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		err = s.stage("workspace", ws_uuid.String(), func(bw *bufio.Writer) error {
+			return workspaceStub(ws).MarshalTo(bw)
+		})
+	}
+	return
+}
+
+func (s *BoltStorer) DeleteWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		s.staged[[2]string{"workspace", ws_uuid.String()}] = nil
+	}
+	return
+}
+
+func (s *BoltStorer) AddSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else {
+		err = s.stage("subscription", sub.Key(), sub.MarshalTo)
+	}
+	return
+}
+
+func (s *BoltStorer) DeleteSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else {
+		s.staged[[2]string{"subscription", sub.Key()}] = nil
+	}
+	return
+}
+
+// writes the staged changes and the new head in one transaction
+func (s *BoltStorer) Commit(message string) (err error) {
+	head := nextHead(s.head, message)
+	if e := s.db.Update(func(tx *bolt.Tx) (err error) {
+		for k, v := range s.staged {
+			if b := tx.Bucket([]byte(k[0])); v == nil {
+				err = b.Delete([]byte(k[1]))
+			} else {
+				err = b.Put([]byte(k[1]), v)
+			}
+			if err != nil {
+				return
+			}
+		}
+		index := tx.Bucket(bolt_index_bucket)
+		for k, v := range s.index {
+			if v {
+				err = index.Put([]byte(k), []byte{})
+			} else {
+				err = index.Delete([]byte(k))
+			}
+			if err != nil {
+				return
+			}
+		}
+		return tx.Bucket(bolt_meta_bucket).Put(bolt_head_key, []byte(head))
+	}); e != nil {
+		err = e
+	} else {
+		s.head = head
+		s.staged = make(map[[2]string][]byte)
+		s.index = make(map[string]bool)
+	}
+	return
+}
+
+// nothing is written before Commit, so Begin only saves what is staged,
+// which stays staged after a Rollback
+func (s *BoltStorer) Begin() (err error) {
+	s.begun, s.begun_index = maps.Clone(s.staged), maps.Clone(s.index)
+	return
+}
+
+func (s *BoltStorer) Rollback() (err error) {
+	if s.begun == nil {
+		return fmt.Errorf("rollback without begin")
+	}
+	s.staged, s.index = s.begun, s.begun_index
+	s.begun, s.begun_index = nil, nil
+	return
+}
+
+// hash of the last commit, derived from the previous one and the message
+func (s *BoltStorer) Head() (hash string, err error) {
+	return s.head, nil
+}
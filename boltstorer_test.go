@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBoltStorerMigrate(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	var tmpdb = "/tmp/bolt-test.db"
+	var tmpdir_back = "/tmp/gitdir-test-back"
+	newHandler := func(s Storer) *Handler {
+		return &Handler{
+			B:     NewBackend(s),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler(NewBillyStorer(tmpdir))
+
+	defer func() {
+		for _, v := range []string{tmpdir, tmpdb, tmpdir_back} {
+			if e := os.RemoveAll(v); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(h *Handler, method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := do(h, "POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	var entry_URLs []string
+	for _, text := range []string{"first post", "second post", "third post"} {
+		res := do(h, "POST", feed_URL, "text/plain", text)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+	}
+
+	if e := migrate("git:"+tmpdir, "bolt:"+tmpdb); e != nil {
+		t.Fatal(e)
+	} else if e := migrate("git:"+tmpdir, "bolt:"+tmpdb); e == nil {
+		t.Fatal("migrated into a non-empty storer")
+	}
+
+	// the bolt database serves, and keeps, the same state
+	s := NewBoltStorer(tmpdb)
+	h = newHandler(s)
+	for _, v := range entry_URLs {
+		if res := do(h, "GET", v, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+	if res := do(h, "DELETE", entry_URLs[0], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// a rollback keeps what was staged before Begin
+	entrymap := h.B.(*Backend).entrymap
+	if e := s.DeleteEntry(entrymap[entry_URLs[1]]); e != nil {
+		t.Fatal(e)
+	} else if e := s.Begin(); e != nil {
+		t.Fatal(e)
+	} else if e := s.DeleteEntry(entrymap[entry_URLs[2]]); e != nil {
+		t.Fatal(e)
+	} else if e := s.Rollback(); e != nil {
+		t.Fatal(e)
+	} else if e := s.Commit("delete"); e != nil {
+		t.Fatal(e)
+	} else if e := s.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	// and back into git
+	if e := migrate("bolt:"+tmpdb, "git:"+tmpdir_back); e != nil {
+		t.Fatal(e)
+	}
+	h = newHandler(NewBillyStorer(tmpdir_back))
+	if res := do(h, "GET", entry_URLs[0], "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", entry_URLs[1], "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", entry_URLs[2], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", feed_URL, "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+}
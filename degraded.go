@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// a Backend starts with whatever its storer can load; the objects it
+// cannot are skipped and listed at /admin/skipped, and the collections
+// they belong to are read-only until they are repaired, e.g. by fsck
+
+func (b *Backend) skip(s Skipped) {
+	log.Printf("skipped %s: %s", s.Name, s.Reason)
+	b.skipped = append(b.skipped, s)
+}
+
+// refuses writes to a collection with skipped objects, and to all of them
+// while an entry of an unknown collection is skipped
+func (b *Backend) degraded(feed_URL string) *HTTPError {
+	for _, v := range b.skipped {
+		if v.FeedURL == feed_URL || v.FeedURL == "" && strings.HasPrefix(v.Name, "entry/") {
+			return &HTTPError{code: http.StatusServiceUnavailable, message: "collection has objects which could not be loaded, see /admin/skipped"}
+		}
+	}
+	return nil
+}
+
+func (b *Backend) degradedEntry(entry *Entry) *HTTPError {
+	if entry.Source == nil || entry.Source.Id == nil {
+		return nil
+	}
+	return b.degraded("/feed/" + strings.TrimPrefix(entry.Source.Id.Target, "urn:uuid:"))
+}
+
+func (b *Backend) GetSkipped(r *http.Request) (skipped []Skipped, err *HTTPError) {
+	return b.skipped, nil
+}
+
+func (h *Handler) serveSkipped(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	skipped, e := h.B.GetSkipped(r)
+	if e != nil {
+		return nil, e
+	} else if skipped == nil {
+		skipped = []Skipped{}
+	}
+	if body, err = json.Marshal(skipped); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return
+}
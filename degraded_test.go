@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDegradedStartup(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	newHandler := func() *Handler {
+		return &Handler{
+			B:     NewBackend(NewBillyStorer(tmpdir)),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler()
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+
+	var feed_URLs, entry_URLs []string
+	for range 2 {
+		res, _ := do("POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed_URLs = append(feed_URLs, res.Header.Get("Location"))
+		res, _ = do("POST", res.Header.Get("Location"), "text/plain", "a good post")
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+	}
+
+	// break an entry of the first collection, and cut another short
+	s := NewBillyStorer(tmpdir)
+	good, e := s.ReadEntry(path.Base(entry_URLs[0]))
+	if e != nil {
+		t.Fatal(e)
+	} else if e := s.AddEntry(good); e != nil {
+		t.Fatal(e)
+	}
+	f, _ := s.fsys.Open("entry/" + path.Base(entry_URLs[0]))
+	p, _ := io.ReadAll(f)
+	f.Close()
+	invalid_uuid, truncated_uuid := uuid.NewString(), uuid.NewString()
+	broken := map[string][]byte{
+		"entry/" + invalid_uuid:   regexp.MustCompile(`<title type="text">[^<]*</title>`).ReplaceAll(bytes.ReplaceAll(p, []byte(path.Base(entry_URLs[0])), []byte(invalid_uuid)), []byte(`<title type="text"></title>`)),
+		"entry/" + truncated_uuid: bytes.ReplaceAll(p[:bytes.LastIndex(p, []byte("</entry>"))], []byte(path.Base(entry_URLs[0])), []byte(truncated_uuid)),
+	}
+	store := func(s *BillyStorer, objects map[string][]byte) {
+		for k, v := range objects {
+			if f, e := s.fsys.Create(k); e != nil {
+				t.Fatal(e)
+			} else if _, e := f.Write(v); e != nil {
+				t.Fatal(e)
+			} else if e := f.Close(); e != nil {
+				t.Fatal(e)
+			}
+		}
+		if e := s.Commit("break things"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	store(s, broken)
+
+	// starts anyway, with the rest
+	h = newHandler()
+	skipped := []Skipped{}
+	if res, body := do("GET", "/admin/skipped", "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if e := json.Unmarshal(body, &skipped); e != nil {
+		t.Fatal(e)
+	} else if len(skipped) != 2 {
+		t.Fatalf("unexpected skipped objects %s", body)
+	}
+	for _, v := range skipped {
+		if _, ok := broken[v.Name]; !ok {
+			t.Fatalf("unexpected skipped object %s", v.Name)
+		} else if v.FeedURL != feed_URLs[0] {
+			t.Fatalf("skipped entry in %q, not %s", v.FeedURL, feed_URLs[0])
+		}
+	}
+	for _, v := range entry_URLs {
+		if res, _ := do("GET", v, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+
+	// only the affected collection is read-only
+	if res, _ := do("POST", feed_URLs[0], "text/plain", "refused"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(res.Status)
+	} else if res, _ := do("DELETE", entry_URLs[0], "", ""); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(res.Status)
+	} else if res, _ := do("POST", feed_URLs[1], "text/plain", "accepted"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// and does not take mentions either
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<p><a href="https://example.org`+entry_URLs[0]+`">a mention</a></p>`)
+	}))
+	defer source.Close()
+	wm := &Webmention{b: h.B.(*Backend), base_URL: "https://example.org", mutex: h.mutex, client: source.Client()}
+	entry := h.B.(*Backend).entrymap[entry_URLs[0]]
+	n := len(entry.Links)
+	if e := wm.verify(source.URL, wm.base_URL+entry_URLs[0], entry_URLs[0]); e == nil {
+		t.Fatal("mention of a read-only collection accepted")
+	} else if len(entry.Links) != n {
+		t.Fatalf("%d links after a refused mention", len(entry.Links))
+	}
+
+	// until it is repaired
+	if _, e := fsck(tmpdir, true, nil, io.Discard); e != nil {
+		t.Fatal(e)
+	}
+	h = newHandler()
+	if res, body := do("GET", "/admin/skipped", "", ""); res.StatusCode != http.StatusOK || string(body) != "[]" {
+		t.Fatalf("%s %s", res.Status, body)
+	} else if res, _ := do("POST", feed_URLs[0], "text/plain", "accepted"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// an entry of which not even the collection can be read makes all of
+	// them read-only
+	store(NewBillyStorer(tmpdir), map[string][]byte{"entry/" + uuid.NewString(): []byte("<entry")})
+	h = newHandler()
+	if res, _ := do("POST", feed_URLs[1], "text/plain", "refused"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(res.Status)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// a Storer keeping the objects as plain files under a directory,
+// laid out like the git tree, for deployments without git
+//
+// changes are staged in memory, and written on Commit by writing a
+// temporary file, syncing it and renaming it into place
+type DirStorer struct {
+	dir    string
+	staged map[string][]byte // path relative to dir, nil to remove
+	begun  map[string][]byte // staged at Begin, nil if not begun
+	head   string
+	bw     *bufio.Writer
+	buf    *bytes.Buffer
+}
+
+// name of the file holding the hash of the last commit
+const dir_head_file = "HEAD"
+
+// prefix of temporary files, which are ignored and cleaned up
+const dir_temp_prefix = ".tmp-"
+
+func NewDirStorer(dir string) *DirStorer {
+	s := &DirStorer{
+		dir:    dir,
+		staged: make(map[string][]byte),
+		bw:     bufio.NewWriter(nil),
+		buf:    bytes.NewBuffer(nil),
+	}
+	for _, d := range tree_dirs {
+		if e := os.MkdirAll(filepath.Join(dir, d), os.ModePerm); e != nil {
+			panic(e)
+		} else if e := s.removeTemp(d); e != nil {
+			panic(e)
+		}
+	}
+	if p, e := os.ReadFile(filepath.Join(dir, dir_head_file)); e == nil {
+		s.head = strings.TrimSpace(string(p))
+	} else if !os.IsNotExist(e) {
+		panic(e)
+	} else if e := s.Commit("init commit"); e != nil {
+		panic(e)
+	}
+	return s
+}
+
+// reads the head again, e.g. after the directory was restored from a
+// backup, which Populate reads as it is; there must be nothing staged
+func (s *DirStorer) Reload() (next Storer, swap func(), err error) {
+	if len(s.staged) != 0 {
+		return nil, nil, fmt.Errorf("reload with staged changes")
+	} else if p, e := os.ReadFile(filepath.Join(s.dir, dir_head_file)); e != nil {
+		return nil, nil, e
+	} else {
+		return s, func() { s.head = strings.TrimSpace(string(p)) }, nil
+	}
+}
+
+// removes the leftovers of a Commit which was interrupted
+func (s *DirStorer) removeTemp(d string) (err error) {
+	if entries, e := os.ReadDir(filepath.Join(s.dir, d)); e != nil {
+		err = e
+	} else {
+		for _, v := range entries {
+			if !strings.HasPrefix(v.Name(), dir_temp_prefix) {
+				continue
+			} else if e := os.Remove(filepath.Join(s.dir, d, v.Name())); e != nil {
+				return e
+			}
+		}
+	}
+	return
+}
+
+// calls fn with the name, {d}/{name}, and the open file of every object in d
+func (s *DirStorer) walk(d string, fn func(name string, f *os.File) error) (err error) {
+	entries, e := os.ReadDir(filepath.Join(s.dir, d))
+	if e != nil {
+		return e
+	}
+	for _, v := range entries {
+		if v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+			continue
+		} else if f, e := os.Open(filepath.Join(s.dir, d, v.Name())); e != nil {
+			return e
+		} else if e := fn(d+"/"+v.Name(), f); e != nil {
+			f.Close()
+			return e
+		} else if e := f.Close(); e != nil {
+			return e
+		}
+	}
+	return
+}
+
+func (s *DirStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped), loaded func(entry_URL string, entry *Entry)) (err error) {
+	if e := s.walk("source", func(name string, f *os.File) (err error) {
+		if feed_URL, source, e := decodeSource(f); e != nil {
+			err = skipOrFail(skip, name, nil, e)
+		} else {
+			sourcemap[feed_URL] = source
+		}
+		return
+	}); e != nil {
+		err = e
+	} else if e := s.walk("entry", func(name string, f *os.File) (err error) {
+		if entry_URL, entry, e := decodeEntry(f, name, sourcemap); e != nil {
+			err = skipOrFail(skip, name, entry, e)
+		} else if entrymap[entry_URL] = entry; loaded != nil {
+			loaded(entry_URL, entry)
+		}
+		return
+	}); e != nil {
+		err = e
+	} else if e := s.walk("workspace", func(name string, f *os.File) (err error) {
+		if ws_URL, ws, e := decodeWorkspace(f, name); e != nil {
+			err = skipOrFail(skip, name, nil, e)
+		} else {
+			workspacemap[ws_URL] = ws
+		}
+		return
+	}); e != nil {
+		err = e
+	} else if e := s.walk("subscription", func(name string, f *os.File) (err error) {
+		if sub, e := decodeSubscription(f, name); e != nil {
+			err = skipOrFail(skip, name, nil, e)
+		} else {
+			subscriptionmap[sub.Key()] = sub
+		}
+		return
+	}); e != nil {
+		err = e
+	}
+	return
+}
+
+// marshals an object into the staging area
+func (s *DirStorer) stage(name string, marshal func(bw *bufio.Writer) error) (err error) {
+	if p, e := marshalObject(s.buf, s.bw, marshal); e != nil {
+		err = e
+	} else {
+		s.staged[name] = p
+	}
+	return
+}
+
+// the stored form of an object, as the BillyStorer writes it
+func marshalObject(buf *bytes.Buffer, bw *bufio.Writer, marshal func(bw *bufio.Writer) error) (p []byte, err error) {
+	out := bytes.NewBuffer(nil)
+	if buf.Reset(); false {
+		//
+	} else if _, e := buf.WriteString(xml.Header); e != nil {
+		err = e
+	} else if bw.Reset(buf); false {
+		//
+	} else if e := marshal(bw); e != nil {
+		err = e
+	} else if e := bw.Flush(); e != nil {
+		err = e
+	} else if e := writeLines(out, buf); e != nil {
+		err = e
+	} else {
+		p = out.Bytes()
+	}
+	return
+}
+
+func (s *DirStorer) AddEntry(entry *Entry) (err error) {
+	if entry == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if entry_uuid, e := uuid.Parse(entry.Id.Target); e != nil {
+		err = fmt.Errorf("invalid entry id: %w", e)
+	} else {
+		err = s.stage(filepath.Join("entry", entry_uuid.String()), func(bw *bufio.Writer) error {
+			return entry.MarshalTo(bw, nil)
+		})
+	}
+	return
+}
+
+func (s *DirStorer) DeleteEntry(entry *Entry) (err error) {
+	if entry == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if entry_uuid, e := uuid.Parse(entry.Id.Target); e != nil {
+		err = fmt.Errorf("invalid entry id: %w", e)
+	} else {
+		s.staged[filepath.Join("entry", entry_uuid.String())] = nil
+	}
+	return
+}
+
+// reads the entry staged or committed last
+func (s *DirStorer) ReadEntry(entry_uuid string) (entry *Entry, err error) {
+	name := filepath.Join("entry", entry_uuid)
+	if p, ok := s.staged[name]; ok && p == nil {
+		err = fmt.Errorf("entry not found: %s", entry_uuid)
+	} else if ok {
+		entry, err = decodeEntryXML(bytes.NewReader(p))
+	} else if f, e := os.Open(filepath.Join(s.dir, name)); e != nil {
+		err = e
+	} else {
+		defer f.Close()
+		entry, err = decodeEntryXML(f)
+	}
+	return
+}
+
+func (s *DirStorer) AddSource(source *Source) (err error) {
+	if source == nil || source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
+		err = fmt.Errorf("invalid source id: %w", e)
+	} else {
+		err = s.stage(filepath.Join("source", source_uuid.String()), func(bw *bufio.Writer) error {
+			return source.MarshalTo(bw, nil, nil)
+		})
+	}
+	return
+}
+
+func (s *DirStorer) DeleteSource(source *Source) (err error) {
+	if source == nil || source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
+		err = fmt.Errorf("invalid source id: %w", e)
+	} else {
+		s.staged[filepath.Join("source", source_uuid.String())] = nil
+	}
+	return
+}
+
+func (s *DirStorer) AddWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		err = s.stage(filepath.Join("workspace", ws_uuid.String()), func(bw *bufio.Writer) error {
+			return workspaceStub(ws).MarshalTo(bw)
+		})
+	}
+	return
+}
+
+func (s *DirStorer) DeleteWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		s.staged[filepath.Join("workspace", ws_uuid.String())] = nil
+	}
+	return
+}
+
+func (s *DirStorer) AddSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else {
+		err = s.stage(filepath.Join("subscription", sub.Key()), sub.MarshalTo)
+	}
+	return
+}
+
+func (s *DirStorer) DeleteSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else {
+		s.staged[filepath.Join("subscription", sub.Key())] = nil
+	}
+	return
+}
+
+// writes the staged changes, then the new head; a crash in between leaves
+// every file either old or new, but possibly a mix of both commits
+func (s *DirStorer) Commit(message string) (err error) {
+	names := make([]string, 0, len(s.staged))
+	for k := range s.staged {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		if p := s.staged[name]; p == nil {
+			if e := os.Remove(filepath.Join(s.dir, name)); e != nil && !os.IsNotExist(e) {
+				return e
+			}
+		} else if e := writeFileSync(filepath.Join(s.dir, name), p); e != nil {
+			return e
+		}
+		dirs[filepath.Dir(name)] = true
+	}
+	for d := range dirs {
+		if e := syncDir(filepath.Join(s.dir, d)); e != nil {
+			return e
+		}
+	}
+
+	head := nextHead(s.head, message)
+	if e := writeFileSync(filepath.Join(s.dir, dir_head_file), []byte(head+"\n")); e != nil {
+		err = e
+	} else if e := syncDir(s.dir); e != nil {
+		err = e
+	} else {
+		s.head = head
+		s.staged = make(map[string][]byte)
+	}
+	return
+}
+
+// nothing is written before Commit, so Begin only saves what is staged,
+// which stays staged after a Rollback
+func (s *DirStorer) Begin() (err error) {
+	s.begun = maps.Clone(s.staged)
+	return
+}
+
+func (s *DirStorer) Rollback() (err error) {
+	if s.begun == nil {
+		return fmt.Errorf("rollback without begin")
+	}
+	s.staged, s.begun = s.begun, nil
+	return
+}
+
+// hash of the last commit, derived from the previous one and the message
+func (s *DirStorer) Head() (hash string, err error) {
+	return s.head, nil
+}
+
+// storers without git chain their commits by hashing the previous head
+func nextHead(head string, message string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%d\n%s", head, time.Now().UnixNano(), message)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replaces the file at name by p, atomically
+func writeFileSync(name string, p []byte) (err error) {
+	f, e := os.CreateTemp(filepath.Dir(name), dir_temp_prefix)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write(p); e != nil {
+		err = e
+	} else if e := f.Sync(); e != nil {
+		err = e
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// makes renames and removals in dir durable
+func syncDir(dir string) (err error) {
+	if f, e := os.Open(dir); e != nil {
+		err = e
+	} else if e := f.Sync(); e != nil {
+		f.Close()
+		err = e
+	} else {
+		err = f.Close()
+	}
+	return
+}
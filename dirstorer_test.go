@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDirStorer(t *testing.T) {
+	var tmpdir = "/tmp/datadir-test"
+	newHandler := func() *Handler {
+		return &Handler{
+			B:     NewBackend(NewDirStorer(tmpdir)),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler()
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(h *Handler, method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := do(h, "POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	head, _ := h.B.(*Backend).storer.Head()
+
+	var entry_URLs []string
+	for _, text := range []string{"first post", "second post"} {
+		res := do(h, "POST", feed_URL, "text/plain", text)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+	}
+	if res := do(h, "DELETE", entry_URLs[0], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if h, _ := h.B.(*Backend).storer.Head(); h == head {
+		t.Fatalf("head did not move")
+	}
+
+	// plain files, and no leftovers
+	if files, e := os.ReadDir(filepath.Join(tmpdir, "entry")); e != nil {
+		t.Fatal(e)
+	} else if len(files) != 1 || "/entry/"+files[0].Name() != entry_URLs[1] {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	// a restart finds the same state
+	h = newHandler()
+	if res := do(h, "GET", feed_URL, "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", entry_URLs[1], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", entry_URLs[0], "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	}
+
+	// a rollback keeps what was staged before Begin
+	res = do(h, "POST", feed_URL, "text/plain", "third post")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+	b := h.B.(*Backend)
+	s := b.storer.(*DirStorer)
+	if e := s.DeleteEntry(b.entrymap[entry_URLs[1]]); e != nil {
+		t.Fatal(e)
+	} else if e := s.Begin(); e != nil {
+		t.Fatal(e)
+	} else if e := s.DeleteEntry(b.entrymap[entry_URLs[2]]); e != nil {
+		t.Fatal(e)
+	} else if e := s.Rollback(); e != nil {
+		t.Fatal(e)
+	} else if e := s.Commit("delete"); e != nil {
+		t.Fatal(e)
+	}
+	h = newHandler()
+	if res := do(h, "GET", entry_URLs[1], "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res := do(h, "GET", entry_URLs[2], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+}
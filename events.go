@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// number of past events kept for Last-Event-ID resume
+const max_event_history = 256
+
+// buffered events per client; slower clients are dropped and
+// expected to reconnect with Last-Event-ID
+const event_client_buffer = 64
+
+const event_heartbeat = 30 * time.Second
+
+type event struct {
+	id      string // {commit}-{n}, n counting the changes of the commit
+	feed    string
+	message []byte
+}
+
+type eventClient struct {
+	feed string // empty for all collections
+	ch   chan []byte
+}
+
+// Server-Sent Events stream of the changes committed by a Backend
+type EventStream struct {
+	mutex   sync.Locker // the lock of the Handler
+	history []event
+	clients map[*eventClient]bool
+	commit  string // of the last event
+	n       int    // of the last event
+}
+
+// creates the stream and registers it with b;
+// mutex must be the one held by the Handler serving b
+func NewEventStream(b *Backend, mutex sync.Locker) *EventStream {
+	es := &EventStream{
+		mutex:   mutex,
+		history: make([]event, 0, max_event_history),
+		clients: make(map[*eventClient]bool),
+	}
+	b.Observe(es)
+	return es
+}
+
+// the data of an event, as JSON
+type eventData struct {
+	Type     string `json:"type"`
+	Feed     string `json:"feed"`
+	Id       string `json:"id,omitempty"`
+	EntryURL string `json:"href,omitempty"`
+	Entry    string `json:"entry,omitempty"`
+}
+
+func (es *EventStream) Notify(b *Backend, c *Change) {
+	data := eventData{
+		Type:     c.Type,
+		Feed:     c.FeedURL,
+		EntryURL: c.EntryURL,
+	}
+	if c.Entry != nil {
+		data.Id = c.Entry.Id.Target
+		buf := bytes.NewBuffer(nil)
+		bw := bufio.NewWriter(buf)
+		if e := c.Entry.MarshalTo(bw, nil); e != nil {
+			log.Printf("events: %s", e)
+			return
+		} else if e := bw.Flush(); e != nil {
+			log.Printf("events: %s", e)
+			return
+		}
+		data.Entry = buf.String()
+	}
+
+	j, e := json.Marshal(data)
+	if e != nil {
+		log.Printf("events: %s", e)
+		return
+	}
+	// a commit, e.g. of a batch, may hold many changes
+	if c.Commit != es.commit {
+		es.commit, es.n = c.Commit, 0
+	}
+	es.n++
+	// the JSON encoding contains no newlines, so a single data field will do
+	id := fmt.Sprintf("%s-%d", c.Commit, es.n)
+	ev := event{
+		id:      id,
+		feed:    c.FeedURL,
+		message: []byte(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", id, c.Type, j)),
+	}
+
+	if len(es.history) == max_event_history {
+		copy(es.history, es.history[1:])
+		es.history = es.history[:max_event_history-1]
+	}
+	es.history = append(es.history, ev)
+
+	for client := range es.clients {
+		if client.feed != "" && client.feed != ev.feed {
+			continue
+		}
+		select {
+		case client.ch <- ev.message:
+		default:
+			close(client.ch)
+			delete(es.clients, client)
+		}
+	}
+}
+
+// registers a client, and returns the events it missed since last_id;
+// ok is false if last_id is no longer in the history
+func (es *EventStream) subscribe(feed_URL string, last_id string) (client *eventClient, missed [][]byte, ok bool) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	client = &eventClient{feed: feed_URL, ch: make(chan []byte, event_client_buffer)}
+	es.clients[client] = true
+
+	if last_id == "" {
+		// a new client only gets the events from now on
+		return client, nil, true
+	}
+	for _, ev := range es.history {
+		if !ok {
+			ok = ev.id == last_id
+		} else if feed_URL == "" || ev.feed == feed_URL {
+			missed = append(missed, ev.message)
+		}
+	}
+	if !ok {
+		missed = nil
+	}
+	return
+}
+
+func (es *EventStream) unsubscribe(client *eventClient) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.clients[client] {
+		close(client.ch)
+		delete(es.clients, client)
+	}
+}
+
+// streams the events of the collection at feed_URL, or of all
+// collections if feed_URL is empty; the caller must not hold the lock
+func (es *EventStream) serve(w http.ResponseWriter, r *http.Request, feed_URL string) (err error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &HTTPError{code: http.StatusInternalServerError, message: "streaming unsupported"}
+	}
+
+	client, missed, ok := es.subscribe(feed_URL, r.Header.Get("Last-Event-ID"))
+	defer es.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if !ok {
+		// the changes since Last-Event-ID are unknown,
+		// the client should reload the collection
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, m := range missed {
+		w.Write(m)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(event_heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case m, open := <-client.ch:
+			if !open {
+				return nil
+			}
+			w.Write(m)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// returns the feed URL of a /feed/{uuid}/events path, or "" for /events
+func eventsFeedURL(events_URL string) string {
+	if events_URL == "/events" {
+		return ""
+	}
+	return path.Dir(events_URL)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventStream(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	b := NewBackend(NewBillyStorer(tmpdir))
+	h := &Handler{
+		B:     b,
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	h.Events = NewEventStream(b, h.mutex)
+	server := httptest.NewServer(h)
+
+	defer func() {
+		server.CloseClientConnections()
+		server.Close()
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	post := func(text string) (entry_URL string) {
+		req := httptest.NewRequest("POST", feed_URL, bytes.NewBufferString(text))
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		return res.Header.Get("Location")
+	}
+
+	type message struct {
+		id    string
+		event string
+		data  eventData
+	}
+	connect := func(events_URL string, last_id string) (context.CancelFunc, chan message) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+events_URL, nil)
+		if last_id != "" {
+			req.Header.Set("Last-Event-ID", last_id)
+		}
+		res, e := http.DefaultClient.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		} else if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		ch := make(chan message, 8)
+		go func() {
+			defer close(ch)
+			sc := bufio.NewScanner(res.Body)
+			sc.Buffer(nil, 1<<20)
+			m := message{}
+			for sc.Scan() {
+				line := sc.Text()
+				if line == "" {
+					ch <- m
+					m = message{}
+				} else if v, ok := strings.CutPrefix(line, "id: "); ok {
+					m.id = v
+				} else if v, ok := strings.CutPrefix(line, "event: "); ok {
+					m.event = v
+				} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+					json.Unmarshal([]byte(v), &m.data)
+				}
+			}
+		}()
+		return cancel, ch
+	}
+
+	cancel, ch := connect(feed_URL+"/events", "")
+	entry_URL := post("Hello, dashboards")
+	m := <-ch
+	if m.event != change_created || m.data.EntryURL != entry_URL || !strings.Contains(m.data.Entry, "Hello, dashboards") {
+		t.Fatalf("unexpected event %+v", m)
+	} else if head, _ := b.storer.Head(); m.id != head+"-1" {
+		t.Fatalf("event id %s is not of the commit %s", m.id, head)
+	}
+	cancel()
+
+	// resume after the first event
+	second := post("Did you miss me?")
+	cancel, ch = connect("/events", m.id)
+	if m := <-ch; m.event != change_created || m.data.EntryURL != second {
+		t.Fatalf("unexpected replayed event %+v", m)
+	}
+
+	req = httptest.NewRequest("DELETE", second, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	if m := <-ch; m.event != change_deleted || m.data.EntryURL != second {
+		t.Fatalf("unexpected event %+v", m)
+	}
+	cancel()
+
+	// the changes of a batch share the commit, not the event id
+	cancel, ch = connect("/events", "")
+	source_id := "urn:uuid:" + strings.TrimPrefix(feed_URL, "/feed/")
+	req = httptest.NewRequest("POST", "/batch", strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<entry><title>one</title><content type="text">one</content><source><id>`+source_id+`</id></source></entry>
+<entry><title>two</title><content type="text">two</content><source><id>`+source_id+`</id></source></entry>
+</feed>`))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	first, second_of_batch := <-ch, <-ch
+	if first.id == second_of_batch.id {
+		t.Fatalf("events of a batch share the id %s", first.id)
+	}
+	cancel()
+	cancel, ch = connect("/events", first.id)
+	if m := <-ch; m.id != second_of_batch.id {
+		t.Fatalf("unexpected replayed event %+v", m)
+	}
+	cancel()
+
+	// unknown event ids ask the client to reload
+	cancel, ch = connect("/events", "0000000000000000000000000000000000000000")
+	if m := <-ch; m.event != "reset" {
+		t.Fatalf("unexpected event %+v", m)
+	}
+	cancel()
+
+	res, e := http.Get(server.URL + "/feed/00000000-0000-0000-0000-000000000000/events")
+	if e != nil {
+		t.Fatal(e)
+	} else if res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const max_page_limit = 500
+
+// query parameters accepted by GET /feed/{uuid}
+type FeedFilter struct {
+	Categories []Category // all must match; an empty Scheme matches any scheme
+	Authors    []string   // any may match, by name or uri
+	Since      time.Time
+	Until      time.Time
+
+	// paging is disabled if Limit is zero
+	Page  int
+	Limit int
+}
+
+func ParseFeedFilter(query url.Values) (f *FeedFilter, err error) {
+	f = &FeedFilter{}
+	scheme := query.Get("scheme")
+	if scheme != "" {
+		if _, e := url.Parse(scheme); e != nil {
+			err = fmt.Errorf("invalid category scheme")
+			return
+		}
+	}
+	for _, term := range query["category"] {
+		if term == "" {
+			err = fmt.Errorf("empty category term")
+			return
+		}
+		f.Categories = append(f.Categories, Category{Term: term, Scheme: scheme})
+	}
+	for _, a := range query["author"] {
+		if a == "" {
+			err = fmt.Errorf("empty author")
+			return
+		}
+		f.Authors = append(f.Authors, a)
+	}
+
+	if v := query.Get("since"); v == "" {
+		//
+	} else if t, e := time.Parse(time.RFC3339Nano, v); e != nil {
+		err = fmt.Errorf("since must be an RFC3339 timestamp")
+		return
+	} else {
+		f.Since = t
+	}
+
+	if v := query.Get("until"); v == "" {
+		//
+	} else if t, e := time.Parse(time.RFC3339Nano, v); e != nil {
+		err = fmt.Errorf("until must be an RFC3339 timestamp")
+		return
+	} else {
+		f.Until = t
+	}
+
+	if v := query.Get("limit"); v == "" {
+		//
+	} else if n, e := strconv.Atoi(v); e != nil || n < 1 || n > max_page_limit {
+		err = fmt.Errorf("limit must be between 1 and %d", max_page_limit)
+		return
+	} else {
+		f.Limit = n
+	}
+
+	if v := query.Get("page"); v == "" {
+		f.Page = 1
+	} else if n, e := strconv.Atoi(v); e != nil || n < 1 {
+		err = fmt.Errorf("page must be a positive integer")
+		return
+	} else if f.Limit == 0 {
+		err = fmt.Errorf("page requires limit")
+		return
+	} else {
+		f.Page = n
+	}
+	return
+}
+
+// true if the filter neither restricts nor pages the feed
+func (f *FeedFilter) IsZero() bool {
+	return f == nil || len(f.Categories) == 0 && len(f.Authors) == 0 && f.Since.IsZero() && f.Until.IsZero() && f.Limit == 0
+}
+
+func (f *FeedFilter) Match(entry *Entry) bool {
+	if f == nil {
+		return true
+	} else if entry == nil {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Updated.T.Before(f.Since) {
+		return false
+	} else if !f.Until.IsZero() && entry.Updated.T.After(f.Until) {
+		return false
+	}
+
+	for _, want := range f.Categories {
+		found := false
+		for _, c := range entry.Categories {
+			if c.Term == want.Term && (want.Scheme == "" || c.Scheme == want.Scheme) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Authors) == 0 {
+		return true
+	}
+	authors := entry.Authors
+	if len(authors) == 0 && entry.Source != nil {
+		// inherited from the source
+		authors = entry.Source.Authors
+	}
+	for _, want := range f.Authors {
+		for _, a := range authors {
+			if strings.EqualFold(a.Name, want) {
+				return true
+			} else if a.URI != nil && a.URI.Target == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canonical query string for the filter, with the given page
+func (f *FeedFilter) Query(page int) string {
+	v := url.Values{}
+	for _, c := range f.Categories {
+		v.Add("category", c.Term)
+		if c.Scheme != "" {
+			v.Set("scheme", c.Scheme)
+		}
+	}
+	for _, a := range f.Authors {
+		v.Add("author", a)
+	}
+	if !f.Since.IsZero() {
+		v.Set("since", f.Since.Format(time.RFC3339Nano))
+	}
+	if !f.Until.IsZero() {
+		v.Set("until", f.Until.Format(time.RFC3339Nano))
+	}
+	if f.Limit != 0 {
+		v.Set("limit", strconv.Itoa(f.Limit))
+		v.Set("page", strconv.Itoa(page))
+	}
+	return v.Encode()
+}
+
+func (f *FeedFilter) href(feed_URL string, page int) string {
+	if q := f.Query(page); q != "" {
+		return feed_URL + "?" + q
+	}
+	return feed_URL
+}
+
+// returns the entries on the current page and the paging links
+func (f *FeedFilter) Apply(feed_URL string, entry_ptrs []*Entry) (paged []*Entry, links []Link) {
+	paged = make([]*Entry, 0, len(entry_ptrs))
+	for _, v := range entry_ptrs {
+		if f.Match(v) {
+			paged = append(paged, v)
+		}
+	}
+
+	links = []Link{{
+		Href:     f.href(feed_URL, f.Page),
+		Relation: "self",
+		Type:     "application/atom+xml",
+	}}
+	if f.Limit == 0 {
+		return
+	}
+
+	// RFC 5005 paging
+	total := len(paged)
+	start := (f.Page - 1) * f.Limit
+	if start > total {
+		start = total
+	}
+	end := start + f.Limit
+	if end > total {
+		end = total
+	}
+	paged = paged[start:end]
+
+	links = append(links, Link{
+		Href:     f.href(feed_URL, 1),
+		Relation: "first",
+		Type:     "application/atom+xml",
+	})
+	if f.Page > 1 {
+		links = append(links, Link{
+			Href:     f.href(feed_URL, f.Page-1),
+			Relation: "previous",
+			Type:     "application/atom+xml",
+		})
+	}
+	if end < total {
+		links = append(links, Link{
+			Href:     f.href(feed_URL, f.Page+1),
+			Relation: "next",
+			Type:     "application/atom+xml",
+		})
+	}
+	return
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/uuid"
+)
+
+// broken objects are moved from the tree into quarantine/{dir}/{name}
+const quarantine_dir = "quarantine"
+
+// a problem found by fsck in a blob of the master tree
+type fsckProblem struct {
+	path   string
+	commit string // the last commit to change the blob
+	reason string
+}
+
+// checks every object of the master tree of the git repository at gitdir,
+// writing the problems to w, without writing to the repository; with
+// repair, the broken objects are quarantined in a new commit, signed by
+// signer if it is not nil
+func fsck(gitdir string, repair bool, signer git.Signer, w io.Writer) (problems []fsckProblem, err error) {
+	var s *BillyStorer
+	var rep *git.Repository
+	if repair {
+		// what the storer commits as it starts, a recovery or the sharding,
+		// is checked and repaired too
+		s = NewSignedBillyStorer(gitdir, signer)
+		rep = s.rep
+	} else if r, e := git.PlainOpen(gitdir); e != nil {
+		return nil, e
+	} else {
+		rep = r
+	}
+	ref, e := rep.Reference(plumbing.Master, true)
+	if e != nil {
+		return nil, e
+	}
+	commit_obj, e := rep.CommitObject(ref.Hash())
+	if e != nil {
+		return nil, e
+	}
+	tree, e := commit_obj.Tree()
+	if e != nil {
+		return nil, e
+	}
+	if problems, err = checkTree(commit_obj, tree); err != nil {
+		return
+	}
+
+	broken := make(map[string]bool)
+	for _, p := range problems {
+		fmt.Fprintf(w, "%s %s: %s\n", p.commit, p.path, p.reason)
+		broken[p.path] = true
+	}
+	if !repair || len(broken) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(broken))
+	for k := range broken {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	if e := s.Quarantine(paths, fmt.Sprintf("fsck: quarantine %d broken objects", len(paths))); e != nil {
+		return problems, e
+	} else if h, e := s.Head(); e != nil {
+		return problems, e
+	} else {
+		fmt.Fprintf(w, "%s quarantined %d objects in %s/\n", h, len(paths), quarantine_dir)
+	}
+	return
+}
+
+// the problems of the objects of tree, that of commit_obj
+func checkTree(commit_obj *object.Commit, tree *object.Tree) (problems []fsckProblem, err error) {
+	files := make(map[string][]*object.File)
+	if e := tree.Files().ForEach(func(f *object.File) error {
+		dir, _ := objectName(f.Name)
+		files[dir] = append(files[dir], f)
+		return nil
+	}); e != nil {
+		return nil, e
+	}
+	for _, v := range files {
+		sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+	}
+
+	report := func(f *object.File, format string, a ...any) {
+		dir, name := objectName(f.Name)
+		problems = append(problems, fsckProblem{path: path.Join(dir, name), commit: lastChange(commit_obj, f).Hash.String(), reason: fmt.Sprintf(format, a...)})
+	}
+	read := func(f *object.File) []byte {
+		if r, e := f.Reader(); e != nil {
+			report(f, "unreadable blob: %v", e)
+		} else if p, e := io.ReadAll(r); e != nil {
+			report(f, "unreadable blob: %v", e)
+		} else {
+			return p
+		}
+		return nil
+	}
+	for _, dir := range tree_dirs {
+		for _, f := range files[dir] {
+			if _, e := uuid.Parse(path.Base(f.Name)); e != nil {
+				report(f, "file name is not a uuid")
+			}
+		}
+	}
+	// of two files with the same id, the one named after it is kept
+	duplicate := func(seen map[string]*object.File, id string, f *object.File) {
+		if other := seen[id]; path.Base(other.Name) == id {
+			report(f, "duplicate id %s, also in %s", id, other.Name)
+		} else {
+			report(other, "duplicate id %s, also in %s", id, f.Name)
+			seen[id] = f
+		}
+	}
+
+	// the sources first, as the entries need theirs
+	sources := make(map[string]*object.File)
+	for _, f := range files["source"] {
+		if p := read(f); p == nil {
+			//
+		} else if feed_URL, source, e := decodeSource(bytes.NewReader(p)); e != nil {
+			report(f, "undecodable source: %v", e)
+		} else if source.Title == nil || source.Title.XMLName.Space != atom_xmlns || source.Title.XMLName.Local != "title" {
+			report(f, "source without atom:title")
+		} else if _, ok := sources[path.Base(feed_URL)]; ok {
+			duplicate(sources, path.Base(feed_URL), f)
+		} else {
+			sources[path.Base(feed_URL)] = f
+		}
+	}
+	entries := make(map[string]*object.File)
+	for _, f := range files["entry"] {
+		entry := new(Entry)
+		if p := read(f); p == nil {
+			//
+		} else if e := xml.Unmarshal(p, entry); e != nil {
+			report(f, "undecodable XML: %v", e)
+		} else if entry.Content.Body = bytes.ReplaceAll(entry.Content.Body, []byte{'\n'}, nil); false {
+			// as stored, see decodeEntryXML
+		} else if _, e := entry.Validate(nil); e != nil {
+			report(f, "invalid entry: %v", e)
+		} else if entry.Source == nil || entry.Source.Id == nil {
+			report(f, "entry without a source")
+		} else if u, e := uuid.Parse(entry.Source.Id.Target); e != nil {
+			report(f, "source id %s is not a urn:uuid", entry.Source.Id.Target)
+		} else if _, ok := sources[u.String()]; !ok {
+			report(f, "source %s is missing", entry.Source.Id.Target)
+		} else if u, e := uuid.Parse(entry.Id.Target); e != nil {
+			report(f, "id %s is not a urn:uuid", entry.Id.Target)
+		} else if _, ok := entries[u.String()]; ok {
+			duplicate(entries, u.String(), f)
+		} else {
+			entries[u.String()] = f
+		}
+	}
+	workspaces := make(map[string]*object.File)
+	for _, f := range files["workspace"] {
+		if p := read(f); p == nil {
+			//
+		} else if ws_URL, _, e := decodeWorkspace(bytes.NewReader(p), f.Name); e != nil {
+			report(f, "undecodable workspace: %v", e)
+		} else if _, ok := workspaces[path.Base(ws_URL)]; ok {
+			duplicate(workspaces, path.Base(ws_URL), f)
+		} else {
+			workspaces[path.Base(ws_URL)] = f
+		}
+	}
+	subscriptions := make(map[string]*object.File)
+	for _, f := range files["subscription"] {
+		if p := read(f); p == nil {
+			//
+		} else if sub, e := decodeSubscription(bytes.NewReader(p), f.Name); e != nil {
+			report(f, "undecodable subscription: %v", e)
+		} else if _, ok := subscriptions[sub.Key()]; ok {
+			duplicate(subscriptions, sub.Key(), f)
+		} else {
+			subscriptions[sub.Key()] = f
+		}
+	}
+	return
+}
+
+// the first parent commit since which f has not changed
+func lastChange(c *object.Commit, f *object.File) *object.Commit {
+	for c.NumParents() != 0 {
+		if parent, e := c.Parent(0); e != nil {
+			break
+		} else if tree, e := parent.Tree(); e != nil {
+			break
+		} else if entry, e := tree.FindEntry(f.Name); e != nil || entry.Hash != f.Hash {
+			break
+		} else {
+			c = parent
+		}
+	}
+	return c
+}
+
+// moves the objects at paths, {dir}/{name}, out of the tree into the
+// quarantine subtree, in a new commit
+func (s *BillyStorer) Quarantine(paths []string, message string) (err error) {
+	quarantined := make(map[string]map[string]plumbing.Hash)
+	if s.quarantine.IsZero() {
+		//
+	} else if tree, e := s.rep.TreeObject(s.quarantine); e != nil {
+		return e
+	} else if e := tree.Files().ForEach(func(f *object.File) error {
+		d, name := path.Split(f.Name)
+		if quarantined[path.Clean(d)] == nil {
+			quarantined[path.Clean(d)] = make(map[string]plumbing.Hash)
+		}
+		quarantined[path.Clean(d)][name] = f.Hash
+		return nil
+	}); e != nil {
+		return e
+	}
+	for _, p := range paths {
+		d, name := path.Split(p)
+		d = path.Clean(d)
+		h, ok := s.hashmap[hashDir(d, name)][name]
+		if !ok {
+			return fmt.Errorf("not in the tree: %s", p)
+		} else if quarantined[d] == nil {
+			quarantined[d] = make(map[string]plumbing.Hash)
+		}
+		quarantined[d][name] = h
+		s.setHash(d, name, plumbing.ZeroHash, true)
+	}
+
+	subtrees := make(map[string]plumbing.Hash, len(quarantined))
+	for d, hashes := range quarantined {
+		if subtrees[d], err = treeHelper(s.rep.Storer, hashes); err != nil {
+			return
+		}
+	}
+	if s.quarantine, err = dirTreeHelper(s.rep.Storer, subtrees); err != nil {
+		return
+	}
+	return s.Commit(message)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFsck(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := do("POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	res = do("POST", feed_URL, "text/plain", "a good post")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URL := res.Header.Get("Location")
+
+	if problems, e := fsck(tmpdir, false, nil, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 0 {
+		t.Fatalf("problems in a good repository: %v", problems)
+	}
+
+	// commit broken copies of the good entry
+	s := NewBillyStorer(tmpdir)
+	good, e := s.ReadEntry(path.Base(entry_URL))
+	if e != nil {
+		t.Fatal(e)
+	} else if e := s.AddEntry(good); e != nil {
+		t.Fatal(e)
+	}
+	f, e := s.fsys.Open("entry/" + path.Base(entry_URL))
+	if e != nil {
+		t.Fatal(e)
+	}
+	p, _ := io.ReadAll(f)
+	f.Close()
+	source_uuid := path.Base(feed_URL)
+	broken := map[string][]byte{
+		"entry/not-a-uuid":          p,
+		"entry/" + uuid.NewString(): []byte("<entry xmlns=\"http://www.w3.org/2005/Atom\"><title>"),
+		"entry/" + uuid.NewString(): regexp.MustCompile(`<title type="text">[^<]*</title>`).ReplaceAll(bytes.ReplaceAll(p, []byte(path.Base(entry_URL)), []byte(uuid.NewString())), []byte(`<title type="text"></title>`)),
+		"entry/" + uuid.NewString(): bytes.ReplaceAll(bytes.ReplaceAll(p, []byte(path.Base(entry_URL)), []byte(uuid.NewString())), []byte(source_uuid), []byte(uuid.NewString())),
+	}
+	for k, v := range broken {
+		if f, e := s.fsys.Create(k); e != nil {
+			t.Fatal(e)
+		} else if _, e := f.Write(v); e != nil {
+			t.Fatal(e)
+		} else if e := f.Close(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := s.Commit("break things"); e != nil {
+		t.Fatal(e)
+	}
+
+	// every broken file is reported, with the commit which broke it
+	out := bytes.NewBuffer(nil)
+	head, _ := s.Head()
+	problems, e := fsck(tmpdir, false, nil, out)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reported := make(map[string]bool)
+	for _, v := range problems {
+		reported[v.path] = true
+		if v.commit != head {
+			t.Fatalf("%s reported at %s, not %s", v.path, v.commit, head)
+		}
+	}
+	for k := range broken {
+		if !reported[k] {
+			t.Fatalf("%s not reported:\n%s", k, out)
+		}
+	}
+	for _, v := range []string{"file name is not a uuid", "duplicate id", "undecodable XML", "invalid entry", "is missing"} {
+		if !strings.Contains(out.String(), v) {
+			t.Fatalf("%q not reported:\n%s", v, out)
+		}
+	}
+
+	// repaired, the repository is good again and keeps what was broken
+	if _, e := fsck(tmpdir, true, nil, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if problems, e := fsck(tmpdir, false, nil, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 0 {
+		t.Fatalf("problems after repair: %v", problems)
+	}
+	s = NewBillyStorer(tmpdir)
+	if h.B = NewBackend(s); len(h.B.(*Backend).entrymap) != 1 {
+		t.Fatalf("%d entries after repair", len(h.B.(*Backend).entrymap))
+	} else if s.quarantine.IsZero() {
+		t.Fatal("no quarantine tree")
+	} else if tree, e := s.rep.TreeObject(s.quarantine); e != nil {
+		t.Fatal(e)
+	} else {
+		for k := range broken {
+			if _, e := tree.File(k); e != nil {
+				t.Fatalf("%s not quarantined: %v", k, e)
+			}
+		}
+	}
+
+	// and keeps the quarantine through later commits
+	if res := do("POST", feed_URL, "text/plain", "after the repair"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if s = NewBillyStorer(tmpdir); s.quarantine.IsZero() {
+		t.Fatal("quarantine tree dropped")
+	}
+
+	// a check leaves a journal to recover, and master, as it finds them
+	head, _ = s.Head()
+	wal_path := path.Join(tmpdir, wal_name)
+	if e := os.WriteFile(wal_path, []byte("[\n- subscription/"+uuid.NewString()+"\n]\n"), 0644); e != nil {
+		t.Fatal(e)
+	} else if _, e := fsck(tmpdir, false, nil, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if again, _ := s.Head(); again != head {
+		t.Fatal("master moved by a check")
+	} else if fi, e := os.Stat(wal_path); e != nil || fi.Size() == 0 {
+		t.Fatalf("journal recovered by a check: %v", e)
+	}
+}
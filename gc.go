@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// every commit leaves loose objects in the git directory; a gc packs the
+// objects reachable from the refs into one pack, which replaces the packs
+// before it, and deletes the loose objects, of which those unreachable
+// only once they are older than the prune time, as git gc does; the
+// unreachable objects of a replaced pack, e.g. of a push which is still
+// being checked, are written as loose objects first, with the time of
+// their pack
+//
+// the pack is written through a repository of its own, without the lock;
+// the lock is held only while the old packs are deleted and the caches
+// of the BillyStorer are dropped
+
+// that of git gc
+const default_prune = 14 * 24 * time.Hour
+
+// runs gc on a BillyStorer, when asked to at /admin/gc and every interval
+type GC struct {
+	s       *BillyStorer
+	mutex   sync.Locker // the lock of the Handler
+	prune   time.Duration
+	kick    chan struct{} // holds at most one gc to do
+	current GCStatus
+}
+
+// as served at /admin/gc
+type GCStatus struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Packed   int       `json:"packed"` // objects in the pack written
+	Pruned   int       `json:"pruned"` // unreachable loose objects deleted
+	Error    string    `json:"error,omitempty"`
+}
+
+// starts the worker, and a gc every interval if it is not zero; mutex
+// must be the one held by the Handler serving s
+func NewGC(s *BillyStorer, interval time.Duration, mutex sync.Locker) (*GC, error) {
+	if _, ok := s.rep.Storer.(*filesystem.Storage); !ok {
+		return nil, fmt.Errorf("gc: not a repository on disk")
+	}
+	g := &GC{
+		s:     s,
+		mutex: mutex,
+		prune: default_prune,
+		kick:  make(chan struct{}, 1),
+	}
+	go g.work()
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				g.mutex.Lock()
+				g.Start()
+				g.mutex.Unlock()
+			}
+		}()
+	}
+	return g, nil
+}
+
+// called with the lock held; false if a gc is running already
+func (g *GC) Start() bool {
+	if g.current.Running {
+		return false
+	}
+	g.current = GCStatus{Running: true, Started: time.Now()}
+	g.kick <- struct{}{}
+	return true
+}
+
+func (g *GC) work() {
+	fs := g.s.rep.Storer.(*filesystem.Storage)
+	for range g.kick {
+		packed, pruned, e := gc(fs.Filesystem().Root(), time.Now().Add(-g.prune), func(f func()) {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			f()
+			// the objects are now in the new pack only
+			fs.Reindex()
+		})
+
+		g.mutex.Lock()
+		g.current.Running, g.current.Finished, g.current.Packed, g.current.Pruned = false, time.Now(), packed, pruned
+		if e != nil {
+			g.current.Error = e.Error()
+			log.Printf("gc: %s", e)
+		}
+		g.mutex.Unlock()
+	}
+}
+
+// called with the lock held
+func (g *GC) Status() GCStatus {
+	return g.current
+}
+
+// packs the objects of the git repository at gitdir which are reachable
+// from a ref, and deletes the loose objects and packs they were in, and
+// the unreachable objects older than prune; the packs are deleted
+// inside locked, as a reader of the repository which found an object in
+// one would fail to open it
+func gc(gitdir string, prune time.Time, locked func(func())) (packed int, pruned int, err error) {
+	rep, e := git.PlainOpen(gitdir)
+	if e != nil {
+		return 0, 0, e
+	}
+	pos, ok := rep.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return 0, 0, git.ErrPackedObjectsNotSupported
+	}
+	los, ok := rep.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return 0, 0, git.ErrLooseObjectsNotSupported
+	}
+	old_packs, e := pos.ObjectPacks()
+	if e != nil {
+		return 0, 0, e
+	}
+	seen, e := reachable(rep)
+	if e != nil {
+		return 0, 0, e
+	}
+	objs := make([]plumbing.Hash, 0, len(seen))
+	for h := range seen {
+		objs = append(objs, h)
+	}
+
+	// the pack, which a reader finds once it is complete
+	pack_hash, e := writePack(rep, objs)
+	if e != nil {
+		return 0, 0, e
+	}
+	// the unreachable objects of the old packs, as loose objects with the
+	// time of their pack, unless that is older than prune
+	for _, h := range old_packs {
+		if h == pack_hash {
+			//
+		} else if n, e := loosen(rep, h, seen, prune); e != nil {
+			return 0, 0, e
+		} else {
+			pruned += n
+		}
+	}
+	locked(func() {
+		for _, h := range old_packs {
+			if h == pack_hash {
+				//
+			} else if e := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); e != nil {
+				err = e
+				return
+			}
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the loose objects, which a reader tries before the packs
+	err = los.ForEachObjectHash(func(h plumbing.Hash) error {
+		if seen[h] {
+			return los.DeleteLooseObject(h)
+		} else if t, e := los.LooseObjectTime(h); e != nil || !t.Before(prune) {
+			// written since the refs were read, or too recently
+			return nil
+		}
+		pruned++
+		return los.DeleteLooseObject(h)
+	})
+	return len(objs), pruned, err
+}
+
+// writes the objects of the pack pack_hash which are not in seen as loose
+// objects, if the pack is not older than prune; returns the number of
+// those dropped with the pack
+func loosen(rep *git.Repository, pack_hash plumbing.Hash, seen map[plumbing.Hash]bool, prune time.Time) (dropped int, err error) {
+	fs := rep.Storer.(*filesystem.Storage).Filesystem()
+	name := fmt.Sprintf("objects/pack/pack-%s", pack_hash)
+	fi, e := fs.Stat(name + ".pack")
+	if e != nil {
+		return 0, e
+	}
+	f, e := fs.Open(name + ".idx")
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	idx := idxfile.NewMemoryIndex()
+	if e := idxfile.NewDecoder(f).Decode(idx); e != nil {
+		return 0, e
+	}
+	entries, e := idx.Entries()
+	if e != nil {
+		return 0, e
+	}
+	defer entries.Close()
+	for {
+		v, e := entries.Next()
+		if e == io.EOF {
+			return dropped, nil
+		} else if e != nil {
+			return dropped, e
+		} else if seen[v.Hash] {
+			continue
+		} else if fi.ModTime().Before(prune) {
+			dropped++
+			continue
+		}
+		loose := fmt.Sprintf("objects/%s/%s", v.Hash.String()[:2], v.Hash.String()[2:])
+		if obj, e := rep.Storer.EncodedObject(plumbing.AnyObject, v.Hash); e != nil {
+			return dropped, e
+		} else if _, e := rep.Storer.SetEncodedObject(obj); e != nil {
+			return dropped, e
+		} else if c, ok := fs.(billy.Change); !ok {
+			// kept for prune from now on
+		} else if e := c.Chtimes(loose, fi.ModTime(), fi.ModTime()); e != nil {
+			return dropped, e
+		}
+	}
+}
+
+func writePack(rep *git.Repository, objs []plumbing.Hash) (h plumbing.Hash, err error) {
+	cfg, e := rep.Config()
+	if e != nil {
+		return h, e
+	}
+	w, e := rep.Storer.(storer.PackfileWriter).PackfileWriter()
+	if e != nil {
+		return h, e
+	}
+	if h, err = packfile.NewEncoder(w, rep.Storer, false).Encode(objs, cfg.Pack.Window); err != nil {
+		w.Close()
+	} else {
+		err = w.Close()
+	}
+	return
+}
+
+// the objects of the commits, trees, blobs and tags of every ref
+func reachable(rep *git.Repository) (seen map[plumbing.Hash]bool, err error) {
+	seen = make(map[plumbing.Hash]bool)
+	var todo []plumbing.Hash
+	refs, e := rep.References()
+	if e != nil {
+		return nil, e
+	}
+	if e := refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			todo = append(todo, ref.Hash())
+		}
+		return nil
+	}); e != nil {
+		return nil, e
+	}
+	for len(todo) != 0 {
+		h := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		obj, e := rep.Storer.EncodedObject(plumbing.AnyObject, h)
+		if e != nil {
+			return nil, fmt.Errorf("%s: %w", h, e)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			if c, e := object.DecodeCommit(rep.Storer, obj); e != nil {
+				return nil, e
+			} else {
+				todo = append(append(todo, c.TreeHash), c.ParentHashes...)
+			}
+		case plumbing.TreeObject:
+			if t, e := object.DecodeTree(rep.Storer, obj); e != nil {
+				return nil, e
+			} else {
+				for _, v := range t.Entries {
+					if v.Mode != filemode.Submodule {
+						todo = append(todo, v.Hash)
+					}
+				}
+			}
+		case plumbing.TagObject:
+			if t, e := object.DecodeTag(rep.Storer, obj); e != nil {
+				return nil, e
+			} else {
+				todo = append(todo, t.Target)
+			}
+		}
+	}
+	return
+}
+
+func (h *Handler) serveGC(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if h.GC == nil {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+	if body, err = json.Marshal(h.GC.Status()); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return
+}
+
+// starts a gc, and answers before it is done
+func (h *Handler) postGC(w http.ResponseWriter, r *http.Request) (err error) {
+	if h.GC == nil {
+		return &HTTPError{code: http.StatusNotFound}
+	} else if !h.GC.Start() {
+		return &HTTPError{code: http.StatusConflict, message: "gc is running"}
+	}
+	if body, e := json.Marshal(h.GC.Status()); e != nil {
+		err = e
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/admin/gc")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	}
+	return
+}
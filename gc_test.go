@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestGC(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := NewBillyStorer(tmpdir)
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+	// the loose objects and the packs of the repository
+	count := func() (loose int, packs int) {
+		if matches, e := filepath.Glob(filepath.Join(tmpdir, "objects", "??", "*")); e != nil {
+			t.Fatal(e)
+		} else {
+			loose = len(matches)
+		}
+		if matches, e := filepath.Glob(filepath.Join(tmpdir, "objects", "pack", "*.pack")); e != nil {
+			t.Fatal(e)
+		} else {
+			packs = len(matches)
+		}
+		return
+	}
+	// an object of no commit, written at
+	unreachable := func(content string, at time.Time) (hash plumbing.Hash) {
+		obj := s.rep.Storer.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		if w, e := obj.Writer(); e != nil {
+			t.Fatal(e)
+		} else if _, e := w.Write([]byte(content)); e != nil {
+			t.Fatal(e)
+		} else if e := w.Close(); e != nil {
+			t.Fatal(e)
+		} else if hash, e = s.rep.Storer.SetEncodedObject(obj); e != nil {
+			t.Fatal(e)
+		} else if e := os.Chtimes(filepath.Join(tmpdir, "objects", hash.String()[:2], hash.String()[2:]), at, at); e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+
+	res, _ := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	var entry_URLs []string
+	for range 8 {
+		if res, _ := do("POST", feed_URL, "text/plain", "a post"); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else {
+			entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+		}
+	}
+	if res, _ := do("POST", "/snapshot", "application/x-www-form-urlencoded", url.Values{"name": {"v1.0"}, "message": {"before the gc"}}.Encode()); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res, _ := do("DELETE", entry_URLs[0], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	unreachable("old", time.Now().Add(-30*24*time.Hour))
+	unreachable("new", time.Now())
+	if loose, packs := count(); loose == 0 || packs != 0 {
+		t.Fatalf("%d loose objects and %d packs before the gc", loose, packs)
+	}
+
+	if res, _ := do("POST", "/admin/gc", "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	}
+	h.mutex.Lock()
+	g, e := NewGC(s, 0, h.mutex)
+	if e != nil {
+		t.Fatal(e)
+	}
+	h.GC = g
+	h.mutex.Unlock()
+
+	// answered at once, and done in the background
+	if res, _ := do("POST", "/admin/gc", "", ""); res.StatusCode != http.StatusAccepted {
+		t.Fatal(res.Status)
+	}
+	var status GCStatus
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if res, body := do("GET", "/admin/gc", "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if e := json.Unmarshal(body, &status); e != nil {
+			t.Fatal(e)
+		} else if !status.Running {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("gc not done")
+		}
+	}
+	if status.Error != "" || status.Packed == 0 || status.Pruned != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	} else if loose, packs := count(); loose != 1 || packs != 1 {
+		t.Fatalf("%d loose objects and %d packs after the gc", loose, packs)
+	}
+
+	// the storer reads from the pack, and writes on
+	if res, body := do("GET", "/snapshot/v1.0"+entry_URLs[0], "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "a post") {
+		t.Fatalf("%s %s", res.Status, body)
+	} else if res, _ := do("POST", feed_URL, "text/plain", "after the gc"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if n := len(NewBackend(NewBillyStorer(tmpdir)).entrymap); n != len(entry_URLs) {
+		t.Fatalf("%d entries, not %d", n, len(entry_URLs))
+	}
+
+	// an unreachable object in a pack, as of a push being checked, is kept
+	// as a loose object
+	pushed := unreachable("pushed", time.Now())
+	if _, e := writePack(s.rep, []plumbing.Hash{pushed}); e != nil {
+		t.Fatal(e)
+	} else if e := os.Remove(filepath.Join(tmpdir, "objects", pushed.String()[:2], pushed.String()[2:])); e != nil {
+		t.Fatal(e)
+	}
+	if _, pruned, e := gc(tmpdir, time.Now().Add(-time.Hour), func(f func()) { f() }); e != nil {
+		t.Fatal(e)
+	} else if pruned != 0 {
+		t.Fatalf("pruned %d", pruned)
+	} else if loose, packs := count(); loose != 2 || packs != 1 {
+		t.Fatalf("%d loose objects and %d packs after the gc of a pack", loose, packs)
+	} else if _, e := NewBillyStorer(tmpdir).rep.Storer.EncodedObject(plumbing.AnyObject, pushed); e != nil {
+		t.Fatal(e)
+	}
+
+	// again, pruning everything unreachable
+	if packed, pruned, e := gc(tmpdir, time.Now(), func(f func()) { f() }); e != nil {
+		t.Fatal(e)
+	} else if packed <= status.Packed || pruned != 2 {
+		t.Fatalf("packed %d, pruned %d", packed, pruned)
+	} else if loose, packs := count(); loose != 0 || packs != 1 {
+		t.Fatalf("%d loose objects and %d packs after the second gc", loose, packs)
+	}
+
+	// which git agrees with, if it is installed
+	if _, e := exec.LookPath("git"); e != nil {
+		t.Log("no git to check the repository with")
+	} else if out, e := exec.Command("git", "--git-dir", tmpdir, "fsck", "--strict", "--no-dangling").CombinedOutput(); e != nil {
+		t.Fatalf("git fsck: %v\n%s", e, out)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/xml"
+	"fmt"
 	"net/http"
 	"path"
 	"strconv"
@@ -26,14 +27,38 @@ type IBackend interface {
 	DeleteEntry(r *http.Request) (err *HTTPError)
 
 	GetMedia(r *http.Request) (media []byte, mediatype string, err *HTTPError)
+	PostMedia(r *http.Request) (media_URL string, err *HTTPError)
+
+	Search(r *http.Request) (feed *Feed, err *HTTPError)
+	Batch(r *http.Request, batch *Batch) (feed *Feed, err *HTTPError)
+	GetAggregate(r *http.Request) (feed *Feed, err *HTTPError)
+	GetReplies(r *http.Request) (feed *Feed, err *HTTPError)
+
+	GetWorkspace(r *http.Request) (ws *Workspace, err *HTTPError)
+	PostWorkspace(r *http.Request, new_ws *Workspace) (ws *Workspace, ws_URL string, err *HTTPError)
+	PutWorkspace(r *http.Request, new_ws *Workspace) (err *HTTPError)
+	DeleteWorkspace(r *http.Request) (err *HTTPError)
+
+	GetSkipped(r *http.Request) (skipped []Skipped, err *HTTPError)
+	PostReload(r *http.Request) (reloaded *Reloaded, err *HTTPError)
+
+	PostSnapshot(r *http.Request, name string, message string) (tag *Tag, tag_URL string, err *HTTPError)
+	GetSnapshots(r *http.Request) (tags []*Tag, err *HTTPError)
+	GetSnapshot(r *http.Request, name string) (snapshot IBackend, err *HTTPError)
 }
 
 type Handler struct {
-	B     IBackend
-	gzw   *gzip.Writer
-	mutex *sync.Mutex
-	buf   *bytes.Buffer
-	bw    *bufio.Writer
+	B           IBackend
+	Hub         *Hub         // nil if WebSub is disabled
+	Events      *EventStream // nil if Server-Sent Events are disabled
+	Webmention  *Webmention  // nil if Webmentions are disabled
+	ActivityPub *ActivityPub // nil if ActivityPub is disabled
+	Mirror      *Mirror      // nil if there are no mirror remotes
+	GC          *GC          // nil if the storer is not git
+	gzw         *gzip.Writer
+	mutex       *sync.Mutex
+	buf         *bytes.Buffer
+	bw          *bufio.Writer
 }
 
 type HTTPError struct {
@@ -50,13 +75,47 @@ func (e *HTTPError) Error() string {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var body []byte
+	route := path.Dir(r.URL.Path)
+	if strings.HasPrefix(r.URL.Path, "/snapshot/") {
+		// /snapshot/{tag}/{feed,entry}/{uuid}
+		route = "/snapshot"
+	} else if route == "/" && r.URL.Path != "/" {
+		// top-level endpoints, e.g. /search
+		route = r.URL.Path
+	} else if path.Dir(route) == "/entry" && path.Base(r.URL.Path) == "replies" {
+		// /entry/{uuid}/replies
+		route = "/replies"
+	} else if route == "/micropub" {
+		// /micropub/media
+	} else if path.Dir(route) == "/feed" && path.Base(r.URL.Path) == "events" {
+		// /feed/{uuid}/events
+		route = "/events"
+	} else if path.Dir(route) == "/feed" {
+		// /feed/{uuid}/{actor,outbox,inbox,followers}
+		route = "/activitypub"
+	} else if r.URL.Path == "/.well-known/webfinger" {
+		route = r.URL.Path
+	}
+
+	if route == "/events" {
+		// event streams are long-lived, and take the lock only when needed
+		if err = h.serveEvents(w, r); err == nil {
+			return
+		} else if e, ok := err.(*HTTPError); ok {
+			http.Error(w, e.Error(), e.code)
+		} else {
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
 	// only allow one connection at a time
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	var err error
-	var body []byte
-	switch path.Dir(r.URL.Path) {
+	switch route {
 	case "/":
 		switch r.Method {
 		case "OPTIONS":
@@ -118,6 +177,228 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		default:
 			err = &HTTPError{code: http.StatusMethodNotAllowed}
 		}
+	case "/workspace":
+		if r.URL.Path == "/workspace" {
+			switch r.Method {
+			case "OPTIONS":
+				w.Header().Add("Allow", "OPTIONS, POST")
+				w.WriteHeader(http.StatusOK)
+				return
+			case "POST":
+				body, err = h.postWorkspace(w, r)
+			default:
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+			}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET, PUT, DELETE")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveWorkspace(w, r)
+		case "PUT":
+			err = h.putWorkspace(w, r)
+		case "DELETE":
+			err = h.deleteWorkspace(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/replies":
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveReplies(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/search":
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveSearch(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/all":
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveAggregate(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/micropub":
+		if r.URL.Path == "/micropub/media" {
+			switch r.Method {
+			case "OPTIONS":
+				w.Header().Add("Allow", "OPTIONS, POST")
+				w.WriteHeader(http.StatusOK)
+				return
+			case "POST":
+				err = h.postMicropubMedia(w, r)
+			default:
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+			}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET, POST")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveMicropub(w, r)
+		case "POST":
+			err = h.postMicropub(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/admin":
+		if r.URL.Path != "/admin/skipped" && r.URL.Path != "/admin/mirrors" && r.URL.Path != "/admin/gc" && r.URL.Path != "/admin/reload" {
+			err = &HTTPError{code: http.StatusNotFound}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			if r.URL.Path == "/admin/gc" {
+				w.Header().Add("Allow", "OPTIONS, GET, POST")
+			} else if r.URL.Path == "/admin/reload" {
+				w.Header().Add("Allow", "OPTIONS, POST")
+			} else {
+				w.Header().Add("Allow", "OPTIONS, GET")
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			if r.URL.Path == "/admin/reload" {
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+			} else if r.URL.Path == "/admin/mirrors" {
+				body, err = h.serveMirrors(w, r)
+			} else if r.URL.Path == "/admin/gc" {
+				body, err = h.serveGC(w, r)
+			} else {
+				body, err = h.serveSkipped(w, r)
+			}
+		case "POST":
+			if r.URL.Path == "/admin/reload" {
+				body, err = h.postReload(w, r)
+			} else if r.URL.Path == "/admin/gc" {
+				err = h.postGC(w, r)
+			} else {
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+			}
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/snapshot":
+		switch r.Method {
+		case "OPTIONS":
+			if r.URL.Path == "/snapshot" {
+				w.Header().Add("Allow", "OPTIONS, GET, POST")
+			} else {
+				w.Header().Add("Allow", "OPTIONS, GET")
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.serveSnapshot(w, r)
+		case "POST":
+			if r.URL.Path != "/snapshot" {
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+				break
+			}
+			body, err = h.postSnapshot(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/batch":
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, POST")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "POST":
+			body, err = h.postBatch(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/webmention":
+		if h.Webmention == nil {
+			err = &HTTPError{code: http.StatusNotFound}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, POST")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "POST":
+			err = h.Webmention.serve(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/activitypub":
+		if h.ActivityPub == nil {
+			err = &HTTPError{code: http.StatusNotFound}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET, POST")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.ActivityPub.serve(w, r)
+		case "POST":
+			if path.Base(r.URL.Path) != "inbox" {
+				err = &HTTPError{code: http.StatusMethodNotAllowed}
+				break
+			}
+			err = h.ActivityPub.postInbox(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/.well-known/webfinger":
+		if h.ActivityPub == nil {
+			err = &HTTPError{code: http.StatusNotFound}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, GET")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "GET":
+			body, err = h.ActivityPub.serveWebFinger(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
+	case "/hub":
+		if h.Hub == nil {
+			err = &HTTPError{code: http.StatusNotFound}
+			break
+		}
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Add("Allow", "OPTIONS, POST")
+			w.WriteHeader(http.StatusOK)
+			return
+		case "POST":
+			err = h.Hub.serve(w, r)
+		default:
+			err = &HTTPError{code: http.StatusMethodNotAllowed}
+		}
 	default:
 		err = &HTTPError{code: http.StatusMethodNotAllowed}
 	}
@@ -212,6 +493,28 @@ func (h *Handler) putEntry(w http.ResponseWriter, r *http.Request) (err error) {
 	}
 }
 
+func (h *Handler) putWorkspace(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Header.Get("Content-Type") != "application/atomsvc+xml" {
+		err = &HTTPError{code: http.StatusUnsupportedMediaType, message: "content-type must be application/atomsvc+xml"}
+		return
+	}
+
+	new_ws := &Workspace{}
+	if _, e := h.B.GetWorkspace(r); e != nil {
+		err = e
+	} else if e := xml.NewDecoder(r.Body).Decode(new_ws); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: "could not unmarshal request body"}
+	} else if e := h.B.PutWorkspace(r, new_ws); e != nil {
+		err = e
+	}
+	if err != nil {
+		return
+	} else {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+}
+
 // POST
 
 // body is <atom:feed> specifying metadata for new collection
@@ -258,6 +561,27 @@ func (h *Handler) postToRoot(w http.ResponseWriter, r *http.Request) (body []byt
 	return
 }
 
+// body is <app:workspace> with an <atom:title>
+// response is <app:service> containing only the new workspace
+func (h *Handler) postWorkspace(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if r.Header.Get("Content-Type") != "application/atomsvc+xml" {
+		err = &HTTPError{code: http.StatusUnsupportedMediaType, message: "content-type must be application/atomsvc+xml"}
+		return
+	}
+
+	new_ws := &Workspace{}
+	if e := xml.NewDecoder(r.Body).Decode(new_ws); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: "could not unmarshal request body"}
+	} else if ws, ws_URL, e := h.B.PostWorkspace(r, new_ws); e != nil {
+		err = e
+	} else if body, err = h.writeWorkspace(w, ws); err != nil {
+		//
+	} else if w.Header().Set("Location", ws_URL); false {
+		//
+	}
+	return
+}
+
 func (h *Handler) postToFeed(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
 	err = &HTTPError{code: http.StatusInternalServerError}
 	if entry, entry_URL, e := h.B.PostToFeed(r); e != nil {
@@ -316,13 +640,50 @@ func (h *Handler) serveRoot(w http.ResponseWriter, r *http.Request) (body []byte
 	return
 }
 
-func (h *Handler) serveFeed(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+func (h *Handler) serveWorkspace(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if ws, e := h.B.GetWorkspace(r); e != nil {
+		err = e
+	} else {
+		body, err = h.writeWorkspace(w, ws)
+	}
+	return
+}
+
+// writes a service document containing only ws
+func (h *Handler) writeWorkspace(w http.ResponseWriter, ws *Workspace) (body []byte, err error) {
 	err = &HTTPError{code: http.StatusInternalServerError}
+	if h.buf.Reset(); false {
+		//
+	} else if _, e := h.buf.WriteString(xml.Header); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if h.bw.Reset(h.buf); false {
+		//
+	} else if e := (&Service{Workspaces: []Workspace{*ws}}).MarshalTo(h.bw); e != nil {
+		return
+	} else if e := h.bw.Flush(); e != nil {
+		return
+	} else if w.Header().Set("Content-Type", "application/atomsvc+xml"); false {
+		//
+	} else {
+		return h.buf.Bytes(), nil
+	}
+	return
+}
+
+func (h *Handler) serveFeed(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
 	if feed, e := h.B.GetFeed(r); e != nil {
 		// could be not found, or something else
 		err = e
-		return
-	} else if etag, e := feed.ETag(); e != nil {
+	} else {
+		body, err = h.writeFeed(w, r, feed)
+	}
+	return
+}
+
+// writes a feed response, honoring the conditional request headers
+func (h *Handler) writeFeed(w http.ResponseWriter, r *http.Request, feed *Feed) (body []byte, err error) {
+	err = &HTTPError{code: http.StatusInternalServerError}
+	if etag, e := feed.ETag(); e != nil {
 		return
 	} else if proceed, e := IfMatchIfNoneMatch(etag, r.Header.Get("If-Match"), r.Header.Get("If-None-Match")); e != nil {
 		// could be bad request
@@ -355,12 +716,19 @@ func (h *Handler) serveFeed(w http.ResponseWriter, r *http.Request) (body []byte
 }
 
 func (h *Handler) serveEntry(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
-	err = &HTTPError{code: http.StatusInternalServerError}
 	if entry, e := h.B.GetEntry(r); e != nil {
 		// could be not found, or something else
 		err = e
-		return
-	} else if etag, e := entry.ETag(); e != nil {
+	} else {
+		body, err = h.writeEntry(w, r, entry)
+	}
+	return
+}
+
+// writes an entry response, honoring the conditional request headers
+func (h *Handler) writeEntry(w http.ResponseWriter, r *http.Request, entry *Entry) (body []byte, err error) {
+	err = &HTTPError{code: http.StatusInternalServerError}
+	if etag, e := entry.ETag(); e != nil {
 		return
 	} else if proceed, e := IfMatchIfNoneMatch(etag, r.Header.Get("If-Match"), r.Header.Get("If-None-Match")); e != nil {
 		// could be bad request
@@ -385,11 +753,71 @@ func (h *Handler) serveEntry(w http.ResponseWriter, r *http.Request) (body []byt
 	} else if w.Header().Set("ETag", strconv.Quote(etag)); false {
 		//
 	} else {
+		if h.Webmention != nil {
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"webmention\"", h.Webmention.URL()))
+		}
 		return h.buf.Bytes(), nil
 	}
 	return
 }
 
+func (h *Handler) serveSearch(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if feed, e := h.B.Search(r); e != nil {
+		// could be bad request, or something else
+		err = e
+	} else {
+		body, err = h.writeFeed(w, r, feed)
+	}
+	return
+}
+
+func (h *Handler) serveReplies(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if feed, e := h.B.GetReplies(r); e != nil {
+		err = e
+	} else {
+		body, err = h.writeFeed(w, r, feed)
+	}
+	return
+}
+
+func (h *Handler) serveAggregate(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if feed, e := h.B.GetAggregate(r); e != nil {
+		err = e
+	} else {
+		body, err = h.writeFeed(w, r, feed)
+	}
+	return
+}
+
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) (err error) {
+	if h.Events == nil {
+		return &HTTPError{code: http.StatusNotFound}
+	}
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "GET":
+	default:
+		return &HTTPError{code: http.StatusMethodNotAllowed}
+	}
+
+	feed_URL := eventsFeedURL(r.URL.Path)
+	if feed_URL != "" {
+		// the collection must exist
+		fr := r.Clone(r.Context())
+		fr.URL.Path, fr.URL.RawQuery = feed_URL, ""
+		h.mutex.Lock()
+		_, e := h.B.GetFeed(fr)
+		h.mutex.Unlock()
+		if e != nil {
+			return e
+		}
+	}
+	return h.Events.serve(w, r, feed_URL)
+}
+
 func (h *Handler) serveMedia(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
 	err = &HTTPError{code: http.StatusInternalServerError}
 	if media, mediatype, e := h.B.GetMedia(r); e != nil {
@@ -425,6 +853,15 @@ func (h *Handler) deleteEntry(w http.ResponseWriter, r *http.Request) (err error
 	return
 }
 
+func (h *Handler) deleteWorkspace(w http.ResponseWriter, r *http.Request) (err error) {
+	if e := h.B.DeleteWorkspace(r); e != nil {
+		err = e
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	return
+}
+
 func (h *Handler) deleteFeed(w http.ResponseWriter, r *http.Request) (err error) {
 	err = &HTTPError{code: http.StatusInternalServerError}
 	if feed, e := h.B.GetFeed(r); e != nil {
@@ -55,7 +55,20 @@ func (feed *Feed) ETag() (etag string, err error) {
 	} else if e := feed.Updated.MarshalTo(bw); e != nil {
 		err = e
 		return
-	} else if e := bw.Flush(); e != nil {
+	} else if _, e := bw.WriteString(feed.sources); e != nil {
+		err = e
+		return
+	}
+	// filtered or paged views of a feed differ in their self link
+	for _, l := range feed.Links {
+		if l.Relation != "self" {
+			continue
+		} else if _, e := bw.WriteString(l.Href); e != nil {
+			err = e
+			return
+		}
+	}
+	if e := bw.Flush(); e != nil {
 		err = e
 		return
 	}
@@ -74,7 +87,22 @@ func (entry *Entry) ETag() (etag string, err error) {
 	} else if e := entry.Updated.MarshalTo(bw); e != nil {
 		err = e
 		return
-	} else if e := bw.Flush(); e != nil {
+	}
+	// neither replies nor mentions change the updated time of the entry
+	for _, l := range entry.Links {
+		if isWebmentionLink(l) {
+			if _, e := bw.WriteString(l.Href); e != nil {
+				err = e
+				return
+			}
+		} else if l.Relation != "replies" {
+			continue
+		} else if _, e := fmt.Fprintf(bw, "%d %s", l.ThreadCount, l.ThreadUpdated); e != nil {
+			err = e
+			return
+		}
+	}
+	if e := bw.Flush(); e != nil {
 		err = e
 		return
 	}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+)
+
+// what an operation changed in memory, to be restored if a storer call
+// fails; a batch is one operation, and the operations it calls join it
+type journal struct {
+	depth           int    // operations joined
+	message         string // of the commit made by finish
+	entrymap        map[string]*Entry
+	sourcemap       map[string]*Source
+	workspacemap    map[string]*Workspace    // nil where there was no value
+	subscriptionmap map[string]*Subscription // nil where there was no value
+	entries         map[*Entry]Entry
+	sources         map[*Source]savedSource
+	workspaces      map[*Workspace]Workspace
+	changes         []*Change // notified once committed
+}
+
+// the updated time and the collection are shared by pointer
+type savedSource struct {
+	source     Source
+	updated    DateConstruct
+	collection Collection
+}
+
+// commits, or leaves the commit to the finish of the running operation;
+// the message of a joined operation is that of the one it joined
+func (b *Backend) commit(message string) (err error) {
+	if b.journal == nil {
+		return b.storer.Commit(message)
+	} else if b.journal.depth == 0 {
+		b.journal.message = message
+	}
+	return nil
+}
+
+// saves entry and source before a change, if an operation is running;
+// either may be nil
+func (b *Backend) touch(entry *Entry, source *Source) {
+	if b.journal == nil {
+		return
+	}
+	if _, ok := b.journal.entries[entry]; entry != nil && !ok {
+		b.journal.entries[entry] = *entry
+	}
+	if _, ok := b.journal.sources[source]; source != nil && source.Updated != nil && !ok {
+		saved := savedSource{source: *source, updated: *source.Updated}
+		if source.Collection != nil {
+			saved.collection = *source.Collection
+		}
+		b.journal.sources[source] = saved
+	}
+}
+
+func (b *Backend) touchWorkspace(ws *Workspace) {
+	if b.journal == nil {
+		return
+	}
+	if _, ok := b.journal.workspaces[ws]; ws != nil && !ok {
+		saved := *ws
+		saved.Collections = append([]*Collection(nil), ws.Collections...)
+		b.journal.workspaces[ws] = saved
+	}
+}
+
+// saves the values of the maps at the given URLs before they are set or
+// deleted; empty URLs are skipped
+func (b *Backend) touchURLs(entry_URL string, feed_URL string, ws_URL string) {
+	if b.journal == nil {
+		return
+	}
+	if _, ok := b.journal.entrymap[entry_URL]; entry_URL != "" && !ok {
+		b.journal.entrymap[entry_URL] = b.entrymap[entry_URL]
+	}
+	if _, ok := b.journal.sourcemap[feed_URL]; feed_URL != "" && !ok {
+		b.journal.sourcemap[feed_URL] = b.sourcemap[feed_URL]
+	}
+	if _, ok := b.journal.workspacemap[ws_URL]; ws_URL != "" && !ok {
+		b.journal.workspacemap[ws_URL] = b.workspacemap[ws_URL]
+	}
+}
+
+// saves the subscription at key before it is set or deleted
+func (b *Backend) touchSubscription(key string) {
+	if b.journal == nil {
+		return
+	}
+	if _, ok := b.journal.subscriptionmap[key]; !ok {
+		b.journal.subscriptionmap[key] = b.subscriptionmap[key]
+	}
+}
+
+// starts an operation, or joins the one running
+func (b *Backend) begin() (err error) {
+	if b.journal != nil {
+		b.journal.depth++
+		return
+	}
+	if e := b.storer.Begin(); e != nil {
+		return e
+	}
+	b.journal = &journal{
+		entrymap:        make(map[string]*Entry),
+		sourcemap:       make(map[string]*Source),
+		workspacemap:    make(map[string]*Workspace),
+		subscriptionmap: make(map[string]*Subscription),
+		entries:         make(map[*Entry]Entry),
+		sources:         make(map[*Source]savedSource),
+		workspaces:      make(map[*Workspace]Workspace),
+	}
+	return
+}
+
+// ends an operation started by begin: if it failed, memory and the storer
+// are restored, else its changes are committed and the observers are
+// told; a joined operation leaves all of it to the one it joined
+func (b *Backend) finish(err *HTTPError) *HTTPError {
+	if b.journal.depth > 0 {
+		b.journal.depth--
+		return err
+	} else if err != nil {
+		if e := b.rollback(); e != nil {
+			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		}
+		return err
+	} else if b.journal.message == "" {
+		//
+	} else if e := b.storer.Commit(b.journal.message); e != nil {
+		// the failed commit is what matters to the caller
+		b.rollback()
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	changes := b.journal.changes
+	b.journal = nil
+	for _, c := range changes {
+		b.notify(c)
+	}
+	return nil
+}
+
+// restores memory and the storer to the state before begin
+func (b *Backend) rollback() (err error) {
+	j := b.journal
+	b.journal = nil
+	err = b.storer.Rollback()
+
+	for ptr, saved := range j.entries {
+		*ptr = saved
+	}
+	for ptr, saved := range j.sources {
+		*ptr = saved.source
+		*ptr.Updated = saved.updated
+		if ptr.Collection != nil {
+			*ptr.Collection = saved.collection
+		}
+	}
+	for ptr, saved := range j.workspaces {
+		*ptr = saved
+	}
+	for k, v := range j.sourcemap {
+		if v == nil {
+			delete(b.sourcemap, k)
+		} else {
+			b.sourcemap[k] = v
+		}
+	}
+	for k, v := range j.workspacemap {
+		if v == nil {
+			delete(b.workspacemap, k)
+		} else {
+			b.workspacemap[k] = v
+		}
+	}
+	for k, v := range j.subscriptionmap {
+		if v == nil {
+			delete(b.subscriptionmap, k)
+		} else {
+			b.subscriptionmap[k] = v
+		}
+	}
+	if len(j.sources)+len(j.workspaces)+len(j.sourcemap)+len(j.workspacemap) != 0 {
+		b.buildServiceDocument()
+	}
+
+	touched := make(map[string]bool, len(j.entrymap))
+	for k, v := range j.entrymap {
+		touched[k] = true
+		if v == nil {
+			delete(b.entrymap, k)
+		} else {
+			b.entrymap[k] = v
+		}
+	}
+	if len(j.entries) != 0 {
+		for k, v := range b.entrymap {
+			if _, ok := j.entries[v]; ok {
+				touched[k] = true
+			}
+		}
+	}
+
+	// the search index and the contents follow the entrymap
+	for k := range touched {
+		if b.contents != nil {
+			b.contents.Remove(k)
+		}
+		if v, ok := b.entrymap[k]; !ok {
+			b.index.Remove(k)
+		} else if loaded, e := b.full(v); e != nil && err == nil {
+			err = e
+		} else if e == nil {
+			b.index.Add(k, loaded)
+		}
+	}
+	return
+}
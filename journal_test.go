@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fails the calls named by fail
+type failingStorer struct {
+	Storer
+	fail string
+}
+
+func (s *failingStorer) AddSource(source *Source) error {
+	if s.fail == "AddSource" {
+		return fmt.Errorf("failing AddSource")
+	}
+	return s.Storer.AddSource(source)
+}
+
+func (s *failingStorer) Commit(message string) error {
+	if s.fail == "Commit" {
+		return fmt.Errorf("failing Commit")
+	}
+	return s.Storer.Commit(message)
+}
+
+func TestRollbackOnStorerFailure(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := &failingStorer{Storer: NewBillyStorer(tmpdir)}
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	b := h.B.(*Backend)
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(method string, target string, header map[string]string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	text := map[string]string{"Content-Type": "text/plain"}
+
+	res := do("POST", "/", map[string]string{"Content-Type": "application/atom+xml;type=feed"}, feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	res = do("POST", feed_URL, text, "the parent post")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	parent_URL := res.Header.Get("Location")
+	parent := b.entrymap[parent_URL]
+	updated := b.sourcemap[feed_URL].Updated.T
+
+	// a reply which cannot be stored leaves nothing behind
+	s.fail = "AddSource"
+	if res := do("POST", feed_URL, map[string]string{"Content-Type": "text/plain", "In-Reply-To": parent_URL}, "the failed reply"); res.StatusCode != http.StatusInternalServerError {
+		t.Fatal(res.Status)
+	} else if len(b.entrymap) != 1 {
+		t.Fatalf("%d entries after a failed post", len(b.entrymap))
+	} else if !b.sourcemap[feed_URL].Updated.T.Equal(updated) {
+		t.Fatal("source updated by a failed post")
+	} else if len(b.index.Search("failed")) != 0 {
+		t.Fatal("failed post indexed")
+	}
+
+	// nor does a deletion which cannot be committed
+	s.fail = "Commit"
+	if res := do("DELETE", parent_URL, nil, ""); res.StatusCode != http.StatusInternalServerError {
+		t.Fatal(res.Status)
+	} else if b.entrymap[parent_URL] != parent {
+		t.Fatal("entry deleted by a failed delete")
+	} else if len(b.index.Search("parent")) != 1 {
+		t.Fatal("entry unindexed by a failed delete")
+	}
+
+	// nor a received mention
+	wm := &Webmention{b: b}
+	mention := Link{Href: "https://elsewhere.example/post", Relation: "related", Title: webmention_link_title}
+	n := len(parent.Links)
+	if e := wm.store(mention.Href, parent_URL, parent, append(append([]Link{}, parent.Links...), mention)); e == nil {
+		t.Fatal("mention did not fail")
+	} else if len(parent.Links) != n {
+		t.Fatalf("%d links after a failed mention", len(parent.Links))
+	} else if !b.sourcemap[feed_URL].Updated.T.Equal(updated) {
+		t.Fatal("source updated by a failed mention")
+	}
+
+	// and the next commit does not carry what failed
+	s.fail = ""
+	if res := do("POST", feed_URL, text, "the second post"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	b = NewBackend(NewBillyStorer(tmpdir))
+	if len(b.entrymap) != 2 {
+		t.Fatalf("%d entries committed", len(b.entrymap))
+	} else if _, ok := b.entrymap[parent_URL]; !ok {
+		t.Fatal("parent not committed")
+	}
+	for _, v := range b.entrymap[parent_URL].Links {
+		if v.Relation == "replies" {
+			t.Fatal("failed reply counted")
+		}
+	}
+}
+
+func TestSubscriptionRollback(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := &failingStorer{Storer: NewBillyStorer(tmpdir)}
+	b := NewBackend(s)
+	ap := &ActivityPub{b: b}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	follow := func(follower string) *HTTPError {
+		sub := &Subscription{
+			Topic:    "https://example.org/feed/00000000-0000-0000-0000-000000000000/actor",
+			Callback: follower + "/inbox",
+			Follower: follower,
+		}
+		return ap.store(&inboxActivity{Type: "Follow", Actor: follower}, sub)
+	}
+
+	// a failed commit leaves no subscription, in memory or staged
+	s.fail = "Commit"
+	if e := follow("https://failed.example/actor"); e == nil {
+		t.Fatal("follow did not fail")
+	} else if len(b.subscriptionmap) != 0 {
+		t.Fatalf("%d subscriptions after a failed follow", len(b.subscriptionmap))
+	}
+	s.fail = ""
+	if e := follow("https://elsewhere.example/actor"); e != nil {
+		t.Fatal(e)
+	} else if n := len(NewBackend(NewBillyStorer(tmpdir)).subscriptionmap); n != 1 {
+		t.Fatalf("%d subscriptions stored, not 1", n)
+	}
+
+	// the same for WebSub, whose expired subscriptions are kept as well
+	hub := &Hub{b: b}
+	for _, v := range b.subscriptionmap {
+		v.Expires = time.Now().Add(-time.Hour)
+	}
+	s.fail = "Commit"
+	if e := hub.store("subscribe", &Subscription{Topic: "https://example.org/feed", Callback: "https://failed.example/callback"}, time.Hour); e == nil {
+		t.Fatal("subscribe did not fail")
+	} else if len(b.subscriptionmap) != 1 {
+		t.Fatalf("%d subscriptions after a failed subscribe, not the expired one", len(b.subscriptionmap))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// entries of a lazy Backend are kept without their content, which is read
+// from the storer when needed and cached within a memory budget
+
+// least recently used content bodies, by entry URL
+type contentCache struct {
+	budget int // in bytes
+	size   int
+	lru    *list.List // of *contentCacheItem, most recent first
+	items  map[string]*list.Element
+}
+
+type contentCacheItem struct {
+	entry_URL string
+	body      []byte
+}
+
+func newContentCache(budget int) *contentCache {
+	return &contentCache{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func (c *contentCache) Get(entry_URL string) (body []byte, ok bool) {
+	if el, found := c.items[entry_URL]; found {
+		c.lru.MoveToFront(el)
+		return el.Value.(*contentCacheItem).body, true
+	}
+	return nil, false
+}
+
+// bodies larger than the whole budget are not cached
+func (c *contentCache) Put(entry_URL string, body []byte) {
+	c.Remove(entry_URL)
+	if len(body) > c.budget {
+		return
+	}
+	c.items[entry_URL] = c.lru.PushFront(&contentCacheItem{entry_URL: entry_URL, body: body})
+	c.size += len(body)
+	for c.size > c.budget {
+		c.Remove(c.lru.Back().Value.(*contentCacheItem).entry_URL)
+	}
+}
+
+func (c *contentCache) Remove(entry_URL string) {
+	if el, found := c.items[entry_URL]; found {
+		c.lru.Remove(el)
+		delete(c.items, entry_URL)
+		c.size -= len(el.Value.(*contentCacheItem).body)
+	}
+}
+
+// a Backend keeping only the metadata of the entries in memory, with
+// budget bytes of content cached; startup still decodes every entry once,
+// to index it, but keeps none of the content
+func NewLazyBackend(storer Storer, budget int) *Backend {
+	b := &Backend{storer: storer, contents: newContentCache(budget)}
+	if e := b.load(); e != nil {
+		panic(e)
+	}
+	return b
+}
+
+// puts the entry into the entrymap, without its content if lazy
+func (b *Backend) keep(entry_URL string, entry *Entry) {
+	b.touchURLs(entry_URL, "", "")
+	if b.contents == nil || entry.Content.Body == nil {
+		b.entrymap[entry_URL] = entry
+		return
+	}
+	b.contents.Put(entry_URL, entry.Content.Body)
+	stub := *entry
+	stub.Content.Body = nil
+	b.entrymap[entry_URL] = &stub
+}
+
+// the entry with its content; a copy if the content had to be loaded
+func (b *Backend) full(entry *Entry) (*Entry, error) {
+	if b.contents == nil || entry.Content.Body != nil {
+		return entry, nil
+	}
+	u, e := uuid.Parse(entry.Id.Target)
+	if e != nil {
+		return nil, fmt.Errorf("cannot parse entry id as urn:uuid")
+	}
+	entry_URL := "/entry/" + u.String()
+	loaded := *entry
+	if body, ok := b.contents.Get(entry_URL); ok {
+		loaded.Content.Body = body
+	} else if stored, e := b.storer.ReadEntry(u.String()); e != nil {
+		return nil, e
+	} else {
+		loaded.Content = stored.Content
+		b.contents.Put(entry_URL, stored.Content.Body)
+	}
+	return &loaded, nil
+}
+
+// the entries of a feed about to be served, with their content
+func (b *Backend) withContent(entry_ptrs []*Entry) (loaded []*Entry, err *HTTPError) {
+	if b.contents == nil {
+		return entry_ptrs, nil
+	}
+	loaded = make([]*Entry, len(entry_ptrs))
+	for k, v := range entry_ptrs {
+		if entry, e := b.full(v); e != nil {
+			return nil, &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		} else {
+			loaded[k] = entry
+		}
+	}
+	return
+}
+
+// stages an entry of the entrymap, which may lack its content
+func (b *Backend) storeEntry(entry *Entry) (err error) {
+	if loaded, e := b.full(entry); e != nil {
+		err = e
+	} else {
+		err = b.storer.AddEntry(loaded)
+	}
+	return
+}
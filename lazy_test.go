@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	c := newContentCache(10)
+	c.Put("/entry/a", []byte("aaaa"))
+	c.Put("/entry/b", []byte("bbbb"))
+	if _, ok := c.Get("/entry/a"); !ok {
+		t.Fatal("a evicted early")
+	}
+	// b is now the least recently used
+	c.Put("/entry/c", []byte("cccc"))
+	if _, ok := c.Get("/entry/b"); ok {
+		t.Fatal("b not evicted")
+	} else if _, ok := c.Get("/entry/a"); !ok {
+		t.Fatal("a evicted")
+	} else if c.size != 8 {
+		t.Fatalf("unexpected size %d", c.size)
+	}
+	c.Put("/entry/d", []byte("too large for the budget"))
+	if _, ok := c.Get("/entry/d"); ok || c.size != 8 {
+		t.Fatal("cached beyond the budget")
+	}
+}
+
+func TestLazyBackend(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	newHandler := func() *Handler {
+		return &Handler{
+			// too small to cache anything, so every read goes to the storer
+			B:     NewLazyBackend(NewBillyStorer(tmpdir), 16),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+	}
+	h := newHandler()
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(h *Handler, method string, target string, header map[string]string, body string) (*http.Response, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, string(p)
+	}
+
+	res, _ := do(h, "POST", "/", map[string]string{"Content-Type": "application/atom+xml;type=feed"}, feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	res, _ = do(h, "POST", feed_URL, map[string]string{"Content-Type": "text/plain"}, "the parent post")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	parent_URL := res.Header.Get("Location")
+	if entry := h.B.(*Backend).entrymap[parent_URL]; entry.Content.Body != nil {
+		t.Fatal("content kept in memory")
+	}
+
+	// the reply restages the parent, which must keep its content
+	res, _ = do(h, "POST", feed_URL, map[string]string{"Content-Type": "text/plain", "In-Reply-To": parent_URL}, "the reply")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// nor is it kept when the storer is read again
+	fresh := newHandler()
+	for k, v := range fresh.B.(*Backend).entrymap {
+		if v.Content.Body != nil {
+			t.Fatalf("content of %s kept in memory", k)
+		}
+	}
+
+	for _, h := range []*Handler{h, fresh} {
+		if res, body := do(h, "GET", parent_URL, nil, ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if !strings.Contains(body, "the parent post") || !strings.Contains(body, `rel="replies"`) {
+			t.Fatalf("unexpected entry %s", body)
+		} else if res, body := do(h, "GET", feed_URL, nil, ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if !strings.Contains(body, "the parent post") || !strings.Contains(body, "the reply") {
+			t.Fatalf("unexpected feed %s", body)
+		} else if res, body := do(h, "GET", "/search?q=parent", nil, ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if !strings.Contains(body, "the parent post") {
+			t.Fatalf("unexpected search results %s", body)
+		}
+	}
+}
@@ -7,21 +7,181 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
 )
 
 var listen_address_flag = flag.String("listen", "127.0.0.1:8357", "listen address")
 var gitdir_flag = flag.String("gitdir", ".atompub", "git directory")
+var datadir_flag = flag.String("datadir", "", "plain directory to store in, instead of the git directory")
+var boltdb_flag = flag.String("boltdb", "", "bbolt database file to store in, instead of the git directory")
+var content_cache_flag = flag.Int("content-cache", 0, "if set, keep entries without content in memory, caching this many bytes of it")
+var url_flag = flag.String("url", "", "public base URL of the server, required by -websub and -webmention")
+var websub_flag = flag.Bool("websub", false, "enable the WebSub hub at {url}/hub")
+var webmention_flag = flag.Bool("webmention", false, "send Webmentions, and receive them at {url}/webmention")
+var signing_key_flag = flag.String("signing-key", "", "OpenPGP or SSH private key file to sign the commits of the git directory with")
+var mirror_flag = flag.String("mirror", "", "comma-separated git remote URLs to push master to after each commit")
+var accept_push_flag = flag.Bool("accept-push", false, "take pushes to master of the git directory which pass the checks of fsck and of a POST; not with -signing-key")
+var gc_interval_flag = flag.Duration("gc-interval", 0, "if set, pack the git directory and prune its unreachable objects this often, e.g. 24h")
+var activitypub_flag = flag.Bool("activitypub", false, "publish every collection as an ActivityPub actor at {url}/feed/{uuid}/actor")
 
 func main() {
 	flag.Parse()
+	var signer git.Signer
+	if *signing_key_flag == "" {
+		//
+	} else if *datadir_flag != "" || *boltdb_flag != "" {
+		log.Fatal("-signing-key requires the git storer")
+	} else if *accept_push_flag {
+		// pushed commits would break the signed history
+		log.Fatal("-accept-push cannot be combined with -signing-key")
+	} else if s, e := LoadSigner(*signing_key_flag); e != nil {
+		log.Fatal(e)
+	} else {
+		signer = s
+	}
+	if flag.Arg(0) == "migrate" {
+		// e.g. atompub-server migrate git:.atompub bolt:atompub.db
+		if flag.NArg() != 3 {
+			log.Fatal("usage: migrate {from} {to}, each git:{gitdir}, dir:{datadir} or bolt:{file}")
+		} else if e := migrate(flag.Arg(1), flag.Arg(2)); e != nil {
+			log.Fatal(e)
+		}
+		return
+	} else if flag.Arg(0) == "pre-receive" {
+		// run by the hook installed by -accept-push
+		if ok, e := preReceive(*gitdir_flag, os.Stdin, os.Stderr); e != nil {
+			log.Fatal(e)
+		} else if !ok {
+			os.Exit(1)
+		}
+		return
+	} else if flag.Arg(0) == "gc" {
+		// e.g. atompub-server -gitdir .atompub gc --prune 1h, while the
+		// server is stopped; a running server gcs at /admin/gc
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		prune := fs.Duration("prune", default_prune, "delete the unreachable loose objects older than this")
+		fs.Parse(flag.Args()[1:])
+		packed, pruned, e := gc(*gitdir_flag, time.Now().Add(-*prune), func(f func()) { f() })
+		if e != nil {
+			log.Fatal(e)
+		}
+		log.Printf("packed %d objects, pruned %d", packed, pruned)
+		return
+	} else if flag.Arg(0) == "fsck" {
+		// e.g. atompub-server -gitdir .atompub fsck --repair
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := fs.Bool("repair", false, "move the broken objects into the quarantine tree, in a new commit")
+		verify := fs.String("verify", "", "file of trusted OpenPGP and SSH public keys, by one of which every commit of master must be signed")
+		fs.Parse(flag.Args()[1:])
+		problems, e := fsck(*gitdir_flag, *repair, signer, os.Stdout)
+		if e != nil {
+			log.Fatal(e)
+		} else if *repair {
+			problems = nil
+		}
+		if *verify == "" {
+			//
+		} else if trusted, e := LoadTrustedKeys(*verify); e != nil {
+			log.Fatal(e)
+		} else if unsigned, e := verifyCommits(*gitdir_flag, trusted, os.Stdout); e != nil {
+			log.Fatal(e)
+		} else {
+			problems = append(problems, unsigned...)
+		}
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	spec, data_dir := "git:"+*gitdir_flag, *gitdir_flag
+	if *datadir_flag != "" {
+		spec, data_dir = "dir:"+*datadir_flag, *datadir_flag
+	} else if *boltdb_flag != "" {
+		spec, data_dir = "bolt:"+*boltdb_flag, filepath.Dir(*boltdb_flag)
+	}
+	var storer Storer
+	if signer != nil {
+		storer = NewSignedBillyStorer(*gitdir_flag, signer)
+	} else if s, e := openStorer(spec); e != nil {
+		log.Fatal(e)
+	} else {
+		storer = s
+	}
+	var b *Backend
+	if *content_cache_flag > 0 {
+		b = NewLazyBackend(storer, *content_cache_flag)
+	} else {
+		b = NewBackend(storer)
+	}
 	h := &Handler{
-		B:     NewBackend(NewBillyStorer(*gitdir_flag)),
+		B:     b,
 		gzw:   gzip.NewWriter(nil),
 		mutex: new(sync.Mutex),
 		buf:   bytes.NewBuffer(nil),
 		bw:    bufio.NewWriter(nil),
 	}
+	h.Events = NewEventStream(b, h.mutex)
+	if (*websub_flag || *webmention_flag || *activitypub_flag) && *url_flag == "" {
+		log.Fatal("-websub, -webmention and -activitypub require -url")
+	}
+	if *websub_flag {
+		h.Hub = NewHub(b, *url_flag, h.mutex)
+	}
+	if *webmention_flag {
+		h.Webmention = NewWebmention(b, *url_flag, h.mutex)
+	}
+	if *activitypub_flag {
+		// one key signs for all actors, and is kept next to the repository
+		if key, e := LoadOrCreateKey(filepath.Join(data_dir, "activitypub.pem")); e != nil {
+			log.Fatal(e)
+		} else if h.ActivityPub, e = NewActivityPub(b, *url_flag, h.mutex, key); e != nil {
+			log.Fatal(e)
+		}
+	}
+	if *mirror_flag != "" {
+		if s, ok := storer.(*BillyStorer); !ok {
+			log.Fatal("-mirror requires the git storer")
+		} else if m, e := NewMirror(s, strings.Split(*mirror_flag, ","), h.mutex); e != nil {
+			log.Fatal(e)
+		} else {
+			h.Mirror = m
+		}
+	}
+	if s, ok := storer.(*BillyStorer); !ok {
+		if *gc_interval_flag != 0 || *accept_push_flag {
+			log.Fatal("-gc-interval and -accept-push require the git storer")
+		}
+	} else if g, e := NewGC(s, *gc_interval_flag, h.mutex); e != nil {
+		log.Fatal(e)
+	} else {
+		h.GC = g
+		// the hook is written again, as -accept-push may have changed
+		hook := pre_receive_hook
+		if !*accept_push_flag {
+			//
+		} else if exe, e := os.Executable(); e != nil {
+			log.Fatal(e)
+		} else {
+			hook = acceptingHook(exe)
+			go WatchPushes(b, s, time.Second, h.mutex)
+		}
+		if e := installHook(*gitdir_flag, hook); e != nil {
+			log.Fatal(e)
+		}
+	}
+	// e.g. after the storage was restored from a backup
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go ReloadOnSignal(b, hup, h.mutex)
 	log.Printf("Starting AtomPub server on %s", *listen_address_flag)
 	log.Fatal(http.ListenAndServe(*listen_address_flag, h))
 }
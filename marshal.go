@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"mime"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -49,7 +51,7 @@ func (f *Feed) MarshalTo(bw *bufio.Writer) (err error) {
 	}
 
 	for _, l := range f.Links {
-		if e := l.MarshalTo(bw); e != nil {
+		if e := l.MarshalTo(bw, parent); e != nil {
 			return e
 		}
 	}
@@ -132,7 +134,7 @@ func (s *Source) MarshalTo(bw *bufio.Writer, feed_id *URI, t *Entry) (err error)
 		}
 
 		for _, l := range s.Links {
-			if e := l.MarshalTo(bw); e != nil {
+			if e := l.MarshalTo(bw, parent); e != nil {
 				return e
 			}
 		}
@@ -216,7 +218,7 @@ func (t *Entry) MarshalTo(bw *bufio.Writer, feed_id *URI) (err error) {
 	}
 
 	for _, l := range t.Links {
-		if e := l.MarshalTo(bw); e != nil {
+		if e := l.MarshalTo(bw, sub_parent); e != nil {
 			return e
 		}
 	}
@@ -227,6 +229,12 @@ func (t *Entry) MarshalTo(bw *bufio.Writer, feed_id *URI) (err error) {
 		}
 	}
 
+	for _, irt := range t.InReplyTo {
+		if e := irt.MarshalTo(bw); e != nil {
+			return e
+		}
+	}
+
 	if err = t.Rights.MarshalTo(bw, sub_parent); err != nil {
 		//
 	} else if err = t.Control.MarshalTo(bw); err != nil {
@@ -366,11 +374,22 @@ func (u *URI) MarshalTo(bw *bufio.Writer) (err error) {
 	return
 }
 
-func (l *Link) MarshalTo(bw *bufio.Writer) (err error) {
+func (l *Link) MarshalTo(bw *bufio.Writer, parent xml.Name) (err error) {
 	if l == nil {
 		return
 	}
-	if _, err = bw.WriteString("<link"); err != nil {
+
+	var header string
+	switch parent.Space {
+	case atom_xmlns:
+		header = "<link"
+	case app_xmlns:
+		header = "<atom:link"
+	default:
+		err = fmt.Errorf("unknown parent xmlns for link")
+		return
+	}
+	if _, err = bw.WriteString(header); err != nil {
 		return
 	}
 
@@ -378,7 +397,7 @@ func (l *Link) MarshalTo(bw *bufio.Writer) (err error) {
 
 	if _, err = url.Parse(l.Href); err != nil {
 		return
-	} else if _, err = fmt.Fprintf(bw, " href=\"%s\"", l.Href); err != nil {
+	} else if _, err = fmt.Fprintf(bw, " href=\"%s\"", escapeAttr(l.Href)); err != nil {
 		return
 	}
 
@@ -414,9 +433,65 @@ func (l *Link) MarshalTo(bw *bufio.Writer) (err error) {
 		return
 	}
 
+	if l.ThreadCount == 0 && l.ThreadUpdated == "" {
+		//
+	} else if _, err = fmt.Fprintf(bw, " xmlns:thr=\"%s\" thr:count=\"%d\"", thr_xmlns, l.ThreadCount); err != nil {
+		return
+	} else if l.ThreadUpdated == "" {
+		//
+	} else if _, err = fmt.Fprintf(bw, " thr:updated=\"%s\"", l.ThreadUpdated); err != nil {
+		return
+	}
+
+	return
+}
+
+func (irt *InReplyTo) MarshalTo(bw *bufio.Writer) (err error) {
+	if irt == nil {
+		return
+	}
+	if irt.Ref == "" {
+		return fmt.Errorf("in-reply-to is missing ref")
+	} else if _, err = fmt.Fprintf(bw, "<in-reply-to xmlns=\"%s\" ref=\"%s\"", thr_xmlns, escapeAttr(irt.Ref)); err != nil {
+		return
+	}
+
+	defer bw.WriteString("/>")
+
+	if irt.Href == "" {
+		//
+	} else if _, err = url.Parse(irt.Href); err != nil {
+		return
+	} else if _, err = fmt.Fprintf(bw, " href=\"%s\"", escapeAttr(irt.Href)); err != nil {
+		return
+	}
+
+	if irt.Type == "" {
+		//
+	} else if _, _, err = mime.ParseMediaType(irt.Type); err != nil {
+		return
+	} else if _, err = fmt.Fprintf(bw, " type=\"%s\"", irt.Type); err != nil {
+		return
+	}
+
+	if irt.Source == "" {
+		//
+	} else if _, err = fmt.Fprintf(bw, " source=\"%s\"", escapeAttr(irt.Source)); err != nil {
+		return
+	}
 	return
 }
 
+// hrefs may carry query strings
+func escapeAttr(s string) string {
+	if !strings.ContainsAny(s, "&<\"") {
+		return s
+	}
+	buf := bytes.NewBuffer(nil)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
 func (c *Category) MarshalTo(bw *bufio.Writer, parent xml.Name) (err error) {
 	if c == nil {
 		return
@@ -523,6 +598,11 @@ func (w *Workspace) MarshalTo(bw *bufio.Writer) (err error) {
 	} else if err = w.Title.MarshalTo(bw, parent); err != nil {
 		//
 	} else {
+		for _, l := range w.Links {
+			if err = l.MarshalTo(bw, parent); err != nil {
+				return
+			}
+		}
 		for _, c := range w.Collections {
 			if err = c.MarshalTo(bw, parent); err != nil {
 				return
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Micropub, https://www.w3.org/TR/micropub/, mapped onto the collections
+//
+// h-entry properties become plain text posts: name is the slug, content
+// the text, and every category a cat: term of the collection
+
+// a Micropub request, from either form or JSON encoding
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Properties map[string][]interface{} `json:"properties"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     interface{}              `json:"delete"`
+}
+
+// the first value of a property, as text
+func (m *micropubRequest) text(name string) string {
+	for _, v := range m.Properties[name] {
+		return micropubText(v)
+	}
+	return ""
+}
+
+func (m *micropubRequest) texts(name string) (values []string) {
+	for _, v := range m.Properties[name] {
+		if s := micropubText(v); s != "" {
+			values = append(values, s)
+		}
+	}
+	return
+}
+
+// values are strings, or objects such as {"html": ...} or {"value": ...}
+func micropubText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		if s, ok := t["value"].(string); ok {
+			return s
+		} else if s, ok := t["html"].(string); ok {
+			return extractText([]byte(s))
+		}
+	}
+	return ""
+}
+
+func parseMicropubRequest(r *http.Request) (m *micropubRequest, err error) {
+	m = &micropubRequest{Properties: make(map[string][]interface{})}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json":
+		if e := json.NewDecoder(r.Body).Decode(m); e != nil {
+			err = &HTTPError{code: http.StatusBadRequest, message: "could not unmarshal request body"}
+		} else if m.Properties == nil {
+			m.Properties = make(map[string][]interface{})
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if e := r.ParseMultipartForm(32 << 20); e != nil && e != http.ErrNotMultipart {
+			err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+			return
+		}
+		for k, values := range r.PostForm {
+			switch k {
+			case "h":
+				m.Type = []string{"h-" + values[0]}
+			case "action":
+				m.Action = values[0]
+			case "url":
+				m.URL = values[0]
+			case "access_token":
+				//
+			default:
+				for _, v := range values {
+					m.Properties[strings.TrimSuffix(k, "[]")] = append(m.Properties[strings.TrimSuffix(k, "[]")], v)
+				}
+			}
+		}
+	default:
+		err = &HTTPError{
+			code:    http.StatusUnsupportedMediaType,
+			message: "content-type must be application/json or application/x-www-form-urlencoded",
+		}
+	}
+	return
+}
+
+// the path of a URL of this server, e.g. /entry/{uuid}
+func localPath(raw_URL string) string {
+	if u, e := url.Parse(raw_URL); e != nil {
+		return ""
+	} else {
+		return u.Path
+	}
+}
+
+func (h *Handler) postMicropub(w http.ResponseWriter, r *http.Request) (err error) {
+	m, err := parseMicropubRequest(r)
+	if err != nil {
+		return
+	}
+	switch m.Action {
+	case "":
+		err = h.micropubCreate(w, r, m)
+	case "update":
+		err = h.micropubUpdate(w, r, m)
+	case "delete":
+		er := r.Clone(r.Context())
+		er.Method, er.URL.Path = "DELETE", localPath(m.URL)
+		if e := h.B.DeleteEntry(er); e != nil {
+			err = e
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		err = &HTTPError{code: http.StatusBadRequest, message: "unsupported action " + m.Action}
+	}
+	return
+}
+
+func (h *Handler) micropubCreate(w http.ResponseWriter, r *http.Request, m *micropubRequest) (err error) {
+	if len(m.Type) != 0 && m.Type[0] != "h-entry" {
+		return &HTTPError{code: http.StatusBadRequest, message: "only h-entry is supported"}
+	}
+
+	feed_URL := localPath(m.text("mp-destination"))
+	if feed_URL == "" {
+		// the first collection of the default workspace
+		if sd, e := h.B.GetRoot(r); e != nil {
+			return e
+		} else {
+			for _, c := range sd.Workspaces[0].Collections {
+				if c != nil {
+					feed_URL = c.Href
+					break
+				}
+			}
+		}
+	}
+
+	text := bytes.NewBufferString(m.text("content"))
+	pr := r.Clone(r.Context())
+	for _, v := range m.texts("in-reply-to") {
+		er := r.Clone(r.Context())
+		er.URL.Path = localPath(v)
+		if _, e := h.B.GetEntry(er); e == nil && pr.Header.Get("In-Reply-To") == "" {
+			pr.Header.Set("In-Reply-To", er.URL.Path)
+		} else {
+			// replies to other sites are footnoted, and so mentioned
+			text.WriteString("\n" + v)
+		}
+	}
+	for _, v := range m.texts("category") {
+		text.WriteString(" cat:" + v)
+	}
+	slug := m.text("name")
+	if slug == "" {
+		slug = m.text("mp-slug")
+	}
+
+	pr.Method, pr.URL.Path, pr.URL.RawQuery = "POST", feed_URL, ""
+	pr.Header.Set("Content-Type", "text/plain")
+	pr.Header.Set("Slug", slug)
+	pr.Body = io.NopCloser(text)
+	if _, entry_URL, e := h.B.PostToFeed(pr); e != nil {
+		err = e
+	} else {
+		w.Header().Set("Location", entry_URL)
+		w.WriteHeader(http.StatusCreated)
+	}
+	return
+}
+
+func (h *Handler) micropubUpdate(w http.ResponseWriter, r *http.Request, m *micropubRequest) (err error) {
+	er := r.Clone(r.Context())
+	er.Method, er.URL.Path, er.URL.RawQuery = "PUT", localPath(m.URL), ""
+	entry, e := h.B.GetEntry(er)
+	if e != nil {
+		return e
+	}
+
+	new_entry := *entry
+	new_entry.Categories = append([]Category(nil), entry.Categories...)
+	for k, values := range m.Replace {
+		switch k {
+		case "name":
+			new_entry.Title.Text = ""
+			if len(values) != 0 {
+				new_entry.Title.Text = micropubText(values[0])
+			}
+		case "content":
+			text := ""
+			if len(values) != 0 {
+				text = micropubText(values[0])
+			}
+			if body, _, e := preparePlainText(strings.NewReader(text)); e != nil {
+				return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+			} else {
+				new_entry.Content = Content{Type: "xhtml", Body: body}
+			}
+		case "category":
+			new_entry.Categories = nil
+			if m.Add == nil {
+				m.Add = make(map[string][]interface{})
+			}
+			m.Add["category"] = append(values, m.Add["category"]...)
+		default:
+			return &HTTPError{code: http.StatusBadRequest, message: "cannot replace " + k}
+		}
+	}
+	for k, values := range m.Add {
+		if k != "category" {
+			return &HTTPError{code: http.StatusBadRequest, message: "cannot add " + k}
+		}
+		// only categories of the collection, copied as a POST does
+		for _, v := range values {
+			term, found := micropubText(v), false
+			if entry.Source != nil {
+				for _, c := range entry.Source.Categories {
+					if c.Term == term && !found {
+						new_entry.Categories = append(new_entry.Categories, c)
+						found = true
+					}
+				}
+			}
+			if !found {
+				return &HTTPError{code: http.StatusBadRequest, message: "unknown category " + term}
+			}
+		}
+	}
+	switch d := m.Delete.(type) {
+	case nil:
+	case []interface{}:
+		// whole properties
+		for _, k := range d {
+			if k != "category" {
+				return &HTTPError{code: http.StatusBadRequest, message: "cannot delete " + micropubText(k)}
+			}
+			new_entry.Categories = nil
+		}
+	case map[string]interface{}:
+		// some values of properties
+		for k, values := range d {
+			terms, ok := values.([]interface{})
+			if k != "category" || !ok {
+				return &HTTPError{code: http.StatusBadRequest, message: "cannot delete " + k}
+			}
+			kept := make([]Category, 0, len(new_entry.Categories))
+			for _, c := range new_entry.Categories {
+				found := false
+				for _, t := range terms {
+					found = found || micropubText(t) == c.Term
+				}
+				if !found {
+					kept = append(kept, c)
+				}
+			}
+			new_entry.Categories = kept
+		}
+	default:
+		return &HTTPError{code: http.StatusBadRequest, message: "delete must be an array or an object"}
+	}
+
+	if _, e := new_entry.Validate(nil); e != nil {
+		err = &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	} else if e := h.B.PutEntry(er, &new_entry); e != nil {
+		err = e
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return
+}
+
+func (h *Handler) serveMicropub(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	var v interface{}
+	switch r.URL.Query().Get("q") {
+	case "config":
+		sd, e := h.B.GetRoot(r)
+		if e != nil {
+			return nil, e
+		}
+		destinations := make([]map[string]string, 0, 8)
+		for _, ws := range sd.Workspaces {
+			for _, c := range ws.Collections {
+				if c != nil && c.Title != nil {
+					destinations = append(destinations, map[string]string{"uid": c.Href, "name": c.Title.Text})
+				}
+			}
+		}
+		v = map[string]interface{}{
+			"media-endpoint": "/micropub/media",
+			"destination":    destinations,
+			"syndicate-to":   []string{},
+			"q":              []string{"config", "source", "syndicate-to"},
+		}
+	case "syndicate-to":
+		v = map[string]interface{}{"syndicate-to": []string{}}
+	case "source":
+		er := r.Clone(r.Context())
+		er.URL.Path, er.URL.RawQuery = localPath(r.URL.Query().Get("url")), ""
+		entry, e := h.B.GetEntry(er)
+		if e != nil {
+			return nil, e
+		}
+		properties := map[string]interface{}{
+			"name":    []string{entry.Title.Text},
+			"content": []map[string]string{{"html": string(entry.Content.Body), "value": extractText(entry.Content.Body)}},
+			"updated": []string{entry.Updated.T.Format(time.RFC3339)},
+		}
+		if entry.Published != nil {
+			properties["published"] = []string{entry.Published.T.Format(time.RFC3339)}
+		}
+		if len(entry.Categories) != 0 {
+			terms := make([]string, 0, len(entry.Categories))
+			for _, c := range entry.Categories {
+				terms = append(terms, c.Term)
+			}
+			properties["category"] = terms
+		}
+		if len(entry.InReplyTo) != 0 {
+			refs := make([]string, 0, len(entry.InReplyTo))
+			for _, irt := range entry.InReplyTo {
+				refs = append(refs, irt.Href)
+			}
+			properties["in-reply-to"] = refs
+		}
+		if wanted := r.URL.Query()["properties[]"]; len(wanted) != 0 {
+			some := make(map[string]interface{})
+			for _, k := range wanted {
+				if p, ok := properties[k]; ok {
+					some[k] = p
+				}
+			}
+			v = map[string]interface{}{"properties": some}
+		} else {
+			v = map[string]interface{}{"type": []string{"h-entry"}, "properties": properties}
+		}
+	default:
+		return nil, &HTTPError{code: http.StatusBadRequest, message: "unsupported query"}
+	}
+
+	if body, e := json.Marshal(v); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		return body, nil
+	}
+	return
+}
+
+// the media endpoint hands the file over to the media storage
+func (h *Handler) postMicropubMedia(w http.ResponseWriter, r *http.Request) (err error) {
+	if media_URL, e := h.B.PostMedia(r); e != nil {
+		err = e
+	} else {
+		w.Header().Set("Location", media_URL)
+		w.WriteHeader(http.StatusCreated)
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMicropub(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<category term="golang"/>
+<category term="gardening"/>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	micropub := func(content_type string, body string) *http.Response {
+		req := httptest.NewRequest("POST", "/micropub", strings.NewReader(body))
+		req.Header.Set("Content-Type", content_type)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	query := func(q string) (v map[string]interface{}) {
+		req := httptest.NewRequest("GET", "/micropub?"+q, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if e := json.NewDecoder(res.Body).Decode(&v); e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+
+	// form-encoded create, into the only collection
+	form := url.Values{}
+	form.Set("h", "entry")
+	form.Set("name", "Generics")
+	form.Set("content", "Type parameters landed.")
+	form.Add("category[]", "golang")
+	res = micropub("application/x-www-form-urlencoded", form.Encode())
+	if res.StatusCode != http.StatusCreated {
+		t.Fatal(res.Status)
+	}
+	parent_URL := res.Header.Get("Location")
+
+	// JSON create, replying to the first entry
+	res = micropub("application/json", `{
+		"type": ["h-entry"],
+		"properties": {
+			"content": ["So did fuzzing."],
+			"in-reply-to": ["https://example.org`+parent_URL+`"],
+			"mp-destination": ["`+feed_URL+`"]
+		}
+	}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatal(res.Status)
+	}
+	reply_URL := res.Header.Get("Location")
+
+	if v := query("q=config"); len(v["destination"].([]interface{})) != 1 {
+		t.Fatalf("unexpected config %v", v)
+	}
+	source := query("q=source&url=" + url.QueryEscape(parent_URL))
+	properties := source["properties"].(map[string]interface{})
+	if properties["name"].([]interface{})[0] != "Generics" || properties["category"].([]interface{})[0] != "golang" {
+		t.Fatalf("unexpected source %v", source)
+	}
+	source = query("q=source&properties[]=in-reply-to&url=" + url.QueryEscape(reply_URL))
+	if irt := source["properties"].(map[string]interface{})["in-reply-to"].([]interface{}); irt[0] != parent_URL {
+		t.Fatalf("unexpected source %v", source)
+	}
+
+	res = micropub("application/json", `{
+		"action": "update",
+		"url": "`+parent_URL+`",
+		"replace": {"content": ["Type parameters landed in 1.18."]},
+		"add": {"category": ["gardening"]},
+		"delete": {"category": ["golang"]}
+	}`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal(res.Status)
+	}
+	properties = query("q=source&url=" + url.QueryEscape(parent_URL))["properties"].(map[string]interface{})
+	if c := properties["category"].([]interface{}); len(c) != 1 || c[0] != "gardening" {
+		t.Fatalf("unexpected categories %v", c)
+	} else if content := properties["content"].([]interface{})[0].(map[string]interface{}); !strings.Contains(content["value"].(string), "1.18") {
+		t.Fatalf("unexpected content %v", content)
+	}
+
+	// only categories of the collection can be added
+	res = micropub("application/json", `{
+		"action": "update",
+		"url": "`+parent_URL+`",
+		"add": {"category": ["knitting"]}
+	}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+
+	res = micropub("application/x-www-form-urlencoded", "action=delete&url="+url.QueryEscape(reply_URL))
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal(res.Status)
+	}
+	req = httptest.NewRequest("GET", reply_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	}
+
+	if res := micropub("text/plain", "hello"); res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatal(res.Status)
+	}
+}
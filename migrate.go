@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// opens the storer named by spec, one of git:{gitdir}, dir:{datadir}
+// or bolt:{database file}
+func openStorer(spec string) (s Storer, err error) {
+	kind, p, _ := strings.Cut(spec, ":")
+	if p == "" {
+		return nil, fmt.Errorf("expected git:, dir: or bolt: followed by a path, got %q", spec)
+	}
+	switch kind {
+	case "git":
+		s = NewBillyStorer(p)
+	case "dir":
+		s = NewDirStorer(p)
+	case "bolt":
+		s = NewBoltStorer(p)
+	default:
+		err = fmt.Errorf("unknown storer %q", kind)
+	}
+	return
+}
+
+// copies every object of the storer at from into the empty storer at to,
+// as a single commit
+func migrate(from string, to string) (err error) {
+	src, e := openStorer(from)
+	if e != nil {
+		return e
+	} else if c, ok := src.(io.Closer); ok {
+		defer c.Close()
+	}
+	dst, e := openStorer(to)
+	if e != nil {
+		return e
+	} else if c, ok := dst.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	entrymap := make(map[string]*Entry)
+	sourcemap := make(map[string]*Source)
+	workspacemap := make(map[string]*Workspace)
+	subscriptionmap := make(map[string]*Subscription)
+	if e := dst.Populate(entrymap, sourcemap, workspacemap, subscriptionmap, nil, nil); e != nil {
+		return e
+	} else if len(entrymap)+len(sourcemap)+len(workspacemap)+len(subscriptionmap) != 0 {
+		return fmt.Errorf("%s is not empty", to)
+	} else if e := src.Populate(entrymap, sourcemap, workspacemap, subscriptionmap, nil, nil); e != nil {
+		return e
+	}
+
+	for _, v := range sourcemap {
+		if e := dst.AddSource(v); e != nil {
+			return e
+		}
+	}
+	for _, v := range entrymap {
+		if e := dst.AddEntry(v); e != nil {
+			return e
+		}
+	}
+	for _, v := range workspacemap {
+		if e := dst.AddWorkspace(v); e != nil {
+			return e
+		}
+	}
+	for _, v := range subscriptionmap {
+		if e := dst.AddSubscription(v); e != nil {
+			return e
+		}
+	}
+	return dst.Commit(fmt.Sprintf("migrate from %s", from))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// pushes master to every remote after each commit of a BillyStorer, in
+// the background; credentials come from the remote URL, or the ssh agent;
+// a master which is no fast-forward of that of a remote, e.g. after a
+// restore from an older backup, is not pushed to it, as the remote may be
+// the only copy of what it would overwrite
+type Mirror struct {
+	s           *BillyStorer
+	mutex       sync.Locker // the lock of the Handler
+	remotes     []*mirrorRemote
+	retry_delay time.Duration // doubles with every failure, up to max_retry_delay
+}
+
+const max_retry_delay = time.Hour
+
+// the state of a remote, as served at /admin/mirrors
+type MirrorStatus struct {
+	URL      string    `json:"url"`              // without password
+	Pushed   string    `json:"pushed,omitempty"` // the commit last pushed
+	PushedAt time.Time `json:"pushed_at,omitempty"`
+	Error    string    `json:"error,omitempty"` // of the last attempt, if it failed
+	Failures int       `json:"failures"`        // since the last push
+	Pending  bool      `json:"pending"`         // commits are waiting to be pushed
+}
+
+type mirrorRemote struct {
+	MirrorStatus
+	remote  *git.Remote
+	storage *filesystem.Storage
+	kick    chan struct{} // holds at most one push to do
+}
+
+// starts a worker for each remote, which pushes the current master
+// at once; mutex must be the one held by the Handler serving s
+func NewMirror(s *BillyStorer, remotes []string, mutex sync.Locker) (*Mirror, error) {
+	m := &Mirror{
+		s:           s,
+		mutex:       mutex,
+		retry_delay: 10 * time.Second,
+	}
+	fs, ok := s.rep.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, fmt.Errorf("mirror: not a repository on disk")
+	}
+	for _, v := range remotes {
+		// the objects are read through a repository of its own, as the
+		// caches of s.rep are not safe for use without the lock
+		rep, e := git.PlainOpen(fs.Filesystem().Root())
+		if e != nil {
+			return nil, e
+		}
+		r := &mirrorRemote{
+			MirrorStatus: MirrorStatus{URL: v},
+			remote:       git.NewRemote(rep.Storer, &config.RemoteConfig{Name: "mirror", URLs: []string{v}}),
+			storage:      rep.Storer.(*filesystem.Storage),
+			kick:         make(chan struct{}, 1),
+		}
+		if u, e := url.Parse(v); e == nil {
+			r.URL = u.Redacted()
+		}
+		m.remotes = append(m.remotes, r)
+	}
+	s.mirror = m
+	m.kick()
+	for _, r := range m.remotes {
+		go m.work(r)
+	}
+	return m, nil
+}
+
+// called with the lock held, after a commit
+func (m *Mirror) kick() {
+	for _, r := range m.remotes {
+		r.Pending = true
+		select {
+		case r.kick <- struct{}{}:
+		default:
+			// a push is queued already, and will take this commit too
+		}
+	}
+}
+
+func (m *Mirror) work(r *mirrorRemote) {
+	var delay time.Duration
+	for range r.kick {
+		for {
+			// the objects of a commit never change, so only
+			// reading master needs the lock
+			m.mutex.Lock()
+			head, e := m.s.rep.Reference(plumbing.Master, true)
+			r.Pending = false
+			m.mutex.Unlock()
+			if e == nil {
+				// a gc may have replaced the packs since the last push
+				r.storage.Reindex()
+				e = r.remote.Push(&git.PushOptions{
+					RemoteName: "mirror",
+					RefSpecs:   []config.RefSpec{config.RefSpec(head.Hash().String() + ":" + plumbing.Master.String())},
+				})
+			}
+			// go-git does not wrap the error of a rejected update
+			diverged := e != nil && (errors.Is(e, git.ErrForceNeeded) || strings.Contains(e.Error(), "non-fast-forward"))
+			if errors.Is(e, git.NoErrAlreadyUpToDate) {
+				e = nil
+			} else if diverged {
+				e = fmt.Errorf("%s is not a fast-forward of master of the mirror, which is kept", head.Hash())
+			}
+
+			m.mutex.Lock()
+			if e == nil {
+				r.Pushed, r.PushedAt, r.Error, r.Failures = head.Hash().String(), time.Now(), "", 0
+			} else if r.Error, r.Failures = e.Error(), r.Failures+1; r.Failures == 1 {
+				delay = m.retry_delay
+			} else {
+				delay = min(2*delay, max_retry_delay)
+			}
+			m.mutex.Unlock()
+
+			if e == nil {
+				break
+			} else if diverged {
+				// not until the next commit, which may not be either
+				log.Printf("mirror: %s: %s", r.URL, e)
+				break
+			}
+			log.Printf("mirror: %s: %s, retrying in %s", r.URL, e, delay)
+			time.Sleep(delay)
+		}
+	}
+}
+
+// called with the lock held
+func (m *Mirror) Status() []MirrorStatus {
+	status := make([]MirrorStatus, 0, len(m.remotes))
+	for _, r := range m.remotes {
+		status = append(status, r.MirrorStatus)
+	}
+	return status
+}
+
+func (h *Handler) serveMirrors(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if h.Mirror == nil {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+	if body, err = json.Marshal(h.Mirror.Status()); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestMirror(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	var mirrordir = "/tmp/gitdir-test-mirror"
+	var laterdir = "/tmp/gitdir-test-mirror-later"
+	s := NewBillyStorer(tmpdir)
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		for _, v := range []string{tmpdir, mirrordir, laterdir} {
+			if e := os.RemoveAll(v); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}()
+
+	// the second remote does not exist yet
+	if _, e := git.PlainInit(mirrordir, true); e != nil {
+		t.Fatal(e)
+	}
+	h.mutex.Lock()
+	m, e := NewMirror(s, []string{"file://" + mirrordir, "file://" + laterdir}, h.mutex)
+	if e != nil {
+		t.Fatal(e)
+	}
+	h.Mirror = m
+	m.retry_delay = 10 * time.Millisecond
+	h.mutex.Unlock()
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+	status := func() (mirrors []MirrorStatus) {
+		if res, body := do("GET", "/admin/mirrors", "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if e := json.Unmarshal(body, &mirrors); e != nil {
+			t.Fatal(e)
+		} else if len(mirrors) != 2 {
+			t.Fatalf("unexpected mirrors %s", body)
+		}
+		return
+	}
+	// waits until every remote has master at the head of s
+	synced := func() {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			h.mutex.Lock()
+			head, _ := s.Head()
+			h.mutex.Unlock()
+			done := true
+			for _, v := range status() {
+				done = done && !v.Pending && v.Pushed == head
+			}
+			if done {
+				for _, dir := range []string{mirrordir, laterdir} {
+					if rep, e := git.PlainOpen(dir); e != nil {
+						t.Fatal(e)
+					} else if ref, e := rep.Reference(plumbing.Master, true); e != nil {
+						t.Fatal(e)
+					} else if ref.Hash().String() != head {
+						t.Fatalf("%s at %s, not %s", dir, ref.Hash(), head)
+					}
+				}
+				return
+			}
+		}
+		t.Fatalf("mirrors not synced: %+v", status())
+	}
+
+	// the missing remote fails, and is retried
+	for start := time.Now(); status()[1].Failures < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("missing remote not retried")
+		}
+	}
+	if v := status()[1]; v.Error == "" || v.Pushed != "" {
+		t.Fatalf("unexpected status of a missing remote %+v", v)
+	} else if v := status()[0]; v.Error != "" || v.Pushed == "" {
+		t.Fatalf("unexpected status of a good remote %+v", v)
+	}
+	if _, e := git.PlainInit(laterdir, true); e != nil {
+		t.Fatal(e)
+	}
+	synced()
+
+	// every commit is pushed
+	res, _ := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	for _, v := range []string{"one", "two", "three"} {
+		if res, _ := do("POST", feed_URL, "text/plain", v); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+	synced()
+	if v := status()[1]; v.Error != "" || v.Failures != 0 {
+		t.Fatalf("failures kept after a push %+v", v)
+	}
+
+	// a master restored from an older backup does not overwrite them
+	h.mutex.Lock()
+	pushed, _ := s.Head()
+	if c, e := s.rep.CommitObject(plumbing.NewHash(pushed)); e != nil {
+		t.Fatal(e)
+	} else if e := s.rep.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, c.ParentHashes[0])); e != nil {
+		t.Fatal(e)
+	} else if _, e := h.B.(*Backend).Reload(); e != nil {
+		t.Fatal(e)
+	}
+	h.mutex.Unlock()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if v := status(); strings.Contains(v[0].Error, "not a fast-forward") && strings.Contains(v[1].Error, "not a fast-forward") {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("no error for a master which is no fast-forward: %+v", v)
+		}
+	}
+	for _, dir := range []string{mirrordir, laterdir} {
+		if rep, e := git.PlainOpen(dir); e != nil {
+			t.Fatal(e)
+		} else if ref, e := rep.Reference(plumbing.Master, true); e != nil {
+			t.Fatal(e)
+		} else if ref.Hash().String() != pushed {
+			t.Fatalf("%s overwritten with %s", dir, ref.Hash())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	change_created = "created"
+	change_updated = "updated"
+	change_deleted = "deleted"
+)
+
+// a change which has been committed to the storer
+type Change struct {
+	Type     string // created, updated or deleted
+	Commit   string // hash of the commit holding the change
+	FeedURL  string
+	EntryURL string // empty if the change is to the feed itself
+	Entry    *Entry
+	Mention  bool // only the received Webmentions of the entry changed
+}
+
+// observers are notified synchronously, while the handler holds its lock;
+// anything slow should be handed off to a goroutine
+type Observer interface {
+	Notify(b *Backend, c *Change)
+}
+
+func (b *Backend) Observe(o Observer) {
+	b.observers = append(b.observers, o)
+}
+
+func (b *Backend) notify(c *Change) {
+	if b.journal != nil {
+		// an operation is running, which may yet be rolled back
+		b.journal.changes = append(b.journal.changes, c)
+		return
+	}
+	if h, e := b.storer.Head(); e == nil {
+		c.Commit = h
+	}
+	for _, o := range b.observers {
+		o.Notify(b, c)
+	}
+}
+
+func (b *Backend) notifyEntry(change_type string, entry_URL string, entry *Entry) {
+	if c := b.entryChange(change_type, entry_URL, entry); c != nil {
+		b.notify(c)
+	}
+}
+
+// the change of an entry, or nil if it has no source
+func (b *Backend) entryChange(change_type string, entry_URL string, entry *Entry) *Change {
+	if entry == nil || entry.Source == nil || entry.Source.Id == nil {
+		return nil
+	} else if loaded, e := b.full(entry); e == nil {
+		// observers see the content, even of a lazy Backend
+		entry = loaded
+	}
+	return &Change{
+		Type:     change_type,
+		FeedURL:  "/feed/" + strings.TrimPrefix(entry.Source.Id.Target, "urn:uuid:"),
+		EntryURL: entry_URL,
+		Entry:    entry,
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5/helper/mount"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// with -accept-push, the pre-receive hook of the git directory runs
+// atompub-server pre-receive, which takes a push to master if it is a
+// fast-forward and the objects it changes pass the checks of fsck, and
+// their collections those of a POST; the server notices that master
+// moved, and reloads
+
+// reloads b whenever master of s was moved by something other than s,
+// checking every interval; mutex must be the one held by the Handler
+// serving b
+func WatchPushes(b *Backend, s *BillyStorer, interval time.Duration, mutex sync.Locker) {
+	for range time.Tick(interval) {
+		mutex.Lock()
+		if head, e := s.Head(); e != nil {
+			log.Printf("push: %s", e)
+		} else if head == s.head.String() {
+			//
+		} else if reloaded, e := b.Reload(); e != nil {
+			log.Printf("push: reloading %s: %s", head, e)
+		} else {
+			log.Printf("push: reloaded %s, %s", head, reloaded)
+		}
+		mutex.Unlock()
+	}
+}
+
+// the pre-receive hook which runs exe to check a push
+func acceptingHook(exe string) string {
+	return fmt.Sprintf("#!/bin/sh\nexec '%s' -gitdir \"$GIT_DIR\" pre-receive\n", strings.ReplaceAll(exe, "'", `'\''`))
+}
+
+// reads the objects of a push, which git keeps apart until the hook
+// takes it, before those of the repository
+type incomingStorer struct {
+	storer.EncodedObjectStorer
+	incoming storer.EncodedObjectStorer
+}
+
+func (s *incomingStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, e := s.incoming.EncodedObject(t, h); e == nil {
+		return obj, nil
+	}
+	return s.EncodedObjectStorer.EncodedObject(t, h)
+}
+
+// checks the pushes of the lines "{old} {new} {ref}" given to the
+// pre-receive hook; ok is false if one is rejected, for the reasons
+// written to w
+func preReceive(gitdir string, r io.Reader, w io.Writer) (ok bool, err error) {
+	rep, e := git.PlainOpen(gitdir)
+	if e != nil {
+		return false, e
+	}
+	var objs storer.EncodedObjectStorer = rep.Storer
+	if dir := os.Getenv("GIT_QUARANTINE_PATH"); dir != "" {
+		// the objects of the push are in objects/incoming-*, as objects/
+		// of a filesystem of their own
+		fs := polyfill.New(mount.New(memfs.New(), "objects", osfs.New(dir)))
+		objs = &incomingStorer{EncodedObjectStorer: rep.Storer, incoming: filesystem.NewStorage(fs, cache.NewObjectLRUDefault())}
+	}
+
+	ok = true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return false, fmt.Errorf("pre-receive: unexpected line %q", scanner.Text())
+		}
+		old, new, ref := plumbing.NewHash(fields[0]), plumbing.NewHash(fields[1]), fields[2]
+		if ref != plumbing.Master.String() {
+			fmt.Fprintf(w, "%s: only master can be pushed\n", ref)
+			ok = false
+		} else if new.IsZero() {
+			fmt.Fprintf(w, "%s: master cannot be deleted\n", ref)
+			ok = false
+		} else if problems, e := checkPush(objs, old, new); e != nil {
+			return false, e
+		} else {
+			for _, p := range problems {
+				fmt.Fprintf(w, "%s %s: %s\n", p.commit, p.path, p.reason)
+				ok = false
+			}
+		}
+	}
+	if err = scanner.Err(); err == nil && !ok {
+		fmt.Fprintln(w, "push rejected")
+	}
+	return
+}
+
+// the problems of moving master from old to new: it must be a
+// fast-forward, which adds no problems fsck would find, keeps every entry
+// in the shard of its uuid, and of which the collections with a changed
+// source or entry pass Feed.Validate
+func checkPush(objs storer.EncodedObjectStorer, old plumbing.Hash, new plumbing.Hash) (problems []fsckProblem, err error) {
+	new_commit, e := object.GetCommit(objs, new)
+	if e != nil {
+		return nil, e
+	}
+	new_tree, e := new_commit.Tree()
+	if e != nil {
+		return nil, e
+	}
+	known := make(map[string]bool)
+	old_hashes := make(map[string]plumbing.Hash)
+	if !old.IsZero() {
+		old_commit, e := object.GetCommit(objs, old)
+		if e != nil {
+			return nil, e
+		}
+		if ff, e := old_commit.IsAncestor(new_commit); e != nil {
+			return nil, e
+		} else if !ff {
+			return []fsckProblem{{path: "master", commit: new.String(), reason: "not a fast-forward of " + old.String() + ", pull and push again"}}, nil
+		}
+		old_tree, e := old_commit.Tree()
+		if e != nil {
+			return nil, e
+		}
+		old_problems, e := checkTree(old_commit, old_tree)
+		if e != nil {
+			return nil, e
+		}
+		for _, p := range old_problems {
+			known[p.path+"\x00"+p.reason] = true
+		}
+		if e := old_tree.Files().ForEach(func(f *object.File) error {
+			dir, name := objectName(f.Name)
+			old_hashes[path.Join(dir, name)] = f.Hash
+			return nil
+		}); e != nil {
+			return nil, e
+		}
+	}
+
+	new_problems, e := checkTree(new_commit, new_tree)
+	if e != nil {
+		return nil, e
+	}
+	for _, p := range new_problems {
+		if !known[p.path+"\x00"+p.reason] {
+			problems = append(problems, p)
+		}
+	}
+
+	// the objects which fsck found broken are left out
+	entrymap, sourcemap := make(map[string]*Entry), make(map[string]*Source)
+	if e := populateTree(new_tree, entrymap, sourcemap, make(map[string]*Workspace), make(map[string]*Subscription), func(Skipped) {}, nil); e != nil {
+		return nil, e
+	}
+	feed_URLs := make(map[*Source]string, len(sourcemap))
+	for k, v := range sourcemap {
+		feed_URLs[v] = k
+	}
+	changed := make(map[string]bool)
+	if e := new_tree.Files().ForEach(func(f *object.File) error {
+		if dir, name := objectName(f.Name); dir == "entry" && path.Dir(f.Name) != hashDir(dir, name) {
+			problems = append(problems, fsckProblem{path: f.Name, commit: new.String(), reason: "not in its shard " + hashDir(dir, name)})
+		}
+		if dir, name := objectName(f.Name); old_hashes[path.Join(dir, name)] == f.Hash {
+			//
+		} else if dir == "source" {
+			changed["/feed/"+name] = true
+		} else if entry, ok := entrymap["/entry/"+name]; dir == "entry" && ok {
+			changed[feed_URLs[entry.Source]] = true
+		}
+		return nil
+	}); e != nil {
+		return nil, e
+	}
+	feeds := make(map[string]*Feed)
+	for k := range changed {
+		if source, ok := sourcemap[k]; ok {
+			feeds[k] = &Feed{
+				Id:           source.Id,
+				Authors:      source.Authors,
+				Updated:      source.Updated,
+				Rights:       source.Rights,
+				Links:        source.Links,
+				Title:        source.Title,
+				Subtitle:     source.Subtitle,
+				Icon:         source.Icon,
+				Logo:         source.Logo,
+				Categories:   source.Categories,
+				Contributors: source.Contributors,
+			}
+		}
+	}
+	for _, v := range entrymap {
+		if feed, ok := feeds[feed_URLs[v.Source]]; ok {
+			feed.Entries = append(feed.Entries, v)
+		}
+	}
+	feed_URL_list := make([]string, 0, len(feeds))
+	for k := range feeds {
+		feed_URL_list = append(feed_URL_list, k)
+	}
+	sort.Strings(feed_URL_list)
+	for _, k := range feed_URL_list {
+		if e := feeds[k].Validate(); e != nil {
+			problems = append(problems, fsckProblem{path: "source/" + path.Base(k), commit: new.String(), reason: fmt.Sprintf("invalid collection: %v", e)})
+		}
+	}
+	return
+}
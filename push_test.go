@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run by the pre-receive hook of TestPush, as atompub-server pre-receive
+func TestPreReceiveHelper(t *testing.T) {
+	if os.Getenv("ATOMPUB_TEST_PRE_RECEIVE") == "" {
+		return
+	} else if ok, e := preReceive(os.Getenv("GIT_DIR"), os.Stdin, os.Stderr); e != nil {
+		os.Stderr.WriteString(e.Error() + "\n")
+		os.Exit(2)
+	} else if !ok {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestPush(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	var clonedir = "/tmp/gitdir-test-clone"
+	if _, e := exec.LookPath("git"); e != nil {
+		t.Skip("no git to push with")
+	}
+	s := NewBillyStorer(tmpdir)
+	b := NewBackend(s)
+	h := &Handler{
+		B:     b,
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		for _, v := range []string{tmpdir, clonedir} {
+			if e := os.RemoveAll(v); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}()
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-C", clonedir, "-c", "user.name=Jane Doe", "-c", "user.email=jane@example.org"}, args...)...)
+		out, e := cmd.CombinedOutput()
+		return string(out), e
+	}
+	// commits the file at name of the clone, written with content
+	edit := func(name string, content string) {
+		if e := os.WriteFile(filepath.Join(clonedir, name), []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		} else if out, e := git("commit", "-a", "-m", "edit "+name); e != nil {
+			t.Fatalf("%v\n%s", e, out)
+		}
+	}
+	read := func(name string) string {
+		p, e := os.ReadFile(filepath.Join(clonedir, name))
+		if e != nil {
+			t.Fatal(e)
+		}
+		return string(p)
+	}
+
+	res, _ := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	if res, _ = do("POST", feed_URL, "text/plain", "as posted"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URL := res.Header.Get("Location")
+	entry_name := path.Join("entry", path.Base(entry_URL)[:entry_shard_len], path.Base(entry_URL))
+	source_name := path.Join("source", path.Base(feed_URL))
+
+	// the hook, running TestPreReceiveHelper of this test binary
+	exe, e := os.Executable()
+	if e != nil {
+		t.Fatal(e)
+	} else if e := installHook(tmpdir, "#!/bin/sh\nATOMPUB_TEST_PRE_RECEIVE=1 exec '"+exe+"' -test.run '^TestPreReceiveHelper$'\n"); e != nil {
+		t.Fatal(e)
+	} else if out, e := exec.Command("git", "clone", tmpdir, clonedir).CombinedOutput(); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	}
+
+	// a broken entry, a collection without a self link and other refs are
+	// rejected, with the reasons
+	edit(entry_name, "<entry")
+	if out, e := git("push", "origin", "master"); e == nil || !strings.Contains(out, "entry/"+path.Base(entry_URL)+": undecodable XML") || !strings.Contains(out, "push rejected") {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("reset", "--hard", "HEAD^"); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	}
+	edit(source_name, strings.Replace(read(source_name), `rel="self"`, `rel="alternate"`, 1))
+	if out, e := git("push", "origin", "master"); e == nil || !strings.Contains(out, source_name+": invalid collection: needs link with self relation") {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("reset", "--hard", "HEAD^"); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("push", "origin", "HEAD:refs/heads/draft"); e == nil || !strings.Contains(out, "only master can be pushed") {
+		t.Fatalf("%v\n%s", e, out)
+	}
+	misplaced := path.Join("entry", "zz", path.Base(entry_URL))
+	if e := os.MkdirAll(filepath.Join(clonedir, "entry", "zz"), 0755); e != nil {
+		t.Fatal(e)
+	} else if out, e := git("mv", entry_name, misplaced); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("commit", "-m", "misplace "+entry_name); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("push", "origin", "master"); e == nil || !strings.Contains(out, misplaced+": not in its shard") {
+		t.Fatalf("%v\n%s", e, out)
+	} else if out, e := git("reset", "--hard", "HEAD^"); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	}
+
+	// a valid edit is taken, and the server cannot commit over it
+	edit(entry_name, strings.Replace(read(entry_name), "as posted", "as pushed", 1))
+	if out, e := git("push", "origin", "master"); e != nil {
+		t.Fatalf("%v\n%s", e, out)
+	} else if res, _ := do("POST", feed_URL, "text/plain", "before the reload"); res.StatusCode != http.StatusInternalServerError {
+		t.Fatal(res.Status)
+	}
+
+	// until it reloads
+	go WatchPushes(b, s, 10*time.Millisecond, h.mutex)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if res, body := do("GET", entry_URL, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if strings.Contains(string(body), "as pushed") {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("push not reloaded")
+		}
+	}
+	if res, _ := do("POST", feed_URL, "text/plain", "after the reload"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res, body := do("GET", entry_URL, "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "as pushed") {
+		t.Fatalf("%s %s", res.Status, body)
+	}
+
+	// a push over what the server committed since is no fast-forward
+	edit(entry_name, strings.Replace(read(entry_name), "as pushed", "pushed again", 1))
+	if out, e := git("push", "--force", "origin", "master"); e == nil || !strings.Contains(out, "not a fast-forward") {
+		t.Fatalf("%v\n%s", e, out)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// the maps are read again from the storer, e.g. after a push or after
+// the storage was restored from a backup, at POST /admin/reload and on
+// SIGHUP; the observers are told what changed, as if it had been posted
+
+// a Storer which keeps what it read of the storage, to be read again
+// when something else changed it, e.g. the BillyStorer: next populates
+// the maps of the storage as it is now, and swap makes that the state of
+// the Reloader, which is left as it was if swap is not called
+type Reloader interface {
+	Reload() (next Storer, swap func(), err error)
+}
+
+// a Storer which knows the hash of the stored form of an object, by which
+// a reload tells what changed without reading it
+type Hasher interface {
+	Hash(name string) (hash string, ok bool) // name is {dir}/{uuid}
+}
+
+// what a reload changed, as served at /admin/reload
+type Reloaded struct {
+	Commit  string   `json:"commit"`
+	Created []string `json:"created"` // feed and entry URLs
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+}
+
+func (r *Reloaded) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d deleted", len(r.Created), len(r.Updated), len(r.Deleted))
+}
+
+// a hash of the stored form of an object, to tell if it changed
+func fingerprint(marshal func(bw *bufio.Writer) error) (string, error) {
+	hasher := fnv.New64a()
+	bw := bufio.NewWriter(hasher)
+	if e := marshal(bw); e != nil {
+		return "", e
+	} else if e := bw.Flush(); e != nil {
+		return "", e
+	}
+	return fmt.Sprintf("%x", hasher.Sum64()), nil
+}
+
+// the hash of the source as stored by s, or a fingerprint if s is no
+// Hasher
+func sourceFingerprint(s Storer, feed_URL string, source *Source) (string, error) {
+	if h, ok := s.(Hasher); !ok {
+		//
+	} else if hash, ok := h.Hash("source/" + path.Base(feed_URL)); ok {
+		return hash, nil
+	}
+	return fingerprint(func(bw *bufio.Writer) error { return source.MarshalTo(bw, nil, nil) })
+}
+
+// the hash of the entry as stored by the storer of b, or a fingerprint
+// of it with its content, without its source, of which changes are those
+// of the feed
+func (b *Backend) entryFingerprint(entry_URL string, entry *Entry) (string, error) {
+	if h, ok := b.storer.(Hasher); !ok {
+		//
+	} else if hash, ok := h.Hash("entry/" + path.Base(entry_URL)); ok {
+		return hash, nil
+	}
+	loaded, e := b.full(entry)
+	if e != nil {
+		return "", e
+	}
+	var feed_id *URI
+	if loaded.Source != nil {
+		feed_id = loaded.Source.Id
+	}
+	return fingerprint(func(bw *bufio.Writer) error { return loaded.MarshalTo(bw, feed_id) })
+}
+
+// reads the storer again, replacing the collections, the entries, the
+// service document and the search index at once, and notifies the
+// observers of the differences; if anything fails, the maps and the
+// storer are kept as they were
+func (b *Backend) Reload() (reloaded *Reloaded, err error) {
+	storer, swap := b.storer, func() {}
+	if r, ok := b.storer.(Reloader); !ok {
+		//
+	} else if storer, swap, err = r.Reload(); err != nil {
+		return nil, err
+	}
+	n := &Backend{storer: storer}
+	if b.contents != nil {
+		n.contents = newContentCache(b.contents.budget)
+	}
+	if e := n.load(); e != nil {
+		return nil, e
+	}
+
+	reloaded = &Reloaded{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+	var created_sources, updated_sources, deleted_sources, created_entries, updated_entries, deleted_entries []string
+	for k, v := range n.sourcemap {
+		if old, ok := b.sourcemap[k]; !ok {
+			created_sources = append(created_sources, k)
+		} else if old_fp, e := sourceFingerprint(b.storer, k, old); e != nil {
+			return nil, e
+		} else if fp, e := sourceFingerprint(storer, k, v); e != nil {
+			return nil, e
+		} else if old_fp != fp {
+			updated_sources = append(updated_sources, k)
+		}
+	}
+	for k := range b.sourcemap {
+		if _, ok := n.sourcemap[k]; !ok {
+			deleted_sources = append(deleted_sources, k)
+		}
+	}
+	for k, v := range n.entrymap {
+		if old, ok := b.entrymap[k]; !ok {
+			created_entries = append(created_entries, k)
+		} else if old_fp, e := b.entryFingerprint(k, old); e != nil {
+			return nil, e
+		} else if fp, e := n.entryFingerprint(k, v); e != nil {
+			return nil, e
+		} else if old_fp != fp {
+			updated_entries = append(updated_entries, k)
+		}
+	}
+	// the deleted entries are read while the storer still has them
+	deleted := make(map[string]*Entry)
+	for k, v := range b.entrymap {
+		if _, ok := n.entrymap[k]; ok {
+			//
+		} else if loaded, e := b.full(v); e != nil {
+			// observers are told without the content
+			deleted_entries, deleted[k] = append(deleted_entries, k), v
+		} else {
+			deleted_entries, deleted[k] = append(deleted_entries, k), loaded
+		}
+	}
+
+	swap()
+	b.contents, b.serviceDocument, b.index, b.skipped, b.snapshot = n.contents, n.serviceDocument, n.index, n.skipped, nil
+	b.entrymap, b.sourcemap, b.workspacemap, b.subscriptionmap = n.entrymap, n.sourcemap, n.workspacemap, n.subscriptionmap
+	if h, e := b.storer.Head(); e == nil {
+		reloaded.Commit = h
+	}
+
+	// the feeds before their entries, and the entries before their
+	// feeds are deleted
+	sort.Strings(created_sources)
+	for _, k := range created_sources {
+		b.notify(&Change{Type: change_created, FeedURL: k})
+		reloaded.Created = append(reloaded.Created, k)
+	}
+	sort.Strings(updated_sources)
+	for _, k := range updated_sources {
+		b.notify(&Change{Type: change_updated, FeedURL: k})
+		reloaded.Updated = append(reloaded.Updated, k)
+	}
+	sort.Strings(created_entries)
+	for _, k := range created_entries {
+		b.notifyEntry(change_created, k, b.entrymap[k])
+		reloaded.Created = append(reloaded.Created, k)
+	}
+	sort.Strings(updated_entries)
+	for _, k := range updated_entries {
+		b.notifyEntry(change_updated, k, b.entrymap[k])
+		reloaded.Updated = append(reloaded.Updated, k)
+	}
+	sort.Strings(deleted_entries)
+	for _, k := range deleted_entries {
+		b.notifyEntry(change_deleted, k, deleted[k])
+		reloaded.Deleted = append(reloaded.Deleted, k)
+	}
+	sort.Strings(deleted_sources)
+	for _, k := range deleted_sources {
+		b.notify(&Change{Type: change_deleted, FeedURL: k})
+		reloaded.Deleted = append(reloaded.Deleted, k)
+	}
+	return
+}
+
+func (b *Backend) PostReload(r *http.Request) (reloaded *Reloaded, err *HTTPError) {
+	if b.journal != nil {
+		return nil, &HTTPError{code: http.StatusConflict, message: "an operation is running"}
+	} else if v, e := b.Reload(); e != nil {
+		return nil, &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		return v, nil
+	}
+}
+
+// reloads b on every signal of c, e.g. SIGHUP; mutex must be the one
+// held by the Handler serving b
+func ReloadOnSignal(b *Backend, c <-chan os.Signal, mutex sync.Locker) {
+	for sig := range c {
+		mutex.Lock()
+		if reloaded, e := b.Reload(); e != nil {
+			log.Printf("%s: reloading: %s", sig, e)
+		} else {
+			log.Printf("%s: reloaded %s, %s", sig, reloaded.Commit, reloaded)
+		}
+		mutex.Unlock()
+	}
+}
+
+func (h *Handler) postReload(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	reloaded, e := h.B.PostReload(r)
+	if e != nil {
+		return nil, e
+	}
+	if body, err = json.Marshal(reloaded); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// the changes an observer was notified of, as "{type} {URL}"
+type changeLog []string
+
+func (l *changeLog) Notify(b *Backend, c *Change) {
+	if c.EntryURL != "" {
+		*l = append(*l, c.Type+" "+c.EntryURL)
+	} else {
+		*l = append(*l, c.Type+" "+c.FeedURL)
+	}
+}
+
+func TestReload(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lazy %v", lazy), func(t *testing.T) {
+			var tmpdir = "/tmp/gitdir-test"
+			s := NewBillyStorer(tmpdir)
+			var b *Backend
+			if lazy {
+				b = NewLazyBackend(s, 1<<20)
+			} else {
+				b = NewBackend(s)
+			}
+			h := &Handler{
+				B:     b,
+				gzw:   gzip.NewWriter(nil),
+				mutex: new(sync.Mutex),
+				buf:   bytes.NewBuffer(nil),
+				bw:    bufio.NewWriter(nil),
+			}
+
+			defer func() {
+				if e := os.RemoveAll(tmpdir); e != nil {
+					t.Fatal(e)
+				}
+			}()
+
+			do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+				req := httptest.NewRequest(method, target, strings.NewReader(body))
+				if content_type != "" {
+					req.Header.Set("Content-Type", content_type)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				res := w.Result()
+				p, _ := io.ReadAll(res.Body)
+				return res, p
+			}
+			post_feed := func(title string) string {
+				res, _ := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">`+title+`</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+				if res.StatusCode != http.StatusOK {
+					t.Fatal(res.Status)
+				}
+				return res.Header.Get("Location")
+			}
+			post_entry := func(feed_URL string, content string) string {
+				res, _ := do("POST", feed_URL, "text/plain", content)
+				if res.StatusCode != http.StatusOK {
+					t.Fatal(res.Status)
+				}
+				return res.Header.Get("Location")
+			}
+			reload := func() (reloaded *Reloaded) {
+				if res, body := do("POST", "/admin/reload", "", ""); res.StatusCode != http.StatusOK {
+					t.Fatal(res.Status)
+				} else if e := json.Unmarshal(body, &reloaded); e != nil {
+					t.Fatal(e)
+				}
+				return
+			}
+
+			// a backup, and what was done since
+			feed_URL := post_feed("kept")
+			deleted_URL, updated_URL := post_entry(feed_URL, "deleted since"), post_entry(feed_URL, "as backed up")
+			backup, _ := s.Head()
+			created_feed_URL := post_feed("created since")
+			created_URL := post_entry(feed_URL, "created since")
+			if res, _ := do("DELETE", deleted_URL, "", ""); res.StatusCode != http.StatusOK {
+				t.Fatal(res.Status)
+			}
+			if res, body := do("GET", updated_URL, "", ""); res.StatusCode != http.StatusOK {
+				t.Fatal(res.Status)
+			} else if res, _ := do("PUT", updated_URL, "application/atom+xml;type=entry", strings.Replace(string(body), "as backed up", "edited since", 1)); res.StatusCode != http.StatusOK {
+				t.Fatal(res.Status)
+			}
+
+			// restored, and reloaded
+			changes := new(changeLog)
+			b.Observe(changes)
+			h.mutex.Lock()
+			if e := s.rep.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, plumbing.NewHash(backup))); e != nil {
+				t.Fatal(e)
+			}
+			h.mutex.Unlock()
+			reloaded := reload()
+			if want := (&Reloaded{
+				Commit:  backup,
+				Created: []string{deleted_URL},
+				Updated: []string{feed_URL, updated_URL}, // the feed was touched by the posts
+				Deleted: []string{created_URL, created_feed_URL},
+			}); !reflect.DeepEqual(reloaded, want) {
+				t.Fatalf("reloaded %#v, not %#v", *reloaded, *want)
+			} else if want := (changeLog{"updated " + feed_URL, "created " + deleted_URL, "updated " + updated_URL, "deleted " + created_URL, "deleted " + created_feed_URL}); !reflect.DeepEqual(*changes, want) {
+				t.Fatalf("notified of %v, not %v", *changes, want)
+			}
+
+			// as backed up
+			if res, body := do("GET", updated_URL, "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "as backed up") {
+				t.Fatalf("%s %s", res.Status, body)
+			} else if res, _ := do("GET", deleted_URL, "", ""); res.StatusCode != http.StatusOK {
+				t.Fatal(res.Status)
+			} else if res, _ := do("GET", created_URL, "", ""); res.StatusCode != http.StatusNotFound {
+				t.Fatal(res.Status)
+			} else if res, body := do("GET", "/", "", ""); res.StatusCode != http.StatusOK || strings.Contains(string(body), created_feed_URL) || !strings.Contains(string(body), feed_URL) {
+				t.Fatalf("%s %s", res.Status, body)
+			} else if res, body := do("GET", "/search?q=since", "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "deleted since") || strings.Contains(string(body), "created since") {
+				t.Fatalf("%s %s", res.Status, body)
+			}
+
+			// and on from there, with nothing more to reload
+			post_entry(feed_URL, "after the reload")
+			if reloaded := reload(); len(reloaded.Created)+len(reloaded.Updated)+len(reloaded.Deleted) != 0 {
+				t.Fatalf("reloaded again %#v", *reloaded)
+			} else if n := len(NewBackend(NewBillyStorer(tmpdir)).entrymap); n != 3 {
+				t.Fatalf("%d entries, not 3", n)
+			}
+
+			// a reload which fails keeps the storer and the maps
+			head := s.head
+			h.mutex.Lock()
+			if e := s.rep.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, plumbing.NewHash("0123456789abcdef0123456789abcdef01234567"))); e != nil {
+				t.Fatal(e)
+			}
+			h.mutex.Unlock()
+			if res, _ := do("POST", "/admin/reload", "", ""); res.StatusCode == http.StatusOK {
+				t.Fatal(res.Status)
+			} else if s.head != head {
+				t.Fatalf("head %s, not %s", s.head, head)
+			} else if res, body := do("GET", updated_URL, "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "as backed up") {
+				t.Fatalf("%s %s", res.Status, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// field weights used when ranking search results
+const (
+	search_weight_title    = 4.0
+	search_weight_category = 3.0
+	search_weight_summary  = 2.0
+	search_weight_content  = 1.0
+)
+
+// positions of different fields are separated by this gap
+// so that phrase queries cannot match across fields
+const search_field_gap = 1 << 16
+
+type posting struct {
+	positions []int
+	weight    float64
+}
+
+// in-memory inverted index over the entries
+type SearchIndex struct {
+	postings map[string]map[string]*posting // term -> entry_URL -> posting
+	terms    map[string][]string            // entry_URL -> distinct terms
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[string]*posting),
+		terms:    make(map[string][]string),
+	}
+}
+
+// indexes the entry under entry_URL, replacing any previous version
+func (x *SearchIndex) Add(entry_URL string, entry *Entry) {
+	x.Remove(entry_URL)
+	if entry == nil {
+		return
+	}
+
+	var pos int
+	distinct := make([]string, 0, 64)
+	field := func(tokens []string, weight float64) {
+		for _, tok := range tokens {
+			if m, ok := x.postings[tok]; !ok {
+				x.postings[tok] = map[string]*posting{entry_URL: {positions: []int{pos}, weight: weight}}
+				distinct = append(distinct, tok)
+			} else if p, ok := m[entry_URL]; !ok {
+				m[entry_URL] = &posting{positions: []int{pos}, weight: weight}
+				distinct = append(distinct, tok)
+			} else {
+				p.positions = append(p.positions, pos)
+				p.weight += weight
+			}
+			pos++
+		}
+		pos += search_field_gap
+	}
+
+	field(tokenize(extractText([]byte(entry.Title.Text))), search_weight_title)
+	for _, c := range entry.Categories {
+		field(tokenize(c.Term), search_weight_category)
+		if c.Label != "" {
+			field(tokenize(c.Label), search_weight_category)
+		}
+	}
+	if entry.Summary != nil {
+		field(tokenize(extractText([]byte(entry.Summary.Text))), search_weight_summary)
+	}
+	field(tokenize(extractText(entry.Content.Body)), search_weight_content)
+
+	x.terms[entry_URL] = distinct
+}
+
+// removes entry_URL from the index
+func (x *SearchIndex) Remove(entry_URL string) {
+	for _, tok := range x.terms[entry_URL] {
+		if m, ok := x.postings[tok]; ok {
+			delete(m, entry_URL)
+			if len(m) == 0 {
+				delete(x.postings, tok)
+			}
+		}
+	}
+	delete(x.terms, entry_URL)
+}
+
+// a single clause of a query: a phrase of one or more tokens,
+// where the last token may be a prefix
+type searchClause struct {
+	tokens []string
+	prefix bool
+}
+
+// parses a query string; "quoted words" are phrases and a trailing * marks a prefix
+func parseQuery(q string) (clauses []searchClause) {
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		var raw string
+		if q[0] == '"' {
+			if i := strings.IndexByte(q[1:], '"'); i == -1 {
+				raw, q = q[1:], ""
+			} else {
+				raw, q = q[1:i+1], q[i+2:]
+			}
+		} else if i := strings.IndexAny(q, " \t\n"); i == -1 {
+			raw, q = q, ""
+		} else {
+			raw, q = q[:i], q[i:]
+		}
+		clause := searchClause{prefix: strings.HasSuffix(raw, "*")}
+		if clause.tokens = tokenize(raw); len(clause.tokens) != 0 {
+			clauses = append(clauses, clause)
+		}
+	}
+	return
+}
+
+// returns the entry_URLs matching every clause of q, ranked by relevance
+func (x *SearchIndex) Search(q string) (results []string) {
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return
+	}
+	n := float64(len(x.terms))
+	var scores map[string]float64
+	for _, c := range clauses {
+		matches := x.matchClause(c, n)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for k, v := range scores {
+			if s, ok := matches[k]; !ok {
+				delete(scores, k)
+			} else {
+				scores[k] = v + s
+			}
+		}
+	}
+	results = make([]string, 0, len(scores))
+	for k := range scores {
+		results = append(results, k)
+	}
+	sort.Slice(results, func(i int, j int) bool {
+		if scores[results[i]] != scores[results[j]] {
+			return scores[results[i]] > scores[results[j]]
+		}
+		return results[i] < results[j]
+	})
+	return
+}
+
+func (x *SearchIndex) idf(df int, n float64) float64 {
+	return math.Log(1 + n/float64(df))
+}
+
+// candidate postings for one token, expanding prefixes over the vocabulary
+func (x *SearchIndex) expand(tok string, prefix bool) (ms []map[string]*posting) {
+	if !prefix {
+		if m, ok := x.postings[tok]; ok {
+			ms = append(ms, m)
+		}
+		return
+	}
+	for term, m := range x.postings {
+		if strings.HasPrefix(term, tok) {
+			ms = append(ms, m)
+		}
+	}
+	return
+}
+
+func (x *SearchIndex) matchClause(c searchClause, n float64) (scores map[string]float64) {
+	scores = make(map[string]float64)
+	last := len(c.tokens) - 1
+	candidates := make([][]map[string]*posting, len(c.tokens))
+	for k, tok := range c.tokens {
+		if candidates[k] = x.expand(tok, c.prefix && k == last); len(candidates[k]) == 0 {
+			return
+		}
+	}
+
+	// single term: plain tf-idf
+	if len(c.tokens) == 1 {
+		for _, m := range candidates[0] {
+			idf := x.idf(len(m), n)
+			for entry_URL, p := range m {
+				scores[entry_URL] += p.weight * idf
+			}
+		}
+		return
+	}
+
+	// phrase: positions must be consecutive
+	for _, m := range candidates[0] {
+		for entry_URL, p := range m {
+			for _, start := range p.positions {
+				if !x.phraseAt(candidates, entry_URL, start) {
+					continue
+				}
+				var s float64
+				for _, cs := range candidates {
+					for _, cm := range cs {
+						if cp, ok := cm[entry_URL]; ok {
+							s += cp.weight / float64(len(cp.positions)) * x.idf(len(cm), n)
+						}
+					}
+				}
+				scores[entry_URL] += s
+			}
+		}
+	}
+	return
+}
+
+func (x *SearchIndex) phraseAt(candidates [][]map[string]*posting, entry_URL string, start int) bool {
+	for k := 1; k < len(candidates); k++ {
+		found := false
+		for _, m := range candidates[k] {
+			if p, ok := m[entry_URL]; !ok {
+				continue
+			} else if i := sort.SearchInts(p.positions, start+k); i < len(p.positions) && p.positions[i] == start+k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// returns the character data of an xml fragment, such as the xhtml div of a content body;
+// falls back to the raw input if it does not parse
+func extractText(innerxml []byte) string {
+	buf := bytes.NewBuffer(nil)
+	dec := xml.NewDecoder(io.MultiReader(
+		bytes.NewBufferString("<x>"),
+		bytes.NewReader(innerxml),
+		bytes.NewBufferString("</x>"),
+	))
+	dec.Strict = false
+	for {
+		if t, e := dec.Token(); errors.Is(e, io.EOF) {
+			break
+		} else if e != nil {
+			return string(innerxml)
+		} else if cd, ok := t.(xml.CharData); ok {
+			buf.Write(cd)
+		} else if _, ok := t.(xml.EndElement); ok {
+			// words in adjacent elements should not run together
+			buf.WriteByte(' ')
+		}
+	}
+	return buf.String()
+}
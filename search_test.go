@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	mk := func(title string, body string, cats ...string) *Entry {
+		entry := &Entry{
+			Title:   TextConstruct{XMLName: xml.Name{Space: atom_xmlns, Local: "title"}, Text: title},
+			Content: Content{Type: "xhtml", Body: []byte(`<div xmlns="http://www.w3.org/1999/xhtml"><p>` + body + `</p></div>`)},
+		}
+		for _, c := range cats {
+			entry.Categories = append(entry.Categories, Category{Term: c})
+		}
+		return entry
+	}
+
+	x := NewSearchIndex()
+	x.Add("/entry/a", mk("Open protocols", "the backbone of a decentralized internet"))
+	x.Add("/entry/b", mk("Decentralization", "open source protocols &amp; standards", "golang"))
+	x.Add("/entry/c", mk("Untitled", "nothing to see here"))
+
+	if res := x.Search("protocols"); len(res) != 2 || res[0] != "/entry/a" {
+		// title matches rank above content matches
+		t.Fatalf("unexpected results %v", res)
+	} else if res := x.Search(`"open protocols"`); len(res) != 1 || res[0] != "/entry/a" {
+		t.Fatalf("unexpected phrase results %v", res)
+	} else if res := x.Search("decentral*"); len(res) != 2 || res[0] != "/entry/b" {
+		t.Fatalf("unexpected prefix results %v", res)
+	} else if res := x.Search("golang standards"); len(res) != 1 || res[0] != "/entry/b" {
+		t.Fatalf("unexpected category results %v", res)
+	} else if res := x.Search(`"protocols open"`); len(res) != 0 {
+		t.Fatalf("unexpected phrase results %v", res)
+	}
+
+	x.Add("/entry/a", mk("Closed protocols", "walled gardens"))
+	if res := x.Search(`"open protocols"`); len(res) != 0 {
+		t.Fatalf("stale results after update %v", res)
+	}
+	x.Remove("/entry/b")
+	if res := x.Search("golang"); len(res) != 0 {
+		t.Fatalf("stale results after removal %v", res)
+	} else if len(x.postings["golang"]) != 0 {
+		t.Fatalf("postings not cleaned up")
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<category term="golang"/>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	posts := map[string]string{
+		"Generics":  "Type parameters landed in Go 1.18. cat:golang",
+		"Gardening": "Tomatoes need plenty of sun. https://example.org/tomatoes",
+	}
+	entry_URLs := make(map[string]string)
+	for slug, post := range posts {
+		req := httptest.NewRequest("POST", feed_URL, bytes.NewBufferString(post))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Slug", slug)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry_URLs[slug] = res.Header.Get("Location")
+	}
+
+	search := func(q string) (feed *Feed) {
+		v := url.Values{}
+		v.Set("q", q)
+		v.Set("feed", feed_URL)
+		req := httptest.NewRequest("GET", "/search?"+v.Encode(), nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		feed = &Feed{}
+		if e := xml.NewDecoder(res.Body).Decode(feed); e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+
+	if feed := search("golang"); len(feed.Entries) != 1 || feed.Entries[0].Title.Text != "Generics" {
+		t.Fatalf("unexpected search results")
+	} else if feed := search("tomato*"); len(feed.Entries) != 1 || feed.Entries[0].Title.Text != "Gardening" {
+		t.Fatalf("unexpected search results")
+	}
+
+	req = httptest.NewRequest("DELETE", entry_URLs["Gardening"], nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	if feed := search("tomato*"); len(feed.Entries) != 0 {
+		t.Fatalf("deleted entry still found")
+	}
+
+	// deleting the older of two collections leaves the latest updated time
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	etag := func() string {
+		req := httptest.NewRequest("GET", "/search?q=golang", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().Header.Get("ETag")
+	}
+	before := etag()
+	req = httptest.NewRequest("DELETE", feed_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if etag() == before {
+		t.Fatalf("search etag unchanged by a deleted collection")
+	}
+
+	req = httptest.NewRequest("GET", "/search", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+}
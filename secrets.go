@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// the secrets of the WebSub subscriptions are kept out of the commits of a
+// BillyStorer, which last forever and are pushed to the mirrors, in a file
+// of the git directory readable by its owner only; subscriptions committed
+// before keep their secret in the tree, until they are stored again
+const secrets_name = "atompub-secrets"
+
+// the secrets by subscription key, as written last
+type secretStore struct {
+	fpath   string
+	secrets map[string]string
+}
+
+func loadSecrets(gitdir string) (ss *secretStore, err error) {
+	ss = &secretStore{fpath: path.Join(gitdir, secrets_name), secrets: make(map[string]string)}
+	if p, e := os.ReadFile(ss.fpath); errors.Is(e, fs.ErrNotExist) {
+		//
+	} else if e != nil {
+		err = e
+	} else if e := json.Unmarshal(p, &ss.secrets); e != nil {
+		err = e
+	}
+	return
+}
+
+// sets, or deletes if empty, the secret of key; written at once, as the
+// subscriber uses it from the verification of its intent on
+func (ss *secretStore) Set(key string, secret string) (err error) {
+	if ss.secrets[key] == secret {
+		return
+	} else if secret == "" {
+		delete(ss.secrets, key)
+	} else {
+		ss.secrets[key] = secret
+	}
+	return ss.write()
+}
+
+// drops the secrets of the subscriptions which are gone
+func (ss *secretStore) Prune(keep func(key string) bool) (err error) {
+	pruned := false
+	for k := range ss.secrets {
+		if !keep(k) {
+			delete(ss.secrets, k)
+			pruned = true
+		}
+	}
+	if pruned {
+		err = ss.write()
+	}
+	return
+}
+
+func (ss *secretStore) write() (err error) {
+	p, e := json.Marshal(ss.secrets)
+	if e != nil {
+		return e
+	}
+	tmp := ss.fpath + ".tmp"
+	if e := os.WriteFile(tmp, p, 0600); e != nil {
+		err = e
+	} else {
+		err = os.Rename(tmp, ss.fpath)
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// the entry tree is split by the first characters of the uuid, so that
+// a commit rewrites entry/{shard}/ of the entries it changed, and not a
+// tree of every entry; the staging area, the hashmap keys and the names
+// reported by Populate and fsck stay entry/{uuid}
+//
+// repositories with the entries in entry/ itself, as written before, are
+// reorganized by NewBillyStorer in a commit of their own; old commits
+// and tags keep their layout, so the readers of trees take both
+
+const entry_shard_len = 2
+
+// the hashmap key of an object: entry/{shard} for entries, else dir
+func hashDir(dir string, name string) string {
+	if dir != "entry" {
+		return dir
+	} else if len(name) < entry_shard_len {
+		return path.Join(dir, "_")
+	}
+	return path.Join(dir, strings.ToLower(name[:entry_shard_len]))
+}
+
+// the tree_dirs directory and name of the object at fpath in a tree,
+// of either layout
+func objectName(fpath string) (dir string, name string) {
+	d, name := path.Split(fpath)
+	if dir = path.Clean(d); path.Dir(dir) == "entry" {
+		dir = "entry"
+	}
+	return
+}
+
+// the map of the shard of an entry, created if there is none
+func (s *BillyStorer) hashes(dir string, name string) map[string]plumbing.Hash {
+	key := hashDir(dir, name)
+	if s.hashmap[key] == nil {
+		s.hashmap[key] = make(map[string]plumbing.Hash)
+	}
+	return s.hashmap[key]
+}
+
+// writes the entry tree, of the trees of the shards
+func (s *BillyStorer) entryTree() (h plumbing.Hash, err error) {
+	subtrees := make(map[string]plumbing.Hash)
+	for key, v := range s.trees {
+		if path.Dir(key) == "entry" {
+			subtrees[path.Base(key)] = v
+		}
+	}
+	return dirTreeHelper(s.rep.Storer, subtrees)
+}
+
+// reads the hashes of the objects of tree into the hashmap, and those of
+// its trees; unsharded is true if there are entries directly in entry/,
+// to be moved into their shards by the next commit
+func (s *BillyStorer) readTree(tree *object.Tree) (unsharded bool, err error) {
+	if e := tree.Files().ForEach(func(obj *object.File) error {
+		if dir, name := objectName(obj.Name); !isTreeDir(dir) {
+			// e.g. quarantine/
+		} else if s.hashes(dir, name)[name] = obj.Hash; path.Dir(obj.Name) == "entry" {
+			unsharded = true
+		} else if d := path.Dir(obj.Name); dir == "entry" && d != hashDir(dir, name) {
+			// in the wrong shard, which is written again without it
+			s.dirty[d], s.dirty[hashDir(dir, name)] = true, true
+		}
+		return nil
+	}); e != nil {
+		return false, e
+	}
+	for _, v := range tree.Entries {
+		if isTreeDir(v.Name) {
+			s.trees[v.Name] = v.Hash
+		}
+	}
+	if entry_tree, e := tree.Tree("entry"); e != nil {
+		// no entries
+	} else {
+		for _, v := range entry_tree.Entries {
+			if !v.Mode.IsFile() {
+				s.trees[path.Join("entry", v.Name)] = v.Hash
+			}
+		}
+	}
+	if unsharded {
+		// every shard is new
+		delete(s.trees, "entry")
+		for key := range s.hashmap {
+			if path.Dir(key) == "entry" {
+				s.dirty[key] = true
+			}
+		}
+	}
+	for _, dir := range tree_dirs {
+		if _, ok := s.trees[dir]; !ok && dir != "entry" {
+			s.dirty[dir] = true
+		}
+	}
+	return
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestShardedEntries(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := NewBillyStorer(tmpdir)
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	do := func(method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	// the shard trees of the head commit, by name
+	shards := func(s *BillyStorer) map[string]plumbing.Hash {
+		shards := make(map[string]plumbing.Hash)
+		head, _ := s.Head()
+		if c, e := s.rep.CommitObject(plumbing.NewHash(head)); e != nil {
+			t.Fatal(e)
+		} else if tree, e := c.Tree(); e != nil {
+			t.Fatal(e)
+		} else if entry_tree, e := tree.Tree("entry"); e != nil {
+			t.Fatal(e)
+		} else {
+			for _, v := range entry_tree.Entries {
+				if v.Mode.IsFile() {
+					t.Fatalf("entry/%s not in a shard", v.Name)
+				}
+				shards[v.Name] = v.Hash
+			}
+		}
+		return shards
+	}
+
+	res := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	var entry_URLs []string
+	for range 16 {
+		if res := do("POST", feed_URL, "text/plain", "a post"); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else {
+			entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+		}
+	}
+
+	// every entry is in the shard of its uuid
+	before := shards(s)
+	for _, v := range entry_URLs {
+		name := path.Base(v)
+		if tree, e := s.rep.TreeObject(before[name[:entry_shard_len]]); e != nil {
+			t.Fatal(e)
+		} else if _, e := tree.File(name); e != nil {
+			t.Fatalf("%s not in its shard: %v", name, e)
+		}
+	}
+
+	// a commit rewrites the shard it changes only
+	if res := do("DELETE", entry_URLs[0], "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	changed := path.Base(entry_URLs[0])[:entry_shard_len]
+	after := shards(s)
+	for k, v := range before {
+		if k == changed {
+			if after[k] == v {
+				t.Fatalf("shard %s not rewritten", k)
+			}
+		} else if after[k] != v {
+			t.Fatalf("shard %s rewritten", k)
+		}
+	}
+
+	// an old repository, with every entry in entry/ itself
+	flat := make(map[string]plumbing.Hash)
+	for k, hashes := range s.hashmap {
+		if path.Dir(k) == "entry" {
+			for name, v := range hashes {
+				flat[name] = v
+			}
+		}
+	}
+	subtrees := make(map[string]plumbing.Hash)
+	for _, dir := range tree_dirs {
+		var e error
+		if dir == "entry" {
+			subtrees[dir], e = treeHelper(s.rep.Storer, flat)
+		} else {
+			subtrees[dir], e = treeHelper(s.rep.Storer, s.hashmap[dir])
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if tree, e := dirTreeHelper(s.rep.Storer, subtrees); e != nil {
+		t.Fatal(e)
+	} else if e := s.nextCommit(tree, "unsharded"); e != nil {
+		t.Fatal(e)
+	} else if _, e := s.Tag("unsharded", ""); e != nil {
+		t.Fatal(e)
+	}
+
+	// is sharded once, and keeps its entries
+	s = NewBillyStorer(tmpdir)
+	h.B = NewBackend(s)
+	head, _ := s.Head()
+	if c, e := s.rep.CommitObject(plumbing.NewHash(head)); e != nil {
+		t.Fatal(e)
+	} else if c.Message != "shard the entry tree\n" {
+		t.Fatalf("head is %q", c.Message)
+	} else if len(shards(s)) != len(after) {
+		t.Fatalf("%d shards, not %d", len(shards(s)), len(after))
+	} else if n := len(h.B.(*Backend).entrymap); n != len(entry_URLs)-1 {
+		t.Fatalf("%d entries, not %d", n, len(entry_URLs)-1)
+	} else if again, _ := NewBillyStorer(tmpdir).Head(); again != head {
+		t.Fatal("sharded again")
+	}
+	for _, v := range entry_URLs[1:] {
+		if res := do("GET", v, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		} else if res := do("GET", "/snapshot/unsharded"+v, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+	}
+
+	// a shard goes with its last entry
+	for _, v := range entry_URLs[1:] {
+		if path.Base(v)[:entry_shard_len] == changed {
+			if res := do("DELETE", v, "", ""); res.StatusCode != http.StatusOK {
+				t.Fatal(res.Status)
+			}
+		}
+	}
+	if _, ok := shards(s)[changed]; ok {
+		t.Fatalf("empty shard %s kept", changed)
+	}
+
+	// an entry put in the wrong shard by something else
+	misplaced := path.Base(entry_URLs[len(entry_URLs)-1])
+	wrong := make(map[string]plumbing.Hash)
+	shard_trees := make(map[string]plumbing.Hash)
+	for k, hashes := range s.hashmap {
+		if path.Dir(k) != "entry" || len(hashes) == 0 {
+			continue
+		}
+		kept := make(map[string]plumbing.Hash)
+		for name, v := range hashes {
+			if name == misplaced {
+				wrong[name] = v
+			} else {
+				kept[name] = v
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		var e error
+		if shard_trees[path.Base(k)], e = treeHelper(s.rep.Storer, kept); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var e error
+	if shard_trees["zz"], e = treeHelper(s.rep.Storer, wrong); e != nil {
+		t.Fatal(e)
+	} else if subtrees["entry"], e = dirTreeHelper(s.rep.Storer, shard_trees); e != nil {
+		t.Fatal(e)
+	}
+	for _, dir := range tree_dirs {
+		if dir == "entry" {
+			//
+		} else if subtrees[dir], e = treeHelper(s.rep.Storer, s.hashmap[dir]); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if tree, e := dirTreeHelper(s.rep.Storer, subtrees); e != nil {
+		t.Fatal(e)
+	} else if e := s.nextCommit(tree, "misplaced"); e != nil {
+		t.Fatal(e)
+	}
+
+	// is moved into its shard by the next commit
+	s = NewBillyStorer(tmpdir)
+	h.B = NewBackend(s)
+	if res := do("POST", feed_URL, "text/plain", "after the move"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if _, ok := shards(s)["zz"]; ok && misplaced[:entry_shard_len] != "zz" {
+		t.Fatal("wrong shard kept")
+	} else if tree, e := s.rep.TreeObject(shards(s)[misplaced[:entry_shard_len]]); e != nil {
+		t.Fatal(e)
+	} else if _, e := tree.File(misplaced); e != nil {
+		t.Fatalf("%s not in its shard: %v", misplaced, e)
+	}
+}
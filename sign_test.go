@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignedCommits(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	var keydir = "/tmp/gitdir-test-keys"
+	if e := os.MkdirAll(keydir, os.ModePerm); e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		for _, v := range []string{tmpdir, keydir} {
+			if e := os.RemoveAll(v); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}()
+	write := func(name string, p []byte) string {
+		if e := os.WriteFile(path.Join(keydir, name), p, 0600); e != nil {
+			t.Fatal(e)
+		}
+		return path.Join(keydir, name)
+	}
+
+	// an SSH key, and an OpenPGP key
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, e := ssh.MarshalPrivateKey(priv, "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	ssh_pub, _ := ssh.NewPublicKey(pub)
+	ssh_key := write("id_ed25519", pem.EncodeToMemory(block))
+	entity, e := openpgp.NewEntity("Jane Doe", "", "jane@example.org", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	buf := bytes.NewBuffer(nil)
+	if w, e := armor.Encode(buf, openpgp.PrivateKeyType, nil); e != nil {
+		t.Fatal(e)
+	} else if e := entity.SerializePrivate(w, nil); e != nil {
+		t.Fatal(e)
+	} else if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+	pgp_key := write("private.asc", buf.Bytes())
+	buf.Reset()
+	if w, e := armor.Encode(buf, openpgp.PublicKeyType, nil); e != nil {
+		t.Fatal(e)
+	} else if e := entity.Serialize(w); e != nil {
+		t.Fatal(e)
+	} else if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+	trusted_file := write("trusted", append(append([]byte("# the server\n"), ssh.MarshalAuthorizedKey(ssh_pub)...), buf.Bytes()...))
+	trusted, e := LoadTrustedKeys(trusted_file)
+	if e != nil {
+		t.Fatal(e)
+	} else if len(trusted.ssh) != 1 || len(trusted.pgp) != 1 {
+		t.Fatalf("%d SSH and %d OpenPGP keys trusted", len(trusted.ssh), len(trusted.pgp))
+	}
+
+	post := func(s *BillyStorer, text string) {
+		h := &Handler{
+			B:     NewBackend(s),
+			gzw:   gzip.NewWriter(nil),
+			mutex: new(sync.Mutex),
+			buf:   bytes.NewBuffer(nil),
+			bw:    bufio.NewWriter(nil),
+		}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">`+text+`</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`))
+		req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatal(w.Result().Status)
+		}
+	}
+
+	// every commit is signed, the first one included, with either key
+	for _, fpath := range []string{ssh_key, pgp_key} {
+		signer, e := LoadSigner(fpath)
+		if e != nil {
+			t.Fatal(e)
+		}
+		post(NewSignedBillyStorer(tmpdir, signer), "signed with "+path.Base(fpath))
+	}
+	if problems, e := verifyCommits(tmpdir, trusted, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 0 {
+		t.Fatalf("problems with signed commits: %v", problems)
+	}
+
+	// go-git verifies the OpenPGP signatures too
+	s := NewBillyStorer(tmpdir)
+	head := func() string {
+		h, e := s.Head()
+		if e != nil {
+			t.Fatal(e)
+		}
+		return h
+	}
+	if c, e := s.rep.CommitObject(plumbing.NewHash(head())); e != nil {
+		t.Fatal(e)
+	} else if !strings.Contains(c.PGPSignature, "BEGIN PGP SIGNATURE") {
+		t.Fatalf("no OpenPGP signature in\n%s", c.PGPSignature)
+	} else if _, e := c.Verify(buf.String()); e != nil {
+		t.Fatal(e)
+	}
+
+	// a journal left to recover is not committed, unsigned, by the check
+	wal_path := path.Join(tmpdir, wal_name)
+	if e := os.WriteFile(wal_path, []byte("[\n- subscription/leftover\n]\n"), 0644); e != nil {
+		t.Fatal(e)
+	} else if problems, e := verifyCommits(tmpdir, trusted, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 0 {
+		t.Fatalf("problems after a check with a journal: %v", problems)
+	} else if e := os.Truncate(wal_path, 0); e != nil {
+		t.Fatal(e)
+	}
+
+	// an untrusted key, or none, is reported
+	other_pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewPublicKey(other_pub)
+	untrusted, e := LoadTrustedKeys(write("untrusted", ssh.MarshalAuthorizedKey(other)))
+	if e != nil {
+		t.Fatal(e)
+	} else if problems, e := verifyCommits(tmpdir, untrusted, io.Discard); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 3 {
+		t.Fatalf("%d problems with untrusted signatures, not 3", len(problems))
+	}
+	post(s, "unsigned")
+	out := bytes.NewBuffer(nil)
+	if problems, e := verifyCommits(tmpdir, trusted, out); e != nil {
+		t.Fatal(e)
+	} else if len(problems) != 1 || problems[0].commit != head() || !strings.Contains(out.String(), "unsigned commit") {
+		t.Fatalf("unexpected problems %v:\n%s", problems, out)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// a tag names a commit of master, e.g. the blog as of a release; the
+// collections and entries of its tree are served read-only at
+// /snapshot/{tag}/feed/{uuid} and /snapshot/{tag}/entry/{uuid}
+
+// a Storer which can tag its commits, i.e. the BillyStorer
+type Tagger interface {
+	// an annotated tag if there is a message, else a lightweight one
+	Tag(name string, message string) (tag *Tag, err error)
+	Tags() (tags []*Tag, err error)
+	// like Populate, from the tree of the tagged commit
+	PopulateTag(name string, entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped)) (err error)
+}
+
+type Tag struct {
+	Name    string    `json:"name"`
+	Commit  string    `json:"commit"`
+	Message string    `json:"message,omitempty"` // empty for lightweight tags
+	Tagged  time.Time `json:"tagged"`            // that of the commit for lightweight tags
+}
+
+// a subset of what git allows, which needs no escaping in URLs
+var tag_name_re = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (s *BillyStorer) Tag(name string, message string) (tag *Tag, err error) {
+	ref_name := plumbing.NewTagReferenceName(name)
+	head, e := s.rep.Reference(plumbing.Master, true)
+	if e != nil {
+		return nil, e
+	} else if _, e := s.rep.Reference(ref_name, false); e == nil {
+		return nil, git.ErrTagExists
+	}
+	commit_obj, e := s.rep.CommitObject(head.Hash())
+	if e != nil {
+		return nil, e
+	}
+	tag = &Tag{Name: name, Commit: head.Hash().String(), Tagged: commit_obj.Committer.When}
+	target := head.Hash()
+	if message != "" {
+		tag.Message, tag.Tagged = strings.TrimRight(message, "\n")+"\n", time.Now().Truncate(time.Second)
+		w := bytes.NewBuffer(nil)
+		if timestring := fmt.Sprintf("%d %s", tag.Tagged.Unix(), tag.Tagged.Format("-0700")); false {
+			//
+		} else if _, e := fmt.Fprintf(w, "object %s\ntype commit\ntag %s\n", head.Hash(), name); e != nil {
+			err = e
+		} else if _, e := fmt.Fprintf(w, "tagger %s %s\n\n%s", commit_obj.Committer.String(), timestring, tag.Message); e != nil {
+			err = e
+		} else if target, e = storeTag(s.rep, s.signer, w.Bytes()); e != nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e := s.rep.Storer.SetReference(plumbing.NewHashReference(ref_name, target)); e != nil {
+		return nil, e
+	}
+	return
+}
+
+// stores the tag object with the headers and message in payload; a
+// signature follows the message, as git tag -s does
+func storeTag(rep *git.Repository, signer git.Signer, payload []byte) (hash plumbing.Hash, err error) {
+	obj := rep.Storer.NewEncodedObject()
+	obj.SetType(plumbing.TagObject)
+	var sig []byte
+	if signer == nil {
+		//
+	} else if sig, err = signer.Sign(bytes.NewReader(payload)); err != nil {
+		return
+	}
+	if w, e := obj.Writer(); e != nil {
+		err = e
+	} else if _, e := w.Write(payload); e != nil {
+		err = e
+	} else if _, e := w.Write(sig); e != nil {
+		err = e
+	} else if e := w.Close(); e != nil {
+		err = e
+	} else {
+		return rep.Storer.SetEncodedObject(obj)
+	}
+	return
+}
+
+// oldest first
+func (s *BillyStorer) Tags() (tags []*Tag, err error) {
+	iter, e := s.rep.Tags()
+	if e != nil {
+		return nil, e
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		tag := &Tag{Name: ref.Name().Short()}
+		if tag_obj, e := s.rep.TagObject(ref.Hash()); e == nil {
+			tag.Commit, tag.Message, tag.Tagged = tag_obj.Target.String(), tag_obj.Message, tag_obj.Tagger.When
+		} else if !errors.Is(e, plumbing.ErrObjectNotFound) {
+			return e
+		} else if commit_obj, e := s.rep.CommitObject(ref.Hash()); e != nil {
+			return e
+		} else {
+			tag.Commit, tag.Tagged = commit_obj.Hash.String(), commit_obj.Committer.When
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Tagged.Equal(tags[j].Tagged) {
+			return tags[i].Name < tags[j].Name
+		}
+		return tags[i].Tagged.Before(tags[j].Tagged)
+	})
+	return
+}
+
+func (s *BillyStorer) PopulateTag(name string, entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped)) (err error) {
+	var commit_obj *object.Commit
+	if ref, e := s.rep.Reference(plumbing.NewTagReferenceName(name), false); e != nil {
+		err = e
+	} else if tag_obj, e := s.rep.TagObject(ref.Hash()); e == nil {
+		commit_obj, err = tag_obj.Commit()
+	} else {
+		commit_obj, err = s.rep.CommitObject(ref.Hash())
+	}
+	if err != nil {
+		return
+	} else if tree, e := commit_obj.Tree(); e != nil {
+		err = e
+	} else {
+		err = populateTree(tree, entrymap, sourcemap, workspacemap, subscriptionmap, skip, nil)
+	}
+	return
+}
+
+// the Backend of a tag, kept for the requests which follow
+type snapshot struct {
+	tag Tag
+	b   *Backend
+}
+
+func (b *Backend) PostSnapshot(r *http.Request, name string, message string) (tag *Tag, tag_URL string, err *HTTPError) {
+	tagger, ok := b.storer.(Tagger)
+	if !ok {
+		return nil, "", &HTTPError{code: http.StatusNotImplemented, message: "snapshots need the git storer"}
+	} else if !tag_name_re.MatchString(name) || strings.HasSuffix(name, ".lock") {
+		return nil, "", &HTTPError{code: http.StatusBadRequest, message: "name must be letters, digits, '.', '_' and '-'"}
+	} else if tag, e := tagger.Tag(name, message); errors.Is(e, git.ErrTagExists) {
+		return nil, "", &HTTPError{code: http.StatusConflict, message: "snapshot exists"}
+	} else if e != nil {
+		return nil, "", &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		return tag, "/snapshot/" + name, nil
+	}
+}
+
+func (b *Backend) GetSnapshots(r *http.Request) (tags []*Tag, err *HTTPError) {
+	if tagger, ok := b.storer.(Tagger); !ok {
+		err = &HTTPError{code: http.StatusNotImplemented, message: "snapshots need the git storer"}
+	} else if t, e := tagger.Tags(); e != nil {
+		err = &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		tags = t
+	}
+	return
+}
+
+// a read-only Backend of the tree of the tag
+func (b *Backend) GetSnapshot(r *http.Request, name string) (snapshot_b IBackend, err *HTTPError) {
+	tags, err := b.GetSnapshots(r)
+	if err != nil {
+		return nil, err
+	}
+	var tag *Tag
+	for _, v := range tags {
+		if v.Name == name {
+			tag = v
+		}
+	}
+	if tag == nil {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	} else if b.snapshot != nil && b.snapshot.tag == *tag {
+		return b.snapshot.b, nil
+	}
+
+	s := &Backend{
+		entrymap:        make(map[string]*Entry),
+		sourcemap:       make(map[string]*Source),
+		workspacemap:    make(map[string]*Workspace),
+		subscriptionmap: make(map[string]*Subscription),
+	}
+	if e := b.storer.(Tagger).PopulateTag(name, s.entrymap, s.sourcemap, s.workspacemap, s.subscriptionmap, s.skip); e != nil {
+		return nil, &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	b.snapshot = &snapshot{tag: *tag, b: s}
+	return s, nil
+}
+
+func (h *Handler) serveSnapshot(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if r.URL.Path == "/snapshot" {
+		tags, e := h.B.GetSnapshots(r)
+		if e != nil {
+			return nil, e
+		} else if tags == nil {
+			tags = []*Tag{}
+		}
+		if body, err = json.Marshal(tags); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		return
+	}
+
+	// /snapshot/{tag}/feed/{uuid} or /snapshot/{tag}/entry/{uuid}
+	name, inner, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/snapshot/"), "/")
+	inner = "/" + inner
+	if path.Dir(inner) != "/feed" && path.Dir(inner) != "/entry" {
+		return nil, &HTTPError{code: http.StatusNotFound}
+	}
+	snapshot_b, e := h.B.GetSnapshot(r, name)
+	if e != nil {
+		return nil, e
+	}
+	sr := r.Clone(r.Context())
+	sr.URL.Path = inner
+	if path.Dir(inner) == "/feed" {
+		if feed, e := snapshot_b.GetFeed(sr); e != nil {
+			err = e
+		} else {
+			body, err = h.writeFeed(w, r, feed)
+		}
+	} else if entry, e := snapshot_b.GetEntry(sr); e != nil {
+		err = e
+	} else {
+		body, err = h.writeEntry(w, r, entry)
+	}
+	return
+}
+
+func (h *Handler) postSnapshot(w http.ResponseWriter, r *http.Request) (body []byte, err error) {
+	if e := r.ParseForm(); e != nil {
+		return nil, &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	}
+	tag, tag_URL, e := h.B.PostSnapshot(r, r.PostForm.Get("name"), r.PostForm.Get("message"))
+	if e != nil {
+		return nil, e
+	}
+	if body, err = json.Marshal(tag); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", tag_URL)
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	h := &Handler{
+		B:     NewBackend(NewBillyStorer(tmpdir)),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	do := func(method string, target string, content_type string, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		p, _ := io.ReadAll(res.Body)
+		return res, p
+	}
+	tag := func(name string, message string) *http.Response {
+		res, _ := do("POST", "/snapshot", "application/x-www-form-urlencoded", url.Values{"name": {name}, "message": {message}}.Encode())
+		return res
+	}
+	entries := func(target string) int {
+		feed := new(Feed)
+		if res, body := do("GET", target, "", ""); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", target, res.Status)
+		} else if e := xml.Unmarshal(body, feed); e != nil {
+			t.Fatal(e)
+		}
+		return len(feed.Entries)
+	}
+
+	res, _ := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	res, _ = do("POST", feed_URL, "text/plain", "as of the release")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URL := res.Header.Get("Location")
+
+	// an annotated tag, and a lightweight one
+	if res := tag("v1.0", "the first release"); res.StatusCode != http.StatusOK || res.Header.Get("Location") != "/snapshot/v1.0" {
+		t.Fatalf("%s %s", res.Status, res.Header.Get("Location"))
+	} else if res := tag("v1.0", ""); res.StatusCode != http.StatusConflict {
+		t.Fatal(res.Status)
+	} else if res := tag("../master", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+
+	// the live collection moves on
+	if res, _ := do("DELETE", entry_URL, "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res, _ := do("POST", feed_URL, "text/plain", "after the release"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res, _ := do("POST", feed_URL, "text/plain", "and another"); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if res := tag("latest", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	// the snapshots do not
+	if n := entries(feed_URL); n != 2 {
+		t.Fatalf("%d live entries", n)
+	} else if n := entries("/snapshot/v1.0" + feed_URL); n != 1 {
+		t.Fatalf("%d entries in v1.0", n)
+	} else if n := entries("/snapshot/latest" + feed_URL); n != 2 {
+		t.Fatalf("%d entries in latest", n)
+	} else if n := entries("/snapshot/v1.0" + feed_URL); n != 1 {
+		t.Fatalf("%d entries in v1.0, served again", n)
+	}
+	if res, _ := do("GET", entry_URL, "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res, body := do("GET", "/snapshot/v1.0"+entry_URL, "", ""); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "as of the release") {
+		t.Fatalf("%s %s", res.Status, body)
+	} else if res, _ := do("GET", "/snapshot/v2.0"+entry_URL, "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res, _ := do("GET", "/snapshot/v1.0/media/x", "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	} else if res, _ := do("DELETE", "/snapshot/v1.0"+entry_URL, "", ""); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal(res.Status)
+	}
+
+	tags := []*Tag{}
+	by_name := make(map[string]*Tag)
+	if res, body := do("GET", "/snapshot", "", ""); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	} else if e := json.Unmarshal(body, &tags); e != nil {
+		t.Fatal(e)
+	} else if len(tags) != 2 {
+		t.Fatalf("unexpected snapshots %s", body)
+	} else {
+		for _, v := range tags {
+			by_name[v.Name] = v
+		}
+	}
+	if v, w := by_name["v1.0"], by_name["latest"]; v == nil || w == nil || v.Message != "the first release\n" || w.Message != "" {
+		t.Fatalf("unexpected snapshots %+v", tags)
+	} else if head, _ := h.B.(*Backend).storer.Head(); w.Commit != head || v.Commit == head {
+		t.Fatalf("snapshots at %s and %s, head at %s", v.Commit, w.Commit, head)
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -18,75 +21,143 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/google/uuid"
 )
 
 type Storer interface {
-	Populate(entrymap map[string]*Entry, sourcemap map[string]*Source) (err error)
+	// objects which cannot be loaded are handed to skip, or fail the
+	// Populate if skip is nil; each entry put into the entrymap is handed
+	// to loaded, if not nil, which may drop its content
+	Populate(entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped), loaded func(entry_URL string, entry *Entry)) (err error)
 	AddEntry(entry *Entry) (err error)
 	DeleteEntry(entry *Entry) (err error)
+	ReadEntry(entry_uuid string) (entry *Entry, err error)
 	AddSource(source *Source) (err error)
 	DeleteSource(source *Source) (err error)
+	AddWorkspace(ws *Workspace) (err error)
+	DeleteWorkspace(ws *Workspace) (err error)
+	AddSubscription(sub *Subscription) (err error)
+	DeleteSubscription(sub *Subscription) (err error)
 	Commit(message string) (err error)
+	Head() (hash string, err error)
+
+	// changes are staged until Commit; after Begin, Rollback discards
+	// every change staged since, instead of committing them
+	Begin() (err error)
+	Rollback() (err error)
 }
 
 // implementation
 type BillyStorer struct {
 	fsys    billy.Filesystem
-	hashmap map[string]map[string]plumbing.Hash
+	hashmap map[string]map[string]plumbing.Hash // by hashDir
+	trees   map[string]plumbing.Hash            // written last, of each hashDir and entry
+	dirty   map[string]bool                     // hashDirs changed since their tree was written
+	begun   bool
+	undo    []hashUndo // hashmap changes since Begin
+	wal     *wal
 	rep     *git.Repository
 	bw      *bufio.Writer
 	buf     *bytes.Buffer
+	lines   *bytes.Buffer
+
+	// the subtree of broken objects set aside by fsck --repair, if any
+	quarantine plumbing.Hash
+	// master, as last read or committed; a commit fails if it moved
+	head plumbing.Hash
+
+	mirror  *Mirror    // nil if there are no mirror remotes
+	signer  git.Signer // nil if commits are not signed
+	secrets *secretStore
+}
+
+// a hashmap value before a change; ok is false if there was none
+type hashUndo struct {
+	dir  string
+	name string
+	hash plumbing.Hash
+	ok   bool
 }
 
 func NewBillyStorer(gitdir string) *BillyStorer {
+	return NewSignedBillyStorer(gitdir, nil)
+}
+
+// signs every commit, from the first of a new repository on, with signer
+func NewSignedBillyStorer(gitdir string, signer git.Signer) *BillyStorer {
 	s := &BillyStorer{
 		fsys:    memfs.New(),
 		hashmap: make(map[string]map[string]plumbing.Hash),
+		trees:   make(map[string]plumbing.Hash),
+		dirty:   make(map[string]bool),
 		bw:      bufio.NewWriter(nil),
 		buf:     bytes.NewBuffer(nil),
+		lines:   bytes.NewBuffer(nil),
+		signer:  signer,
+	}
+	for _, dir := range tree_dirs {
+		if e := s.fsys.MkdirAll(dir, os.ModePerm); e != nil {
+			panic(e)
+		} else if dir != "entry" {
+			s.hashmap[dir] = make(map[string]plumbing.Hash)
+		}
+	}
+	unsharded := false
+	if rep, u, e := s.gitStartUp(gitdir); e != nil {
+		panic(e)
+	} else {
+		s.rep, unsharded = rep, u
 	}
-	if e := s.fsys.MkdirAll("entry", os.ModePerm); e != nil {
+	if ss, e := loadSecrets(gitdir); e != nil {
 		panic(e)
-	} else if e := s.fsys.MkdirAll("source", os.ModePerm); e != nil {
+	} else {
+		s.secrets = ss
+	}
+	if e := s.recover(path.Join(gitdir, wal_name)); e != nil {
 		panic(e)
-	} else if s.hashmap["entry"] = make(map[string]plumbing.Hash); false {
-		//
-	} else if s.hashmap["source"] = make(map[string]plumbing.Hash); false {
+	} else if !unsharded {
 		//
-	} else if rep, e := s.gitStartUp(gitdir); e != nil {
+	} else if e := s.Commit("shard the entry tree"); e != nil {
 		panic(e)
 	} else {
-		s.rep = rep
+		log.Printf("moved the entries of %s into entry/{shard}/", gitdir)
 	}
 
 	return s
 }
 
-func (s *BillyStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]*Source) (err error) {
-	if ref, e := s.rep.Reference(plumbing.Master, true); e != nil {
-		err = e
-	} else if commit_obj, e := s.rep.CommitObject(ref.Hash()); e != nil {
+// reads the tree of the head, as last read or committed
+func (s *BillyStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped), loaded func(entry_URL string, entry *Entry)) (err error) {
+	if commit_obj, e := s.rep.CommitObject(s.head); e != nil {
 		err = e
 	} else if tree, e := commit_obj.Tree(); e != nil {
 		err = e
-	} else if iter := tree.Files(); false {
+	} else if e := populateTree(tree, entrymap, sourcemap, workspacemap, subscriptionmap, skip, loaded); e != nil {
+		err = e
+	} else {
+		for k, v := range subscriptionmap {
+			if secret, ok := s.secrets.secrets[k]; ok {
+				v.Secret = secret
+			}
+		}
+	}
+	return
+}
+
+// decodes the objects of a commit tree into the maps
+func populateTree(tree *object.Tree, entrymap map[string]*Entry, sourcemap map[string]*Source, workspacemap map[string]*Workspace, subscriptionmap map[string]*Subscription, skip func(Skipped), loaded func(entry_URL string, entry *Entry)) (err error) {
+	if iter := tree.Files(); false {
 		//
 	} else if e := iter.ForEach(func(obj *object.File) (err error) {
 		// load the sources
-		if path.Dir(obj.Name) != "source" {
+		if dir, _ := objectName(obj.Name); dir != "source" {
 			return nil
 		} else if objr, e := obj.Reader(); e != nil {
 			err = e
-		} else if source := new(Source); false {
-			//
-		} else if e := xml.NewDecoder(objr).Decode(source); e != nil {
-			err = e
-		} else if source.Id == nil || source.Updated == nil {
-			err = fmt.Errorf("nil pointer dereference")
-		} else if u, e := uuid.Parse(source.Id.Target); e != nil {
-			err = fmt.Errorf("cannot parse source id as urn:uuid")
-		} else if feed_URL := "/feed/" + u.String(); true {
+		} else if feed_URL, source, e := decodeSource(objr); e != nil {
+			err = skipOrFail(skip, obj.Name, nil, e)
+		} else {
 			sourcemap[feed_URL] = source
 		}
 		return
@@ -95,39 +166,44 @@ func (s *BillyStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]
 	} else if iter = tree.Files(); false {
 		//
 	} else if e := iter.ForEach(func(obj *object.File) (err error) {
-		if path.Dir(obj.Name) != "entry" {
+		if dir, name := objectName(obj.Name); dir != "entry" {
 			return nil
 		} else if objr, e := obj.Reader(); e != nil {
 			err = e
-		} else if entry := new(Entry); false {
-			//
-		} else if e := xml.NewDecoder(objr).Decode(entry); e != nil {
+		} else if entry_URL, entry, e := decodeEntry(objr, path.Join(dir, name), sourcemap); e != nil {
+			err = skipOrFail(skip, path.Join(dir, name), entry, e)
+		} else if entrymap[entry_URL] = entry; loaded != nil {
+			loaded(entry_URL, entry)
+		}
+		return
+	}); e != nil {
+		err = e
+	} else if iter = tree.Files(); false {
+		//
+	} else if e := iter.ForEach(func(obj *object.File) (err error) {
+		if dir, _ := objectName(obj.Name); dir != "workspace" {
+			return nil
+		} else if objr, e := obj.Reader(); e != nil {
 			err = e
-		} else if entry.Content.Body = bytes.Map(func(r rune) rune {
-			if r == '\n' {
-				return -1
-			} else {
-				return r
-			}
-		}, entry.Content.Body); false {
-			//
-		} else if _, e := entry.Validate(nil); e != nil {
+		} else if ws_URL, ws, e := decodeWorkspace(objr, obj.Name); e != nil {
+			err = skipOrFail(skip, obj.Name, nil, e)
+		} else {
+			workspacemap[ws_URL] = ws
+		}
+		return
+	}); e != nil {
+		err = e
+	} else if iter = tree.Files(); false {
+		//
+	} else if e := iter.ForEach(func(obj *object.File) (err error) {
+		if dir, _ := objectName(obj.Name); dir != "subscription" {
+			return nil
+		} else if objr, e := obj.Reader(); e != nil {
 			err = e
-		} else if entry.Source == nil || entry.Source.Id == nil {
-			err = fmt.Errorf("nil pointer dereference")
-		} else if u, e := uuid.Parse(entry.Source.Id.Target); e != nil {
-			err = fmt.Errorf("cannot parse source id as urn:uuid")
-		} else if feed_URL := "/feed/" + u.String(); false {
-			//
-		} else if source, ok := sourcemap[feed_URL]; !ok {
-			err = fmt.Errorf("entry without a source: %s", obj.Name)
-		} else if entry.Source = source; false {
-			// the previous source which was unmarshalled into
-			// will be discarded by the garbage collector
-		} else if u, e := uuid.Parse(entry.Id.Target); e != nil {
-			err = fmt.Errorf("cannot parse entry id as urn:uuid")
-		} else if entry_URL := "/entry/" + u.String(); true {
-			entrymap[entry_URL] = entry
+		} else if sub, e := decodeSubscription(objr, obj.Name); e != nil {
+			err = skipOrFail(skip, obj.Name, nil, e)
+		} else {
+			subscriptionmap[sub.Key()] = sub
 		}
 		return
 	}); e != nil {
@@ -137,13 +213,162 @@ func (s *BillyStorer) Populate(entrymap map[string]*Entry, sourcemap map[string]
 	return
 }
 
+// an object a Storer could not load
+type Skipped struct {
+	Name    string `json:"name"`                 // in the storer, e.g. entry/{uuid}
+	FeedURL string `json:"collection,omitempty"` // of the collection it belongs to, if known
+	Reason  string `json:"reason"`
+}
+
+// hands the object at name to skip, or fails without one; entry is what
+// could be decoded of an entry, if anything
+func skipOrFail(skip func(Skipped), name string, entry *Entry, err error) error {
+	if skip == nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	s := Skipped{Name: name, Reason: err.Error()}
+	if path.Dir(name) == "source" {
+		if u, e := uuid.Parse(path.Base(name)); e == nil {
+			s.FeedURL = "/feed/" + u.String()
+		}
+	} else if entry != nil && entry.Source != nil && entry.Source.Id != nil {
+		if u, e := uuid.Parse(entry.Source.Id.Target); e == nil {
+			s.FeedURL = "/feed/" + u.String()
+		}
+	}
+	skip(s)
+	return nil
+}
+
+// decoders of the stored objects, shared by the Storer implementations
+
+func decodeSource(r io.Reader) (feed_URL string, source *Source, err error) {
+	source = new(Source)
+	if e := xml.NewDecoder(r).Decode(source); e != nil {
+		err = e
+	} else if source.Id == nil || source.Updated == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if u, e := uuid.Parse(source.Id.Target); e != nil {
+		err = fmt.Errorf("cannot parse source id as urn:uuid")
+	} else {
+		feed_URL = "/feed/" + u.String()
+	}
+	return
+}
+
+// the sources must be decoded first, as entries share their source
+func decodeEntry(r io.Reader, name string, sourcemap map[string]*Source) (entry_URL string, entry *Entry, err error) {
+	p, e := io.ReadAll(r)
+	if e != nil {
+		return "", nil, e
+	}
+	if entry, err = decodeEntryXML(bytes.NewReader(p)); err != nil {
+		if entry == nil || entry.Source == nil || entry.Source.Id == nil {
+			// the collection of the skipped entry, if it can be told
+			entry = &Entry{Source: scanSourceId(p)}
+		}
+	} else if entry.Source == nil || entry.Source.Id == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if u, e := uuid.Parse(entry.Source.Id.Target); e != nil {
+		err = fmt.Errorf("cannot parse source id as urn:uuid")
+	} else if feed_URL := "/feed/" + u.String(); false {
+		//
+	} else if source, ok := sourcemap[feed_URL]; !ok {
+		err = fmt.Errorf("entry without a source: %s", name)
+	} else if entry.Source = source; false {
+		// the previous source which was unmarshalled into
+		// will be discarded by the garbage collector
+	} else if u, e := uuid.Parse(entry.Id.Target); e != nil {
+		err = fmt.Errorf("cannot parse entry id as urn:uuid")
+	} else {
+		entry_URL = "/entry/" + u.String()
+	}
+	return
+}
+
+// the source id of an entry which cannot be decoded, from the tokens up
+// to the first atom:source/atom:id; nil if there is none
+func scanSourceId(p []byte) *Source {
+	d := xml.NewDecoder(bytes.NewReader(p))
+	d.Strict = false
+	depth, source_depth := 0, 0
+	for {
+		t, e := d.Token()
+		if e != nil {
+			return nil
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			if source_depth == 0 && t.Name.Local == "source" && t.Name.Space == atom_xmlns {
+				source_depth = depth
+			} else if source_depth != 0 && depth == source_depth+1 && t.Name.Local == "id" && t.Name.Space == atom_xmlns {
+				if text, e := d.Token(); e != nil {
+					return nil
+				} else if cd, ok := text.(xml.CharData); ok {
+					return &Source{Id: &URI{Target: string(bytes.TrimSpace(cd))}}
+				}
+				return nil
+			}
+		case xml.EndElement:
+			if depth == source_depth {
+				source_depth = 0
+			}
+			depth--
+		}
+	}
+}
+
+// an entry on its own, with the source as stored
+func decodeEntryXML(r io.Reader) (entry *Entry, err error) {
+	entry = new(Entry)
+	if e := xml.NewDecoder(r).Decode(entry); e != nil {
+		err = e
+	} else if entry.Content.Body = bytes.Map(func(r rune) rune {
+		if r == '\n' {
+			return -1
+		} else {
+			return r
+		}
+	}, entry.Content.Body); false {
+		//
+	} else if _, e := entry.Validate(nil); e != nil {
+		err = e
+	}
+	return
+}
+
+func decodeWorkspace(r io.Reader, name string) (ws_URL string, ws *Workspace, err error) {
+	sd := new(Service)
+	if e := xml.NewDecoder(r).Decode(sd); e != nil {
+		err = e
+	} else if len(sd.Workspaces) != 1 {
+		err = fmt.Errorf("expected a single workspace: %s", name)
+	} else if ws = &sd.Workspaces[0]; false {
+		//
+	} else if u, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		ws_URL = "/workspace/" + u.String()
+	}
+	return
+}
+
+func decodeSubscription(r io.Reader, name string) (sub *Subscription, err error) {
+	sub = new(Subscription)
+	if e := xml.NewDecoder(r).Decode(sub); e != nil {
+		err = e
+	} else if sub.Topic == "" || sub.Callback == "" {
+		err = fmt.Errorf("subscription without topic or callback: %s", name)
+	}
+	return
+}
+
 func (s *BillyStorer) AddEntry(entry *Entry) (err error) {
 	if entry == nil {
 		err = fmt.Errorf("nil pointer dereference")
 	} else if entry_uuid, e := uuid.Parse(entry.Id.Target); e != nil {
 		err = fmt.Errorf("invalid entry id: %w", e)
-	} else if f, e := s.fsys.Create(path.Join("entry", entry_uuid.String())); e != nil {
-		err = e
 	} else if s.buf.Reset(); false {
 		//
 	} else if _, e := s.buf.WriteString(xml.Header); e != nil {
@@ -155,31 +380,7 @@ func (s *BillyStorer) AddEntry(entry *Entry) (err error) {
 	} else if e := s.bw.Flush(); e != nil {
 		err = e
 	} else {
-		// separating into lines makes cleaner git logs
-		for {
-			if l, e := s.buf.ReadBytes('>'); e != nil {
-				err = e
-			} else if _, e := f.Write(l); e != nil {
-				err = e
-			} else if b, e := s.buf.ReadByte(); e != nil {
-				// probably gets tripped here
-				err = e
-			} else if b != '<' {
-				if _, e := f.Write([]byte{b}); e != nil {
-					err = e
-				}
-			} else {
-				if _, e := f.Write([]byte{'\n', b}); e != nil {
-					err = e
-				}
-			}
-			if errors.Is(err, io.EOF) {
-				break
-			} else if err != nil {
-				return
-			}
-		}
-		err = f.Close()
+		err = s.stage(path.Join("entry", entry_uuid.String()))
 	}
 	return
 }
@@ -190,7 +391,25 @@ func (s *BillyStorer) DeleteEntry(entry *Entry) (err error) {
 	} else if entry_uuid, e := uuid.Parse(entry.Id.Target); e != nil {
 		err = fmt.Errorf("invalid entry id: %w", e)
 	} else {
-		delete(s.hashmap["entry"], entry_uuid.String())
+		err = s.unstage("entry", entry_uuid.String())
+	}
+	return
+}
+
+// reads the entry staged or committed last
+func (s *BillyStorer) ReadEntry(entry_uuid string) (entry *Entry, err error) {
+	if f, e := s.fsys.Open(path.Join("entry", entry_uuid)); e == nil {
+		defer f.Close()
+		return decodeEntryXML(f)
+	} else if h, ok := s.hashmap[hashDir("entry", entry_uuid)][entry_uuid]; !ok {
+		err = fmt.Errorf("entry not found: %s", entry_uuid)
+	} else if blob, e := s.rep.BlobObject(h); e != nil {
+		err = e
+	} else if r, e := blob.Reader(); e != nil {
+		err = e
+	} else {
+		defer r.Close()
+		entry, err = decodeEntryXML(r)
 	}
 	return
 }
@@ -200,8 +419,6 @@ func (s *BillyStorer) AddSource(source *Source) (err error) {
 		err = fmt.Errorf("nil pointer dereference")
 	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
 		err = fmt.Errorf("invalid entry id: %w", e)
-	} else if f, e := s.fsys.Create(path.Join("source", source_uuid.String())); e != nil {
-		err = e
 	} else if s.buf.Reset(); false {
 		//
 	} else if _, e := s.buf.WriteString(xml.Header); e != nil {
@@ -213,32 +430,9 @@ func (s *BillyStorer) AddSource(source *Source) (err error) {
 	} else if e := s.bw.Flush(); e != nil {
 		err = e
 	} else {
-		for {
-			if l, e := s.buf.ReadBytes('>'); e != nil {
-				err = e
-			} else if _, e := f.Write(l); e != nil {
-				err = e
-			} else if b, e := s.buf.ReadByte(); e != nil {
-				// probably gets tripped here
-				err = e
-			} else if b != '<' {
-				if _, e := f.Write([]byte{b}); e != nil {
-					err = e
-				}
-			} else {
-				if _, e := f.Write([]byte{'\n', b}); e != nil {
-					err = e
-				}
-			}
-			if errors.Is(err, io.EOF) {
-				break
-			} else if err != nil {
-				return
-			}
-		}
-		err = f.Close()
+		err = s.stage(path.Join("source", source_uuid.String()))
 	}
-	return nil
+	return
 }
 
 func (s *BillyStorer) DeleteSource(source *Source) (err error) {
@@ -247,12 +441,112 @@ func (s *BillyStorer) DeleteSource(source *Source) (err error) {
 	} else if source_uuid, e := uuid.Parse(source.Id.Target); e != nil {
 		err = fmt.Errorf("invalid entry id: %w", e)
 	} else {
-		delete(s.hashmap["source"], source_uuid.String())
+		err = s.unstage("source", source_uuid.String())
 	}
 	return
 }
 
+func (s *BillyStorer) AddWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else if s.buf.Reset(); false {
+		//
+	} else if _, e := s.buf.WriteString(xml.Header); e != nil {
+		err = e
+	} else if s.bw.Reset(s.buf); false {
+		//
+	} else if e := workspaceStub(ws).MarshalTo(s.bw); e != nil {
+		err = e
+	} else if e := s.bw.Flush(); e != nil {
+		err = e
+	} else {
+		err = s.stage(path.Join("workspace", ws_uuid.String()))
+	}
+	return
+}
+
+func (s *BillyStorer) DeleteWorkspace(ws *Workspace) (err error) {
+	if ws_uuid, e := workspaceUUID(ws); e != nil {
+		err = e
+	} else {
+		err = s.unstage("workspace", ws_uuid.String())
+	}
+	return
+}
+
+// the secret is kept apart, in the secretStore
+func (s *BillyStorer) AddSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if e := s.secrets.Set(sub.Key(), sub.Secret); e != nil {
+		err = e
+	} else if stored := *sub; false {
+		//
+	} else if stored.Secret = ""; false {
+		//
+	} else if s.buf.Reset(); false {
+		//
+	} else if _, e := s.buf.WriteString(xml.Header); e != nil {
+		err = e
+	} else if s.bw.Reset(s.buf); false {
+		//
+	} else if e := stored.MarshalTo(s.bw); e != nil {
+		err = e
+	} else if e := s.bw.Flush(); e != nil {
+		err = e
+	} else {
+		err = s.stage(path.Join("subscription", sub.Key()))
+	}
+	return
+}
+
+func (s *BillyStorer) DeleteSubscription(sub *Subscription) (err error) {
+	if sub == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else {
+		err = s.unstage("subscription", sub.Key())
+	}
+	return
+}
+
+// copies buf into f, separating into lines which makes cleaner git logs
+func writeLines(f io.Writer, buf *bytes.Buffer) (err error) {
+	for {
+		if l, e := buf.ReadBytes('>'); e != nil {
+			err = e
+		} else if _, e := f.Write(l); e != nil {
+			err = e
+		} else if b, e := buf.ReadByte(); e != nil {
+			// probably gets tripped here
+			err = e
+		} else if b != '<' {
+			if _, e := f.Write([]byte{b}); e != nil {
+				err = e
+			}
+		} else {
+			if _, e := f.Write([]byte{'\n', b}); e != nil {
+				err = e
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return
+		}
+	}
+}
+
 func (s *BillyStorer) Commit(message string) (err error) {
+	ended, e := s.wal.End()
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if err != nil {
+			// an operation is not complete before its commit
+			s.wal.TruncateTo(ended)
+		}
+	}()
 
 	// store the objects
 	if e := s.storeObjs(); e != nil {
@@ -261,28 +555,110 @@ func (s *BillyStorer) Commit(message string) (err error) {
 		err = e
 	} else if e := s.nextCommit(h, message); e != nil {
 		err = e
+	} else {
+		s.begun, s.undo = false, s.undo[:0]
+		// a journal left over replays what is already committed
+		s.wal.Truncate()
+		s.secrets.Prune(func(key string) bool {
+			_, ok := s.hashmap["subscription"][key]
+			return ok
+		})
+		if s.mirror != nil {
+			s.mirror.kick()
+		}
 	}
 
 	return
 }
 
+// deletions take effect in the hashmap, and are undone by a Rollback
+func (s *BillyStorer) Begin() (err error) {
+	s.begun, s.undo = true, s.undo[:0]
+	return s.wal.Begin()
+}
+
+func (s *BillyStorer) Rollback() (err error) {
+	if !s.begun {
+		return fmt.Errorf("rollback without begin")
+	}
+	for _, dir := range tree_dirs {
+		if entries, e := s.fsys.ReadDir(dir); e != nil {
+			return e
+		} else {
+			for _, entry := range entries {
+				if e := s.fsys.Remove(path.Join(dir, entry.Name())); e != nil {
+					return e
+				}
+			}
+		}
+	}
+	for k := len(s.undo) - 1; k >= 0; k-- {
+		u := s.undo[k]
+		if s.markDirty(u.dir); u.ok {
+			s.hashmap[u.dir][u.name] = u.hash
+		} else {
+			delete(s.hashmap[u.dir], u.name)
+		}
+	}
+	s.begun, s.undo = false, s.undo[:0]
+
+	// what was staged before Begin stays staged
+	if e := s.wal.Rollback(); e != nil {
+		return e
+	} else if _, e := s.replay(s.wal.Staged(), false); e != nil {
+		return e
+	}
+	return
+}
+
+// sets or deletes a hashmap value, saving the previous one if begun
+func (s *BillyStorer) setHash(dir string, name string, hash plumbing.Hash, del bool) {
+	hashes := s.hashes(dir, name)
+	if s.begun {
+		h, ok := hashes[name]
+		s.undo = append(s.undo, hashUndo{dir: hashDir(dir, name), name: name, hash: h, ok: ok})
+	}
+	if s.markDirty(hashDir(dir, name)); del {
+		delete(hashes, name)
+	} else {
+		hashes[name] = hash
+	}
+}
+
+// the tree of key is written again by the next commit
+func (s *BillyStorer) markDirty(key string) {
+	s.dirty[key] = true
+}
+
+// hash of the last commit
+func (s *BillyStorer) Head() (hash string, err error) {
+	if ref, e := s.rep.Reference(plumbing.Master, true); e != nil {
+		err = e
+	} else {
+		hash = ref.Hash().String()
+	}
+	return
+}
+
 const pre_receive_hook = `#!/bin/sh
 echo "atompub-server git backend is read-only."
 exit 1`
 
+// writes the pre-receive hook of the git directory at dir
+func installHook(dir string, hook string) error {
+	if e := os.MkdirAll(path.Join(dir, "hooks"), os.ModePerm); e != nil {
+		return e
+	}
+	return os.WriteFile(path.Join(dir, "hooks", "pre-receive"), []byte(hook), 0744)
+}
+
 // git
-func (s *BillyStorer) gitStartUp(dir string) (rep *git.Repository, err error) {
+func (s *BillyStorer) gitStartUp(dir string) (rep *git.Repository, unsharded bool, err error) {
 	if r, e := git.PlainOpen(dir); e == nil {
 		rep = r
 	} else if r, e := git.PlainInit(dir, true); e != nil {
 		err = e
-	} else if e := os.Mkdir(path.Join(dir, "hooks"), os.ModePerm); e != nil {
-		err = e
-	} else if f, e := os.OpenFile(path.Join(dir, "hooks", "pre-receive"), os.O_WRONLY|os.O_CREATE, 0744); e != nil {
-		err = e
-	} else if _, e := f.WriteString(pre_receive_hook); e != nil {
-		err = e
-	} else if e := f.Close(); e != nil {
+	} else if e := installHook(dir, pre_receive_hook); e != nil {
 		err = e
 	} else {
 		rep = r
@@ -294,7 +670,7 @@ func (s *BillyStorer) gitStartUp(dir string) (rep *git.Repository, err error) {
 	var master *plumbing.Reference
 	if ref, e := rep.Reference(plumbing.Master, true); e == nil {
 		master = ref
-	} else if h, e := initCommit(rep); e != nil {
+	} else if h, e := initCommit(rep, s.signer); e != nil {
 		err = e
 	} else if ref := plumbing.NewHashReference(plumbing.Master, h); false {
 		//
@@ -309,36 +685,77 @@ func (s *BillyStorer) gitStartUp(dir string) (rep *git.Repository, err error) {
 		return
 	}
 
-	if commit_obj, e := rep.CommitObject(master.Hash()); e != nil {
+	unsharded, err = s.readCommit(rep, master.Hash())
+	return
+}
+
+// reads the tree of the commit at hash, the new head
+func (s *BillyStorer) readCommit(rep *git.Repository, hash plumbing.Hash) (unsharded bool, err error) {
+	if commit_obj, e := rep.CommitObject(hash); e != nil {
 		err = e
 	} else if tree, e := commit_obj.Tree(); e != nil {
 		err = e
-	} else if iter := tree.Files(); false {
+	} else if unsharded, err = s.readTree(tree); err != nil {
 		//
 	} else {
-		iter.ForEach(func(obj *object.File) error {
-			d, f := path.Split(obj.Name)
-			s.hashmap[path.Clean(d)][f] = obj.Hash
-			return nil
-		})
+		if entry, e := tree.FindEntry(quarantine_dir); e == nil {
+			s.quarantine = entry.Hash
+		}
+		s.head = hash
 	}
-
 	return
 }
 
-func initCommit(rep *git.Repository) (hash plumbing.Hash, err error) {
+// reads master again, after it was moved by something else, e.g. a push,
+// into a storer of its own, which shares the repository with s and
+// populates the maps of the new master; swap makes it the state of s, and
+// until then s is as it was; there must be nothing staged
+func (s *BillyStorer) Reload() (next Storer, swap func(), err error) {
+	if s.begun {
+		return nil, nil, fmt.Errorf("reload during a transaction")
+	}
+	ref, e := s.rep.Reference(plumbing.Master, true)
+	if e != nil {
+		return nil, nil, e
+	}
+	if fs, ok := s.rep.Storer.(*filesystem.Storage); ok {
+		// the objects may have come in a new pack
+		fs.Reindex()
+	}
+	n := *s
+	n.hashmap, n.trees, n.dirty, n.quarantine = make(map[string]map[string]plumbing.Hash), make(map[string]plumbing.Hash), make(map[string]bool), plumbing.ZeroHash
+	for _, dir := range tree_dirs {
+		if dir != "entry" {
+			n.hashmap[dir] = make(map[string]plumbing.Hash)
+		}
+	}
+	if _, e := n.readCommit(n.rep, ref.Hash()); e != nil {
+		return nil, nil, e
+	}
+	return &n, func() {
+		s.hashmap, s.trees, s.dirty, s.quarantine, s.head = n.hashmap, n.trees, n.dirty, n.quarantine, n.head
+		if s.mirror != nil {
+			s.mirror.kick()
+		}
+	}, nil
+}
+
+// the hash of the stored form of the object at name, {dir}/{uuid}
+func (s *BillyStorer) Hash(name string) (hash string, ok bool) {
+	dir, base := path.Split(name)
+	h, ok := s.hashmap[hashDir(path.Clean(dir), base)][base]
+	return h.String(), ok
+}
+
+func initCommit(rep *git.Repository, signer git.Signer) (hash plumbing.Hash, err error) {
 	if tree_obj := rep.Storer.NewEncodedObject(); false {
 		//
 	} else if tree_obj.SetType(plumbing.TreeObject); false {
 		//
 	} else if t, e := rep.Storer.SetEncodedObject(tree_obj); e != nil {
 		err = e
-	} else if commit_obj := rep.Storer.NewEncodedObject(); false {
-		//
-	} else if commit_obj.SetType(plumbing.CommitObject); false {
+	} else if w := bytes.NewBuffer(nil); false {
 		//
-	} else if w, e := commit_obj.Writer(); e != nil {
-		err = e
 	} else if timestring := fmt.Sprintf("%d %s", time.Now().Unix(), time.Now().Format("-0700")); false {
 		//
 	} else if _, e := fmt.Fprintf(w, "tree %s\n", t); e != nil {
@@ -347,17 +764,15 @@ func initCommit(rep *git.Repository) (hash plumbing.Hash, err error) {
 		err = e
 	} else if _, e := fmt.Fprintf(w, "committer atompub-git-bot <atompub-git-bot@localhost> %s\n\ninit commit\n", timestring); e != nil {
 		err = e
-	} else if e := w.Close(); e != nil {
-		err = e
 	} else {
-		return rep.Storer.SetEncodedObject(commit_obj)
+		return storeCommit(rep, signer, w.Bytes())
 	}
 	return
 }
 
 // store objects in the repository storer and populate hashmap
 func (s *BillyStorer) storeObjs() error {
-	for _, dir := range []string{"entry", "source"} {
+	for _, dir := range tree_dirs {
 		if entries, e := s.fsys.ReadDir(dir); e != nil {
 			return e
 		} else {
@@ -382,7 +797,7 @@ func (s *BillyStorer) storeObjs() error {
 				} else if h, e := s.rep.Storer.SetEncodedObject(obj); e != nil {
 					return e
 				} else {
-					s.hashmap[dir][entry.Name()] = h
+					s.setHash(dir, entry.Name(), h, false)
 				}
 			}
 		}
@@ -390,51 +805,96 @@ func (s *BillyStorer) storeObjs() error {
 	return nil
 }
 
-// returns the hash of the next tree
+// subtrees of the root tree, in git order
+var tree_dirs = []string{"entry", "source", "subscription", "workspace"}
+
+// returns the hash of the next tree, writing only the trees which
+// changed since the last one; the cost does not grow with the number of
+// objects, but with that of the entries in a shard
 func (s *BillyStorer) nextTree() (h plumbing.Hash, err error) {
-	if h_entry, e := treeHelper(s.rep.Storer, s.hashmap["entry"]); e != nil {
-		err = e
-	} else if h_source, e := treeHelper(s.rep.Storer, s.hashmap["source"]); e != nil {
-		err = e
-	} else if h_root, e := func() (h plumbing.Hash, err error) {
-		obj := s.rep.Storer.NewEncodedObject()
-		obj.SetType(plumbing.TreeObject)
-		w, e := obj.Writer()
-		if e != nil {
-			err = e
-			return
-		}
-		names := [2][]byte{[]byte("entry"), []byte("source")}
-		for k, v := range [2]plumbing.Hash{h_entry, h_source} {
-			if _, e := w.Write([]byte(filemode.Dir.String())); e != nil {
-				err = e
-			} else if _, e := w.Write([]byte{' '}); e != nil {
-				err = e
-			} else if _, e := w.Write(names[k]); e != nil {
-				err = e
-			} else if _, e := w.Write([]byte{0x00}); e != nil {
-				err = e
-			} else if _, e := w.Write(v[:]); e != nil {
-				err = e
+	_, ok := s.trees["entry"]
+	entries_changed := !ok
+	for key := range s.dirty {
+		if path.Dir(key) == "entry" {
+			entries_changed = true
+			if len(s.hashmap[key]) == 0 {
+				// git has no empty trees but the root
+				delete(s.trees, key)
+				delete(s.dirty, key)
+				continue
 			}
 		}
-		if err != nil {
-			//
-		} else if k, e := s.rep.Storer.SetEncodedObject(obj); e != nil {
-			err = e
-		} else {
-			h = k
+		if s.trees[key], err = treeHelper(s.rep.Storer, s.hashmap[key]); err != nil {
+			return
 		}
+		delete(s.dirty, key)
+	}
+	if !entries_changed {
+		//
+	} else if s.trees["entry"], err = s.entryTree(); err != nil {
 		return
-	}(); e != nil {
+	}
+
+	subtrees := make(map[string]plumbing.Hash, len(tree_dirs)+1)
+	for _, dir := range tree_dirs {
+		subtrees[dir] = s.trees[dir]
+	}
+	if !s.quarantine.IsZero() {
+		subtrees[quarantine_dir] = s.quarantine
+	}
+	return dirTreeHelper(s.rep.Storer, subtrees)
+}
+
+// writes a tree of subtrees
+func dirTreeHelper(storer storer.Storer, subtrees map[string]plumbing.Hash) (h plumbing.Hash, err error) {
+	names := make([]string, 0, len(subtrees))
+	for k := range subtrees {
+		names = append(names, k)
+	}
+	// git order, as none of the names is a prefix of another
+	sort.Strings(names)
+
+	obj := storer.NewEncodedObject()
+	obj.SetType(plumbing.TreeObject)
+	w, e := obj.Writer()
+	if e != nil {
+		err = e
+		return
+	}
+	for _, name := range names {
+		v := subtrees[name]
+		if _, e := w.Write(strconv.AppendUint(nil, uint64(filemode.Dir), 8)); e != nil {
+			err = e
+		} else if _, e := w.Write([]byte{' '}); e != nil {
+			err = e
+		} else if _, e := w.Write([]byte(name)); e != nil {
+			err = e
+		} else if _, e := w.Write([]byte{0x00}); e != nil {
+			err = e
+		} else if _, e := w.Write(v[:]); e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		//
+	} else if k, e := storer.SetEncodedObject(obj); e != nil {
 		err = e
 	} else {
-		h = h_root
+		h = k
 	}
 	return
 }
 
+// writes a tree of blobs
 func treeHelper(storer storer.Storer, hashmapchild map[string]plumbing.Hash) (h plumbing.Hash, err error) {
+	names := make([]string, 0, len(hashmapchild))
+	for k := range hashmapchild {
+		names = append(names, k)
+	}
+	// git order, which for blobs is that of the bytes of the names
+	sort.Strings(names)
+	// the modes are octal without leading zeros, as git writes them
+
 	obj := storer.NewEncodedObject()
 	obj.SetType(plumbing.TreeObject)
 	w, e := obj.Writer()
@@ -442,8 +902,9 @@ func treeHelper(storer storer.Storer, hashmapchild map[string]plumbing.Hash) (h
 		err = e
 		return
 	}
-	for k, v := range hashmapchild {
-		if _, e := w.Write([]byte(filemode.Regular.String())); e != nil {
+	for _, k := range names {
+		v := hashmapchild[k]
+		if _, e := w.Write(strconv.AppendUint(nil, uint64(filemode.Regular), 8)); e != nil {
 			err = e
 		} else if _, e := w.Write([]byte{' '}); e != nil {
 			err = e
@@ -466,33 +927,28 @@ func treeHelper(storer storer.Storer, hashmapchild map[string]plumbing.Hash) (h
 }
 
 func (s *BillyStorer) nextCommit(tree_hash plumbing.Hash, message string) (err error) {
-	obj := s.rep.Storer.NewEncodedObject()
-	obj.SetType(plumbing.CommitObject)
+	w := bytes.NewBuffer(nil)
 
-	if ref, e := s.rep.Reference(plumbing.Master, true); e != nil {
-		err = e
-	} else if parent_commit_obj, e := s.rep.CommitObject(ref.Hash()); e != nil {
-		err = e
-	} else if w, e := obj.Writer(); e != nil {
+	if parent_commit_obj, e := s.rep.CommitObject(s.head); e != nil {
 		err = e
 	} else if timestring := fmt.Sprintf("%d %s", time.Now().Unix(), time.Now().Format("-0700")); false {
 		//
 	} else if _, e := fmt.Fprintf(w, "tree %s\n", tree_hash.String()); e != nil {
 		err = e
-	} else if _, e := fmt.Fprintf(w, "parent %s\n", ref.Hash().String()); e != nil {
+	} else if _, e := fmt.Fprintf(w, "parent %s\n", s.head.String()); e != nil {
 		err = e
 	} else if _, e := fmt.Fprintf(w, "author %s %s\n", parent_commit_obj.Author.String(), timestring); e != nil {
 		err = e
 	} else if _, e := fmt.Fprintf(w, "committer %s %s\n\n%s\n", parent_commit_obj.Committer.String(), timestring, message); e != nil {
 		err = e
-	} else if e := w.Close(); e != nil {
-		err = e
-	} else if h, e := s.rep.Storer.SetEncodedObject(obj); e != nil {
+	} else if h, e := storeCommit(s.rep, s.signer, w.Bytes()); e != nil {
 		err = e
 	} else if ref := plumbing.NewHashReference(plumbing.Master, h); false {
 		//
-	} else if e := s.rep.Storer.SetReference(ref); e != nil {
-		err = e
+	} else if e := s.rep.Storer.CheckAndSetReference(ref, plumbing.NewHashReference(plumbing.Master, s.head)); e != nil {
+		err = fmt.Errorf("master moved since %s, e.g. by a push: %w", s.head, e)
+	} else {
+		s.head = h
 	}
 	return
 
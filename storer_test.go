@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/uuid"
+)
+
+// a storer with one entry, to be copied by newEntry
+func newTestStorer(tb testing.TB, gitdir string) (s *BillyStorer, template *Entry) {
+	s = NewBillyStorer(gitdir)
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	do := func(method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", content_type)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	res := do("POST", "/", "application/atom+xml;type=feed", `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`)
+	if res.StatusCode != http.StatusOK {
+		tb.Fatal(res.Status)
+	} else if res = do("POST", res.Header.Get("Location"), "text/plain", "a post"); res.StatusCode != http.StatusOK {
+		tb.Fatal(res.Status)
+	}
+	template = h.B.(*Backend).entrymap[res.Header.Get("Location")]
+	return
+}
+
+func newEntry(template *Entry) *Entry {
+	entry := *template
+	entry.Id.Target = "urn:uuid:" + uuid.NewString()
+	return &entry
+}
+
+func TestIncrementalTree(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s, template := newTestStorer(t, tmpdir)
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	// the tree of the head commit, and the tree written from scratch
+	trees := func() (head plumbing.Hash, full plumbing.Hash) {
+		h, _ := s.Head()
+		if c, e := s.rep.CommitObject(plumbing.NewHash(h)); e != nil {
+			t.Fatal(e)
+		} else {
+			head = c.TreeHash
+		}
+		subtrees, shards := make(map[string]plumbing.Hash), make(map[string]plumbing.Hash)
+		for key, hashes := range s.hashmap {
+			var e error
+			if path.Dir(key) != "entry" {
+				subtrees[key], e = treeHelper(s.rep.Storer, hashes)
+			} else if len(hashes) != 0 {
+				shards[path.Base(key)], e = treeHelper(s.rep.Storer, hashes)
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+		}
+		var e error
+		if subtrees["entry"], e = dirTreeHelper(s.rep.Storer, shards); e != nil {
+			t.Fatal(e)
+		} else if full, e = dirTreeHelper(s.rep.Storer, subtrees); e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+
+	var entries []*Entry
+	for i := range 64 {
+		entries = append(entries, newEntry(template))
+		if e := s.AddEntry(entries[i]); e != nil {
+			t.Fatal(e)
+		} else if i%8 != 7 {
+			//
+		} else if e := s.Commit("add"); e != nil {
+			t.Fatal(e)
+		} else if head, full := trees(); head != full {
+			t.Fatalf("tree %s after %d entries, not %s", head, i+1, full)
+		}
+	}
+
+	// deleted, and rolled back
+	if e := s.Begin(); e != nil {
+		t.Fatal(e)
+	}
+	for _, v := range entries[:32] {
+		if e := s.DeleteEntry(v); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := s.AddEntry(newEntry(template)); e != nil {
+		t.Fatal(e)
+	} else if e := s.Rollback(); e != nil {
+		t.Fatal(e)
+	} else if e := s.DeleteEntry(entries[0]); e != nil {
+		t.Fatal(e)
+	} else if e := s.Commit("delete"); e != nil {
+		t.Fatal(e)
+	} else if head, full := trees(); head != full {
+		t.Fatalf("tree %s after a rollback, not %s", head, full)
+	} else if name := strings.TrimPrefix(entries[1].Id.Target, "urn:uuid:"); s.hashmap[hashDir("entry", name)][name].IsZero() {
+		t.Fatal("deletion not rolled back")
+	}
+
+	// which git agrees with, if it is installed
+	if _, e := exec.LookPath("git"); e != nil {
+		t.Log("no git to check the repository with")
+	} else if out, e := exec.Command("git", "--git-dir", tmpdir, "fsck", "--strict", "--no-dangling").CombinedOutput(); e != nil {
+		t.Fatalf("git fsck: %v\n%s", e, out)
+	}
+}
+
+// a commit of one entry rewrites its shard of the 256 under entry/, so
+// ns/op is a constant, of the commit, the root tree and the journal, plus
+// a part linear in entries/shard, n/256, and not in n; 10000 entries
+// should take well under twice the time of 100,
+// e.g. go test -bench Commit -run XXX
+func BenchmarkCommit(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("%d entries", n), func(b *testing.B) {
+			var tmpdir = "/tmp/gitdir-bench"
+			s, template := newTestStorer(b, tmpdir)
+			defer os.RemoveAll(tmpdir)
+			for range n {
+				if e := s.AddEntry(newEntry(template)); e != nil {
+					b.Fatal(e)
+				}
+			}
+			if e := s.Commit("add"); e != nil {
+				b.Fatal(e)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				if e := s.AddEntry(newEntry(template)); e != nil {
+					b.Fatal(e)
+				} else if e := s.Commit("add"); e != nil {
+					b.Fatal(e)
+				}
+			}
+			b.ReportMetric(float64(n+b.N)/256, "entries/shard")
+		})
+	}
+}
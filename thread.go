@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Atom Threading Extensions, RFC 4685
+const thr_xmlns = `http://purl.org/syndication/thread/1.0`
+
+// resolves the ref of a thr:in-reply-to, or an /entry/ URL, to a known entry
+func (b *Backend) resolveInReplyTo(ref string) (parent_URL string, parent *Entry, err error) {
+	var u uuid.UUID
+	if strings.HasPrefix(ref, "urn:uuid:") {
+		u, err = uuid.Parse(strings.TrimPrefix(ref, "urn:uuid:"))
+	} else if path.Base(path.Dir(ref)) == "entry" {
+		u, err = uuid.Parse(path.Base(ref))
+	} else {
+		err = fmt.Errorf("in-reply-to must be a urn:uuid or an /entry/ URL")
+	}
+	if err != nil {
+		return
+	}
+	parent_URL = "/entry/" + u.String()
+	if v, ok := b.entrymap[parent_URL]; !ok {
+		err = fmt.Errorf("in-reply-to unknown entry %s", ref)
+	} else {
+		parent = v
+	}
+	return
+}
+
+// checks every thr:in-reply-to of entry which is not among existing
+// against the entrymap, filling in the href of each parent; the existing
+// ones are kept as they are, also if their parent is gone
+func (b *Backend) validateInReplyTo(entry *Entry, existing []InReplyTo) (err error) {
+	known := make(map[string]InReplyTo)
+	for _, v := range existing {
+		known[v.Ref] = v
+	}
+	for k, v := range entry.InReplyTo {
+		if v.Ref == "" {
+			return fmt.Errorf("in-reply-to is missing ref")
+		} else if old, ok := known[v.Ref]; ok {
+			entry.InReplyTo[k] = old
+		} else if parent_URL, parent, e := b.resolveInReplyTo(v.Ref); e != nil {
+			return e
+		} else if parent.Id.Target == entry.Id.Target {
+			return fmt.Errorf("entry cannot reply to itself")
+		} else {
+			entry.InReplyTo[k].Ref = parent.Id.Target
+			entry.InReplyTo[k].Href = parent_URL
+			if v.Type == "" {
+				entry.InReplyTo[k].Type = "application/atom+xml"
+			}
+		}
+	}
+	return
+}
+
+// returns the replies to parent found in the entrymap
+func (b *Backend) replies(parent *Entry) (entry_ptrs []*Entry) {
+	for _, v := range b.entrymap {
+		for _, irt := range v.InReplyTo {
+			if irt.Ref == parent.Id.Target {
+				entry_ptrs = append(entry_ptrs, v)
+				break
+			}
+		}
+	}
+	return
+}
+
+// recomputes the replies link of each parent referred to by refs,
+// and stages the changed parents and their sources with the storer
+func (b *Backend) refreshReplies(refs ...string) (err error) {
+	for _, ref := range refs {
+		parent_URL, parent, e := b.resolveInReplyTo(ref)
+		if e != nil {
+			// the parent is gone; nothing to maintain
+			continue
+		}
+		var count uint64
+		var updated time.Time
+		for _, v := range b.replies(parent) {
+			count++
+			if v.Updated.T.After(updated) {
+				updated = v.Updated.T
+			}
+		}
+
+		links := make([]Link, 0, len(parent.Links)+1)
+		for _, l := range parent.Links {
+			if l.Relation != "replies" {
+				links = append(links, l)
+			}
+		}
+		if count != 0 {
+			links = append(links, Link{
+				Href:          parent_URL + "/replies",
+				Relation:      "replies",
+				Type:          "application/atom+xml",
+				ThreadCount:   count,
+				ThreadUpdated: updated.Format(time.RFC3339Nano),
+			})
+		}
+		// the feed of the parent changes with it, also if the reply is
+		// in another one
+		b.touch(parent, parent.Source)
+		parent.Links = links
+
+		if e := b.storeEntry(parent); e != nil {
+			return e
+		} else if parent.Source == nil || parent.Source.Updated == nil {
+			//
+		} else if e := parent.Source.Updated.Set(time.Now().Round(time.Microsecond)); e != nil {
+			return e
+		} else if e := b.storer.AddSource(parent.Source); e != nil {
+			return e
+		}
+	}
+	return
+}
+
+func inReplyToRefs(entries ...*Entry) (refs []string) {
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		for _, v := range entry.InReplyTo {
+			refs = append(refs, v.Ref)
+		}
+	}
+	return
+}
+
+// the thread below the entry at path.Dir(r.URL.Path)
+func (b *Backend) GetReplies(r *http.Request) (feed *Feed, err *HTTPError) {
+	parent_URL := path.Dir(r.URL.Path)
+	parent, ok := b.entrymap[parent_URL]
+	if !ok {
+		err = &HTTPError{code: http.StatusNotFound}
+		return
+	}
+
+	entry_ptrs := b.replies(parent)
+	sortEntries(entry_ptrs)
+	if entry_ptrs, err = b.withContent(entry_ptrs); err != nil {
+		return
+	}
+
+	// replies may live in any collection, and every change
+	// to a collection bumps the updated time of its source
+	updated := parent.Updated.T
+	for _, v := range b.sourcemap {
+		if v != nil && v.Updated != nil && v.Updated.T.After(updated) {
+			updated = v.Updated.T
+		}
+	}
+
+	return &Feed{
+		Id: &URI{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "id"},
+			Target:  "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte(r.URL.Path)).String(),
+		},
+		Title: &TextConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
+			Text:    "Replies to " + parent.Title.Text,
+		},
+		Updated: &DateConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "updated"},
+			T:       updated,
+		},
+		Links: []Link{{
+			Href:     r.URL.Path,
+			Relation: "self",
+			Type:     "application/atom+xml",
+		}, {
+			Href:     parent_URL,
+			Relation: "related",
+			Type:     "application/atom+xml",
+		}},
+		Entries: entry_ptrs,
+	}, nil
+}
@@ -131,6 +131,15 @@ func (l *Link) Validate() (relation string, err error) {
 		relation = "alternate"
 	case "self", "related", "alternate", "enclosure", "via", "edit", "edit-media":
 		relation = l.Relation
+	case "first", "last", "next", "previous":
+		// RFC 5005 paging
+		relation = l.Relation
+	case "replies":
+		// RFC 4685 threading
+		relation = l.Relation
+	case "hub":
+		// WebSub discovery
+		relation = l.Relation
 	default:
 		err = fmt.Errorf("unknown link relation")
 	}
@@ -187,6 +196,12 @@ func (t *Entry) Validate(feed_id *URI) (has_author bool, err error) {
 				return
 			}
 		}
+		for _, irt := range t.InReplyTo {
+			if irt.Ref == "" {
+				err = fmt.Errorf("error: in-reply-to needs ref")
+				return
+			}
+		}
 	}
 	if feed_id == nil && !has_author {
 		err = fmt.Errorf("error: entry needs author")
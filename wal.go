@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// the staged changes of a BillyStorer are written ahead to a journal file
+// in the git directory, which is emptied by every Commit; whatever it still
+// holds at startup up to its last end marker was staged by operations
+// whose Commit had started, but not finished, and is committed then;
+// only those are recovered, and the operation after the last end marker,
+// which had not got as far as its Commit, is dropped, and its paths logged
+const wal_name = "atompub-wal"
+
+// a journal record is "+ {dir}/{name} {length}\n" followed by the staged
+// bytes, or "- {dir}/{name}\n" for a deletion; "[\n" marks the Begin of
+// an operation, and "]\n" its end, written by Commit before anything is
+// committed; the last record may be torn by a crash
+type wal struct {
+	f     *os.File
+	size  int64
+	begun int64 // size at Begin
+	buf   *bytes.Buffer
+}
+
+// appends a record, synced before it is staged in memory
+func (w *wal) Append(op byte, fpath string, data []byte) (err error) {
+	w.buf.Reset()
+	if op == '+' {
+		fmt.Fprintf(w.buf, "+ %s %d\n", fpath, len(data))
+		w.buf.Write(data)
+	} else if op == '-' {
+		fmt.Fprintf(w.buf, "- %s\n", fpath)
+	} else {
+		fmt.Fprintf(w.buf, "%c\n", op)
+	}
+	if n, e := w.f.Write(w.buf.Bytes()); e != nil {
+		// no half record is left behind
+		w.f.Truncate(w.size)
+		err = e
+	} else if e := w.f.Sync(); e != nil {
+		w.f.Truncate(w.size)
+		err = e
+	} else {
+		w.size += int64(n)
+	}
+	return
+}
+
+// marks the start of an operation
+func (w *wal) Begin() (err error) {
+	w.begun = w.size
+	return w.Append('[', "", nil)
+}
+
+// marks the end of an operation, and returns the size before the marker,
+// to truncate it away if the commit fails
+func (w *wal) End() (ended int64, err error) {
+	ended = w.size
+	return ended, w.Append(']', "", nil)
+}
+
+// drops what was appended from size on
+func (w *wal) TruncateTo(size int64) (err error) {
+	if e := w.f.Truncate(size); e != nil {
+		err = e
+	} else {
+		w.size = size
+		err = w.f.Sync()
+	}
+	return
+}
+
+// drops the records appended since Begin, its marker included
+func (w *wal) Rollback() (err error) {
+	return w.TruncateTo(w.begun)
+}
+
+func (w *wal) Truncate() (err error) {
+	w.begun = 0
+	return w.TruncateTo(0)
+}
+
+// the records appended so far
+func (w *wal) Staged() io.Reader {
+	return io.NewSectionReader(w.f, 0, w.size)
+}
+
+// stages the lines of buf at fpath, journaled first
+func (s *BillyStorer) stage(fpath string) (err error) {
+	s.lines.Reset()
+	if e := writeLines(s.lines, s.buf); e != nil {
+		err = e
+	} else if e := s.wal.Append('+', fpath, s.lines.Bytes()); e != nil {
+		err = e
+	} else if f, e := s.fsys.Create(fpath); e != nil {
+		err = e
+	} else if _, e := f.Write(s.lines.Bytes()); e != nil {
+		err = e
+	} else {
+		err = f.Close()
+	}
+	return
+}
+
+func (s *BillyStorer) unstage(dir string, name string) (err error) {
+	if e := s.wal.Append('-', path.Join(dir, name), nil); e != nil {
+		err = e
+	} else {
+		s.setHash(dir, name, plumbing.ZeroHash, true)
+	}
+	return
+}
+
+// a record read back from the journal
+type walRecord struct {
+	op    byte
+	fpath string
+	data  []byte
+}
+
+// applies the records of r to the staging area, and returns how many
+// there were; if complete, only those up to the last end marker, else
+// every record before a torn one
+func (s *BillyStorer) replay(r io.Reader, complete bool) (n int, err error) {
+	records, e := readRecords(r)
+	if e != nil {
+		return 0, e
+	}
+	if complete {
+		last := 0
+		for k, v := range records {
+			if v.op == ']' {
+				last = k + 1
+			}
+		}
+		for _, v := range records[last:] {
+			if v.op == '+' || v.op == '-' {
+				log.Printf("%s: dropping %c %s of an operation which did not reach its commit", wal_name, v.op, v.fpath)
+			}
+		}
+		records = records[:last]
+	}
+	for _, v := range records {
+		switch v.op {
+		case '+':
+			if f, e := s.fsys.Create(v.fpath); e != nil {
+				return n, e
+			} else if _, e := f.Write(v.data); e != nil {
+				return n, e
+			} else if e := f.Close(); e != nil {
+				return n, e
+			}
+		case '-':
+			dir, name := path.Split(v.fpath)
+			s.setHash(path.Clean(dir), name, plumbing.ZeroHash, true)
+		default:
+			continue
+		}
+		n++
+	}
+	return
+}
+
+// the records of r, up to a torn one
+func readRecords(r io.Reader) (records []walRecord, err error) {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, e := br.ReadString('\n')
+		if errors.Is(e, io.EOF) {
+			return
+		} else if e != nil {
+			return nil, e
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && (fields[0] == "[" || fields[0] == "]"):
+			records = append(records, walRecord{op: fields[0][0]})
+		case len(fields) < 2 || !isTreeDir(path.Dir(fields[1])):
+			return nil, fmt.Errorf("%s: malformed record %d", wal_name, n)
+		case fields[0] == "+" && len(fields) == 3:
+			length, e := strconv.Atoi(fields[2])
+			if e != nil || length < 0 {
+				return nil, fmt.Errorf("%s: malformed record %d", wal_name, n)
+			}
+			data := make([]byte, length)
+			if _, e := io.ReadFull(br, data); errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) {
+				// torn
+				return
+			} else if e != nil {
+				return nil, e
+			}
+			records = append(records, walRecord{op: '+', fpath: fields[1], data: data})
+		case fields[0] == "-" && len(fields) == 2:
+			records = append(records, walRecord{op: '-', fpath: fields[1]})
+		default:
+			return nil, fmt.Errorf("%s: malformed record %d", wal_name, n)
+		}
+	}
+}
+
+// opens the journal, and commits what the complete operations of a crash
+// left in it
+func (s *BillyStorer) recover(wal_path string) (err error) {
+	if f, e := os.OpenFile(wal_path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); e != nil {
+		err = e
+	} else if fi, e := f.Stat(); e != nil {
+		err = e
+	} else if s.wal = (&wal{f: f, size: fi.Size(), buf: bytes.NewBuffer(nil)}); false {
+		//
+	} else if s.wal.size == 0 {
+		//
+	} else if n, e := s.replay(s.wal.Staged(), true); e != nil {
+		err = e
+	} else if n == 0 {
+		err = s.wal.Truncate()
+	} else {
+		err = s.Commit(fmt.Sprintf("recover %d uncommitted changes", n))
+	}
+	return
+}
+
+func isTreeDir(dir string) bool {
+	for _, v := range tree_dirs {
+		if v == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestBillyStorerRecovery(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	s := NewBillyStorer(tmpdir)
+	h := &Handler{
+		B:     NewBackend(s),
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	do := func(method string, target string, content_type string, body string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := do("POST", "/", "application/atom+xml;type=feed", feed_to_post_to_root)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	var entry_URLs []string
+	for _, text := range []string{"first post", "second post"} {
+		res := do("POST", feed_URL, "text/plain", text)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(res.Status)
+		}
+		entry_URLs = append(entry_URLs, res.Header.Get("Location"))
+	}
+
+	// an operation which ended, and crashed in its commit, then one which
+	// crashed before its end, in the middle of a record
+	b := h.B.(*Backend)
+	changed := *b.entrymap[entry_URLs[0]]
+	changed.Title.Text = "changed before the crash"
+	unfinished := *b.entrymap[entry_URLs[1]]
+	unfinished.Title.Text = "changed by an unfinished operation"
+	if e := s.Begin(); e != nil {
+		t.Fatal(e)
+	} else if e := s.AddEntry(&changed); e != nil {
+		t.Fatal(e)
+	} else if e := s.DeleteEntry(b.entrymap[entry_URLs[1]]); e != nil {
+		t.Fatal(e)
+	} else if _, e := s.wal.End(); e != nil {
+		t.Fatal(e)
+	} else if e := s.Begin(); e != nil {
+		t.Fatal(e)
+	} else if e := s.AddEntry(&unfinished); e != nil {
+		t.Fatal(e)
+	} else if f, e := os.OpenFile(path.Join(tmpdir, wal_name), os.O_WRONLY|os.O_APPEND, 0644); e != nil {
+		t.Fatal(e)
+	} else if _, e := f.WriteString("+ entry/torn 4096\n<?xml"); e != nil {
+		t.Fatal(e)
+	} else if e := f.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	logged := bytes.NewBuffer(nil)
+	log.SetOutput(logged)
+	s = NewBillyStorer(tmpdir)
+	log.SetOutput(os.Stderr)
+	b = NewBackend(s)
+	if !strings.Contains(logged.String(), "dropping + entry/"+path.Base(entry_URLs[1])) {
+		t.Fatalf("dropped change not logged: %s", logged)
+	} else if entry, ok := b.entrymap[entry_URLs[0]]; !ok {
+		t.Fatal("entry lost")
+	} else if entry.Title.Text != "changed before the crash" {
+		t.Fatalf("staged change not recovered: %s", entry.Title.Text)
+	} else if _, ok := b.entrymap[entry_URLs[1]]; ok {
+		t.Fatal("staged deletion not recovered, or unfinished operation replayed")
+	} else if fi, e := os.Stat(path.Join(tmpdir, wal_name)); e != nil {
+		t.Fatal(e)
+	} else if fi.Size() != 0 {
+		t.Fatalf("journal not emptied: %d bytes", fi.Size())
+	} else if ref, e := s.rep.Reference(plumbing.Master, true); e != nil {
+		t.Fatal(e)
+	} else if commit_obj, e := s.rep.CommitObject(ref.Hash()); e != nil {
+		t.Fatal(e)
+	} else if strings.TrimSpace(commit_obj.Message) != "recover 2 uncommitted changes" {
+		t.Fatalf("unexpected commit %q", commit_obj.Message)
+	}
+}
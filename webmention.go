@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// title of the links to received mentions, which are maintained by the server
+const webmention_link_title = "webmention"
+
+const (
+	max_webmention_attempts = 5
+	max_webmention_body     = 1 << 20
+)
+
+// a Webmention waiting to be sent
+type mentionJob struct {
+	source  string
+	target  string
+	attempt int
+}
+
+// sends Webmentions for the links in committed entries, and receives
+// Webmentions of our entries from other sites
+type Webmention struct {
+	b           *Backend
+	base_URL    string      // public URL of the server, without trailing slash
+	mutex       sync.Locker // the lock of the Handler
+	client      *http.Client
+	queue       chan *mentionJob
+	pending     sync.WaitGroup
+	retry_delay time.Duration // doubles with every attempt
+}
+
+// creates the endpoint at base_URL/webmention, registers it with b
+// and starts the worker sending the outgoing mentions;
+// mutex must be the one held by the Handler serving b
+func NewWebmention(b *Backend, base_URL string, mutex sync.Locker) *Webmention {
+	wm := &Webmention{
+		b:           b,
+		base_URL:    strings.TrimSuffix(base_URL, "/"),
+		mutex:       mutex,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		queue:       make(chan *mentionJob, 256),
+		retry_delay: time.Minute,
+	}
+	b.Observe(wm)
+	go wm.work()
+	return wm
+}
+
+func (wm *Webmention) URL() string {
+	return wm.base_URL + "/webmention"
+}
+
+func isWebmentionLink(l Link) bool {
+	return l.Relation == "related" && l.Title == webmention_link_title
+}
+
+// queues a mention of every link in the content of the changed entry
+func (wm *Webmention) Notify(b *Backend, c *Change) {
+	if c.Entry == nil || c.EntryURL == "" || c.Mention {
+		return
+	}
+	source := wm.base_URL + c.EntryURL
+	for _, target := range outboundLinks(c.Entry.Content.Body) {
+		if strings.HasPrefix(target, wm.base_URL+"/") {
+			// no need to tell ourselves
+			continue
+		}
+		wm.enqueue(&mentionJob{source: source, target: target})
+	}
+}
+
+func (wm *Webmention) enqueue(job *mentionJob) {
+	if job.attempt == 0 {
+		wm.pending.Add(1)
+	}
+	select {
+	case wm.queue <- job:
+	default:
+		// never block the caller, which may hold the lock
+		go func() { wm.queue <- job }()
+	}
+}
+
+func (wm *Webmention) work() {
+	for job := range wm.queue {
+		err := wm.send(job.source, job.target)
+		var retry *retryableError
+		if err == nil {
+			wm.pending.Done()
+		} else if errors.As(err, &retry) && job.attempt+1 < max_webmention_attempts {
+			delay := wm.retry_delay << job.attempt
+			job.attempt++
+			time.AfterFunc(delay, func() { wm.enqueue(job) })
+		} else {
+			log.Printf("webmention: %s -> %s: %s", job.source, job.target, err)
+			wm.pending.Done()
+		}
+	}
+}
+
+// errors worth another attempt later on
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func retryableStatus(res *http.Response) error {
+	err := fmt.Errorf("%s responded %s", res.Request.URL, res.Status)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return &retryableError{err}
+	}
+	return err
+}
+
+func (wm *Webmention) send(source string, target string) (err error) {
+	endpoint, err := wm.discover(target)
+	if err != nil {
+		return
+	} else if endpoint == "" {
+		// the target does not accept mentions
+		return nil
+	}
+
+	v := url.Values{}
+	v.Set("source", source)
+	v.Set("target", target)
+	res, e := wm.client.PostForm(endpoint, v)
+	if e != nil {
+		return &retryableError{e}
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, max_webmention_body))
+	if res.StatusCode/100 != 2 {
+		err = retryableStatus(res)
+	}
+	return
+}
+
+// Webmention 3.1.2, returns the endpoint of target, or "" if there is none
+func (wm *Webmention) discover(target string) (endpoint string, err error) {
+	res, e := wm.client.Get(target)
+	if e != nil {
+		return "", &retryableError{e}
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return "", retryableStatus(res)
+	}
+
+	base := res.Request.URL
+	for _, h := range res.Header.Values("Link") {
+		for _, link := range strings.Split(h, ",") {
+			href, params, found := strings.Cut(link, ";")
+			href = strings.TrimSpace(href)
+			if !found || !strings.HasPrefix(href, "<") || !strings.HasSuffix(href, ">") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if k == "rel" && hasRel(strings.Trim(v, `"`), "webmention") {
+					return resolveReference(base, href[1:len(href)-1])
+				}
+			}
+		}
+	}
+
+	if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt != "text/html" && mt != "application/xhtml+xml" {
+		return "", nil
+	}
+	body, e := io.ReadAll(io.LimitReader(res.Body, max_webmention_body))
+	if e != nil {
+		return "", &retryableError{e}
+	}
+	for _, l := range htmlLinks(body) {
+		if (l.name == "link" || l.name == "a") && hasRel(l.rel, "webmention") {
+			return resolveReference(base, l.href)
+		}
+	}
+	return "", nil
+}
+
+func hasRel(rels string, rel string) bool {
+	for _, v := range strings.Fields(rels) {
+		if strings.EqualFold(v, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveReference(base *url.URL, href string) (string, error) {
+	if u, e := base.Parse(href); e != nil {
+		return "", e
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("endpoint must be an http(s) URL")
+	} else {
+		return u.String(), nil
+	}
+}
+
+type htmlLink struct {
+	name string
+	rel  string
+	href string
+}
+
+// the elements with an href in a tolerantly parsed HTML document
+func htmlLinks(body []byte) (links []htmlLink) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	for {
+		t, e := dec.Token()
+		if e != nil {
+			// io.EOF, or HTML beyond repair
+			return
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		l := htmlLink{name: strings.ToLower(se.Name.Local)}
+		found := false
+		for _, a := range se.Attr {
+			switch strings.ToLower(a.Name.Local) {
+			case "href":
+				l.href, found = a.Value, true
+			case "rel":
+				l.rel = a.Value
+			}
+		}
+		if found {
+			links = append(links, l)
+		}
+	}
+}
+
+// the absolute http(s) links in xhtml content, in order of appearance
+func outboundLinks(content []byte) (targets []string) {
+	seen := make(map[string]bool)
+	for _, l := range htmlLinks(content) {
+		if l.name != "a" || seen[l.href] {
+			continue
+		} else if u, e := url.Parse(l.href); e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			continue
+		}
+		seen[l.href] = true
+		targets = append(targets, l.href)
+	}
+	return
+}
+
+// handles an incoming Webmention; the caller holds the lock
+func (wm *Webmention) serve(w http.ResponseWriter, r *http.Request) (err error) {
+	if e := r.ParseForm(); e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	}
+	source, target := r.PostForm.Get("source"), r.PostForm.Get("target")
+	if u, e := url.Parse(source); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return &HTTPError{code: http.StatusBadRequest, message: "source must be an http(s) URL"}
+	} else if source == target {
+		return &HTTPError{code: http.StatusBadRequest, message: "source and target must differ"}
+	} else if entry_URL, e := wm.entryOf(target); e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	} else {
+		// the source is verified after the response
+		wm.pending.Add(1)
+		go func() {
+			defer wm.pending.Done()
+			if e := wm.verify(source, target, entry_URL); e != nil {
+				log.Printf("webmention: from %s: %s", source, e)
+			}
+		}()
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// returns the entry URL of target, if it is one of our entries
+func (wm *Webmention) entryOf(target string) (entry_URL string, err error) {
+	if u, e := url.Parse(target); e != nil {
+		err = fmt.Errorf("cannot parse target")
+	} else if !strings.HasPrefix(target, wm.base_URL+"/") {
+		err = fmt.Errorf("target is not served by this host")
+	} else if path.Dir(u.Path) != "/entry" {
+		err = fmt.Errorf("target is not an entry")
+	} else if id, e := uuid.Parse(path.Base(u.Path)); e != nil {
+		err = fmt.Errorf("target is not an entry")
+	} else if entry_URL = "/entry/" + id.String(); false {
+		//
+	} else if _, ok := wm.b.entrymap[entry_URL]; !ok {
+		err = fmt.Errorf("target not found")
+	}
+	return
+}
+
+// Webmention 3.2.2, checks that source links to target, and
+// adds or removes the mention on the entry at entry_URL
+func (wm *Webmention) verify(source string, target string, entry_URL string) (err error) {
+	res, e := wm.client.Get(source)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+
+	mentions := false
+	if res.StatusCode == http.StatusGone {
+		// a deleted source removes the mention
+	} else if res.StatusCode/100 != 2 {
+		return fmt.Errorf("source responded %s", res.Status)
+	} else if body, e := io.ReadAll(io.LimitReader(res.Body, max_webmention_body)); e != nil {
+		return e
+	} else if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt == "text/html" || mt == "application/xhtml+xml" {
+		for _, l := range htmlLinks(body) {
+			if l.href == target {
+				mentions = true
+				break
+			}
+		}
+	} else {
+		mentions = bytes.Contains(body, []byte(target))
+	}
+
+	wm.mutex.Lock()
+	defer wm.mutex.Unlock()
+
+	entry, ok := wm.b.entrymap[entry_URL]
+	if !ok {
+		return fmt.Errorf("target %s is gone", target)
+	} else if e := wm.b.degradedEntry(entry); e != nil {
+		return e
+	}
+	links := make([]Link, 0, len(entry.Links)+1)
+	known := false
+	for _, l := range entry.Links {
+		if isWebmentionLink(l) && l.Href == source {
+			known = true
+			if !mentions {
+				continue
+			}
+		}
+		links = append(links, l)
+	}
+	if known == mentions {
+		// nothing changed, except perhaps the content of the source
+		return nil
+	} else if mentions {
+		links = append(links, Link{
+			Href:     source,
+			Relation: "related",
+			Title:    webmention_link_title,
+		})
+	}
+	if e := wm.store(source, entry_URL, entry, links); e != nil {
+		return e
+	}
+	return nil
+}
+
+// sets the links of the mentioned entry, as one operation
+func (wm *Webmention) store(source string, entry_URL string, entry *Entry, links []Link) (err *HTTPError) {
+	if e := wm.b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = wm.b.finish(err) }()
+
+	// mentions change the entry, and so the feed, but not the updated time
+	// of the entry; only the source is bumped, as with any other change
+	wm.b.touch(entry, entry.Source)
+	entry.Links = links
+	if e := entry.Source.Updated.Set(time.Now().Round(time.Microsecond)); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := wm.b.storeEntry(entry); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := wm.b.storer.AddSource(entry.Source); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if e := wm.b.commit(fmt.Sprintf("webmention %s", source)); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else if loaded, e := wm.b.full(entry); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	} else {
+		wm.b.index.Add(entry_URL, loaded)
+	}
+	// the feed changed, but there is nothing new to mention or deliver
+	if c := wm.b.entryChange(change_updated, entry_URL, entry); c != nil {
+		c.Mention = true
+		wm.b.notify(c)
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebmention(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	b := NewBackend(NewBillyStorer(tmpdir))
+	h := &Handler{
+		B:     b,
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	h.Webmention = NewWebmention(b, "https://example.org", h.mutex)
+	h.Webmention.retry_delay = 10 * time.Millisecond
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	// a stand-in for another site, whose endpoint fails once
+	var mentioned atomic.Value
+	mentioned.Store("")
+	var gone atomic.Bool
+	var failures atomic.Int32
+	received := make(chan url.Values, 4)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/article":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<!DOCTYPE html><html><head><link rel="webmention" href="/endpoint"><title>An article</title></head><body><p>Hello<br></p></body></html>`)
+		case "/reply":
+			if gone.Load() {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<html><body><p>Nice post &mdash; <a class="u-in-reply-to" href="%s">indeed</a></p></body></html>`, mentioned.Load())
+		case "/endpoint":
+			if failures.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			r.ParseForm()
+			received <- r.PostForm
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer remote.Close()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+
+	// outgoing, with a retry
+	req = httptest.NewRequest("POST", feed_URL, bytes.NewBufferString("Responding to "+remote.URL+"/article ."))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res = w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	entry_URL := res.Header.Get("Location")
+	if v := <-received; v.Get("source") != "https://example.org"+entry_URL || v.Get("target") != remote.URL+"/article" {
+		t.Fatalf("unexpected webmention %v", v)
+	}
+	h.Webmention.pending.Wait()
+
+	// incoming
+	target := "https://example.org" + entry_URL
+	mentioned.Store(target)
+	mention := func(source string, target string) int {
+		v := url.Values{}
+		v.Set("source", source)
+		v.Set("target", target)
+		req := httptest.NewRequest("POST", "/webmention", strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		h.Webmention.pending.Wait()
+		return w.Result().StatusCode
+	}
+	mentions := func() (hrefs []string) {
+		req := httptest.NewRequest("GET", entry_URL, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		if res.Header.Get("Link") != `<https://example.org/webmention>; rel="webmention"` {
+			t.Fatalf("endpoint not advertised")
+		}
+		entry := &Entry{}
+		if e := xml.NewDecoder(res.Body).Decode(entry); e != nil {
+			t.Fatal(e)
+		}
+		for _, l := range entry.Links {
+			if isWebmentionLink(l) {
+				hrefs = append(hrefs, l.Href)
+			}
+		}
+		return
+	}
+
+	if code := mention(remote.URL+"/reply", "https://example.org/entry/unknown"); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", code)
+	} else if code := mention(remote.URL+"/reply", "https://elsewhere.example/"); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", code)
+	} else if code := mention(remote.URL+"/article", target); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if hrefs := mentions(); len(hrefs) != 0 {
+		t.Fatalf("unverified mention stored %v", hrefs)
+	} else if code := mention(remote.URL+"/reply", target); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if hrefs := mentions(); len(hrefs) != 1 || hrefs[0] != remote.URL+"/reply" {
+		t.Fatalf("unexpected mentions %v", hrefs)
+	}
+	// which is no reason to mention the article again
+	if len(received) != 0 {
+		t.Fatalf("mentioned again %v", <-received)
+	}
+
+	// a deleted source removes the mention
+	gone.Store(true)
+	if code := mention(remote.URL+"/reply", target); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	} else if hrefs := mentions(); len(hrefs) != 0 {
+		t.Fatalf("unexpected mentions %v", hrefs)
+	}
+}
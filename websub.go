@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const websub_xmlns = `urn:atompub-server:websub`
+
+const (
+	default_lease = 10 * 24 * time.Hour
+	min_lease     = time.Hour
+	max_lease     = 30 * 24 * time.Hour
+
+	// WebSub 5.1, the secret must be less than 200 bytes
+	max_secret_length = 199
+)
+
+// a verified subscription of callback to the feed at topic
+//
+// ActivityPub followers are kept alike, with the actor of the collection
+// as topic, the inbox of the follower as callback, and no expiry
+type Subscription struct {
+	XMLName  xml.Name  `xml:"urn:atompub-server:websub subscription"`
+	Topic    string    `xml:"urn:atompub-server:websub topic"`
+	Callback string    `xml:"urn:atompub-server:websub callback"`
+	Secret   string    `xml:"urn:atompub-server:websub secret"`
+	Expires  time.Time `xml:"urn:atompub-server:websub expires"`
+	Follower string    `xml:"urn:atompub-server:websub follower"`
+}
+
+// true if the subscription has run out; followers never do
+func (sub *Subscription) Expired(now time.Time) bool {
+	return !sub.Expires.IsZero() && sub.Expires.Before(now)
+}
+
+// name of the subscription in the subscriptionmap and the repository
+func (sub *Subscription) Key() string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(sub.Topic+" "+sub.Callback)).String()
+}
+
+func (sub *Subscription) MarshalTo(bw *bufio.Writer) (err error) {
+	if _, err = fmt.Fprintf(bw, "<subscription xmlns=\"%s\">", websub_xmlns); err != nil {
+		return
+	}
+	expires := ""
+	if !sub.Expires.IsZero() {
+		expires = sub.Expires.UTC().Format(time.RFC3339)
+	}
+	for _, v := range [][2]string{
+		{"topic", sub.Topic},
+		{"callback", sub.Callback},
+		{"secret", sub.Secret},
+		{"expires", expires},
+		{"follower", sub.Follower},
+	} {
+		if v[1] == "" {
+			continue
+		} else if _, err = fmt.Fprintf(bw, "<%s>", v[0]); err != nil {
+			return
+		} else if err = xml.EscapeText(bw, []byte(v[1])); err != nil {
+			return
+		} else if _, err = fmt.Fprintf(bw, "</%s>", v[0]); err != nil {
+			return
+		}
+	}
+	_, err = bw.WriteString("</subscription>")
+	return
+}
+
+// an embedded WebSub hub for the collection feeds
+//
+// subscription requests are verified asynchronously, and content is
+// distributed to the subscribers as fat pings of the whole feed
+type Hub struct {
+	b        *Backend
+	base_URL string      // public URL of the server, without trailing slash
+	mutex    sync.Locker // the lock of the Handler
+	client   *http.Client
+	pending  sync.WaitGroup
+}
+
+// creates the hub at base_URL/hub and registers it with b;
+// mutex must be the one held by the Handler serving b
+func NewHub(b *Backend, base_URL string, mutex sync.Locker) *Hub {
+	hub := &Hub{
+		b:        b,
+		base_URL: strings.TrimSuffix(base_URL, "/"),
+		mutex:    mutex,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	b.hub = hub
+	b.Observe(hub)
+	return hub
+}
+
+func (hub *Hub) URL() string {
+	return hub.base_URL + "/hub"
+}
+
+// the topic URL of the feed at feed_URL
+func (hub *Hub) Topic(feed_URL string) string {
+	return hub.base_URL + feed_URL
+}
+
+// replaces the self link of a feed by its topic URL, and adds the hub link
+func (hub *Hub) Links(feed_URL string, links []Link) []Link {
+	l := make([]Link, 0, len(links)+2)
+	for _, v := range links {
+		if v.Relation != "self" && v.Relation != "hub" {
+			l = append(l, v)
+		}
+	}
+	return append(l, Link{
+		Href:     hub.URL(),
+		Relation: "hub",
+	}, Link{
+		Href:     hub.Topic(feed_URL),
+		Relation: "self",
+		Type:     "application/atom+xml",
+	})
+}
+
+// returns the feed URL of the topic, if it is a collection feed
+func (hub *Hub) feedOf(topic string) (feed_URL string, err error) {
+	if u, e := url.Parse(topic); e != nil {
+		err = fmt.Errorf("cannot parse hub.topic")
+	} else if !strings.HasPrefix(topic, hub.base_URL+"/") && u.IsAbs() {
+		err = fmt.Errorf("hub.topic is not served by this hub")
+	} else if path.Dir(u.Path) != "/feed" {
+		err = fmt.Errorf("hub.topic is not a collection feed")
+	} else if _, ok := hub.b.sourcemap[u.Path]; !ok {
+		err = fmt.Errorf("hub.topic not found")
+	} else {
+		feed_URL = u.Path
+	}
+	return
+}
+
+// handles a subscription request; the caller holds the lock
+func (hub *Hub) serve(w http.ResponseWriter, r *http.Request) (err error) {
+	if e := r.ParseForm(); e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	}
+
+	mode := r.PostForm.Get("hub.mode")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		return &HTTPError{code: http.StatusBadRequest, message: "hub.mode must be subscribe or unsubscribe"}
+	}
+
+	sub := &Subscription{
+		Callback: r.PostForm.Get("hub.callback"),
+		Secret:   r.PostForm.Get("hub.secret"),
+	}
+	if feed_URL, e := hub.feedOf(r.PostForm.Get("hub.topic")); e != nil {
+		return &HTTPError{code: http.StatusBadRequest, message: e.Error()}
+	} else {
+		// subscriptions are kept by canonical topic
+		sub.Topic = hub.Topic(feed_URL)
+	}
+	if u, e := url.Parse(sub.Callback); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return &HTTPError{code: http.StatusBadRequest, message: "hub.callback must be an http(s) URL"}
+	} else if len(sub.Secret) > max_secret_length {
+		return &HTTPError{code: http.StatusBadRequest, message: "hub.secret is too long"}
+	}
+
+	lease := default_lease
+	if v := r.PostForm.Get("hub.lease_seconds"); v == "" {
+		//
+	} else if n, e := strconv.Atoi(v); e != nil || n < 1 {
+		return &HTTPError{code: http.StatusBadRequest, message: "hub.lease_seconds must be a positive integer"}
+	} else if lease = time.Duration(n) * time.Second; lease < min_lease {
+		lease = min_lease
+	} else if lease > max_lease {
+		lease = max_lease
+	}
+
+	// verification of intent happens after the response
+	hub.pending.Add(1)
+	go func() {
+		defer hub.pending.Done()
+		if e := hub.verify(mode, sub, lease); e != nil {
+			log.Printf("websub: %s %s for %s: %s", mode, sub.Callback, sub.Topic, e)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// verifies the intent of the subscriber, then stores the change
+func (hub *Hub) verify(mode string, sub *Subscription, lease time.Duration) (err error) {
+	challenge := make([]byte, 16)
+	if _, e := rand.Read(challenge); e != nil {
+		return e
+	}
+
+	v := url.Values{}
+	v.Set("hub.mode", mode)
+	v.Set("hub.topic", sub.Topic)
+	v.Set("hub.challenge", hex.EncodeToString(challenge))
+	if mode == "subscribe" {
+		v.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	callback := sub.Callback
+	if strings.Contains(callback, "?") {
+		callback += "&" + v.Encode()
+	} else {
+		callback += "?" + v.Encode()
+	}
+
+	res, e := hub.client.Get(callback)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	if body, e := io.ReadAll(io.LimitReader(res.Body, 1024)); e != nil {
+		return e
+	} else if res.StatusCode/100 != 2 {
+		return fmt.Errorf("verification failed with %s", res.Status)
+	} else if string(body) != v.Get("hub.challenge") {
+		return fmt.Errorf("verification failed, challenge not echoed")
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if e := hub.store(mode, sub, lease); e != nil {
+		return e
+	}
+	return nil
+}
+
+// stores the verified change, pruning the expired subscriptions along the
+// way, as one operation
+func (hub *Hub) store(mode string, sub *Subscription, lease time.Duration) (err *HTTPError) {
+	if e := hub.b.begin(); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	defer func() { err = hub.b.finish(err) }()
+
+	now := time.Now()
+	for k, v := range hub.b.subscriptionmap {
+		if !v.Expired(now) {
+			//
+		} else if e := hub.b.deleteSubscription(k); e != nil {
+			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		}
+	}
+	if mode == "subscribe" {
+		sub.Expires = now.Add(lease).Round(time.Second)
+		if e := hub.b.addSubscription(sub); e != nil {
+			return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+		}
+	} else if e := hub.b.deleteSubscription(sub.Key()); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	if e := hub.b.commit(fmt.Sprintf("websub %s %s", mode, sub.Callback)); e != nil {
+		return &HTTPError{code: http.StatusInternalServerError, message: e.Error()}
+	}
+	return nil
+}
+
+// stages sub and puts it into the subscriptionmap
+func (b *Backend) addSubscription(sub *Subscription) (err error) {
+	if e := b.storer.AddSubscription(sub); e != nil {
+		return e
+	}
+	b.touchSubscription(sub.Key())
+	b.subscriptionmap[sub.Key()] = sub
+	return
+}
+
+// stages the deletion of the subscription at key, if there is one
+func (b *Backend) deleteSubscription(key string) (err error) {
+	if sub, ok := b.subscriptionmap[key]; !ok {
+		//
+	} else if e := b.storer.DeleteSubscription(sub); e != nil {
+		err = e
+	} else {
+		b.touchSubscription(key)
+		delete(b.subscriptionmap, key)
+	}
+	return
+}
+
+// distributes the feed of every changed collection to its subscribers
+func (hub *Hub) Notify(b *Backend, c *Change) {
+	if c.Type == change_created && c.EntryURL == "" {
+		// a new collection has no subscribers yet
+		return
+	} else if _, ok := b.sourcemap[c.FeedURL]; !ok {
+		// a deleted collection; its subscriptions expire with their lease
+		return
+	}
+
+	topic := hub.Topic(c.FeedURL)
+	now := time.Now()
+	subs := make([]*Subscription, 0, 8)
+	for _, v := range b.subscriptionmap {
+		if v.Topic == topic && !v.Expired(now) {
+			subs = append(subs, v)
+		}
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	r, e := http.NewRequest("GET", c.FeedURL, nil)
+	if e != nil {
+		log.Printf("websub: %s", e)
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	bw := bufio.NewWriter(buf)
+	if feed, e := b.GetFeed(r); e != nil {
+		log.Printf("websub: %s", e)
+		return
+	} else if _, e := buf.WriteString(xml.Header); e != nil {
+		log.Printf("websub: %s", e)
+		return
+	} else if e := feed.MarshalTo(bw); e != nil {
+		log.Printf("websub: %s", e)
+		return
+	} else if e := bw.Flush(); e != nil {
+		log.Printf("websub: %s", e)
+		return
+	}
+
+	body := buf.Bytes()
+	for _, sub := range subs {
+		hub.pending.Add(1)
+		go func(callback string, secret string) {
+			defer hub.pending.Done()
+			if e := hub.deliver(topic, callback, secret, body); e != nil {
+				log.Printf("websub: delivery to %s: %s", callback, e)
+			}
+		}(sub.Callback, sub.Secret)
+	}
+}
+
+func (hub *Hub) deliver(topic string, callback string, secret string, body []byte) (err error) {
+	req, e := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/atom+xml")
+	req.Header.Add("Link", fmt.Sprintf("<%s>; rel=\"hub\"", hub.URL()))
+	req.Header.Add("Link", fmt.Sprintf("<%s>; rel=\"self\"", topic))
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, e := hub.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		err = fmt.Errorf("callback responded %s", res.Status)
+	}
+	return
+}
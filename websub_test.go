@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestWebSub(t *testing.T) {
+	var tmpdir = "/tmp/gitdir-test"
+	b := NewBackend(NewBillyStorer(tmpdir))
+	h := &Handler{
+		B:     b,
+		gzw:   gzip.NewWriter(nil),
+		mutex: new(sync.Mutex),
+		buf:   bytes.NewBuffer(nil),
+		bw:    bufio.NewWriter(nil),
+	}
+	h.Hub = NewHub(b, "https://example.org/", h.mutex)
+
+	defer func() {
+		if e := os.RemoveAll(tmpdir); e != nil {
+			t.Fatal(e)
+		}
+	}()
+
+	// the subscriber echoes every challenge and forwards the deliveries
+	verified := make(chan url.Values, 4)
+	delivered := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			verified <- r.URL.Query()
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			delivered <- r
+			bodies <- body
+		}
+	}))
+	defer subscriber.Close()
+
+	var feed_to_post_to_root = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<id/>
+<title type="text">test microblog</title>
+<updated>2025-02-14T10:33:12.546909+01:00</updated>
+<author>
+<name>Jane Doe</name>
+</author>
+<link href="https://example.org/feed.atom" rel="self" type="application/atom+xml"/>
+</feed>`
+
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(feed_to_post_to_root))
+	req.Header.Set("Content-Type", "application/atom+xml;type=feed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	feed_URL := res.Header.Get("Location")
+	topic := "https://example.org" + feed_URL
+
+	// discovery
+	req = httptest.NewRequest("GET", feed_URL, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	feed := &Feed{}
+	if e := xml.NewDecoder(w.Result().Body).Decode(feed); e != nil {
+		t.Fatal(e)
+	}
+	rels := make(map[string]string)
+	for _, l := range feed.Links {
+		rels[l.Relation] = l.Href
+	}
+	if rels["hub"] != "https://example.org/hub" || rels["self"] != topic {
+		t.Fatalf("unexpected discovery links %v", rels)
+	}
+
+	hub := func(form url.Values) {
+		req := httptest.NewRequest("POST", "/hub", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if res := w.Result(); res.StatusCode != http.StatusAccepted {
+			t.Fatal(res.Status)
+		}
+		if v := <-verified; v.Get("hub.mode") != form.Get("hub.mode") || v.Get("hub.topic") != topic {
+			t.Fatalf("unexpected verification %v", v)
+		}
+		h.Hub.pending.Wait()
+	}
+
+	req = httptest.NewRequest("POST", "/hub", strings.NewReader("hub.mode=subscribe&hub.topic=/feed/unknown&hub.callback="+subscriber.URL))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+
+	hub(url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {topic},
+		"hub.callback": {subscriber.URL},
+		"hub.secret":   {"hunter2"},
+	})
+	if len(b.subscriptionmap) != 1 {
+		t.Fatalf("subscription not stored")
+	}
+
+	// subscriptions survive a restart, with their secret, which is not
+	// committed
+	restarted := NewBillyStorer(tmpdir)
+	if subs := NewBackend(restarted).subscriptionmap; len(subs) != 1 {
+		t.Fatalf("subscription not persisted")
+	} else {
+		for _, v := range subs {
+			if v.Secret != "hunter2" {
+				t.Fatalf("secret %q not restored", v.Secret)
+			}
+		}
+	}
+	if ref, e := restarted.rep.Reference(plumbing.Master, true); e != nil {
+		t.Fatal(e)
+	} else if c, e := restarted.rep.CommitObject(ref.Hash()); e != nil {
+		t.Fatal(e)
+	} else if tree, e := c.Tree(); e != nil {
+		t.Fatal(e)
+	} else if e := tree.Files().ForEach(func(f *object.File) error {
+		if content, e := f.Contents(); e != nil {
+			return e
+		} else if strings.Contains(content, "hunter2") {
+			t.Fatalf("secret committed in %s", f.Name)
+		}
+		return nil
+	}); e != nil {
+		t.Fatal(e)
+	}
+
+	req = httptest.NewRequest("POST", feed_URL, bytes.NewBufferString("Hello, subscribers"))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+
+	r, body := <-delivered, <-bodies
+	mac := hmac.New(sha256.New, []byte("hunter2"))
+	mac.Write(body)
+	if r.Header.Get("X-Hub-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("bad signature")
+	} else if !strings.Contains(string(body), "Hello, subscribers") {
+		t.Fatalf("fat ping without the new entry")
+	}
+
+	hub(url.Values{
+		"hub.mode":     {"unsubscribe"},
+		"hub.topic":    {feed_URL},
+		"hub.callback": {subscriber.URL},
+	})
+	if len(b.subscriptionmap) != 0 {
+		t.Fatalf("subscription not removed")
+	} else if p, e := os.ReadFile(path.Join(tmpdir, secrets_name)); e != nil {
+		t.Fatal(e)
+	} else if strings.Contains(string(p), "hunter2") {
+		t.Fatalf("secret kept after the unsubscription")
+	}
+}
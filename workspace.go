@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// categories with this scheme assign a new collection to the workspace with uuid term
+const workspace_scheme = "urn:atompub-server:workspace"
+
+// name of the workspace used when the repository does not define any
+const default_workspace_title = "default workspace"
+
+// relation of the link marking the default workspace, which takes the new
+// collections assigned to no other one
+const default_workspace_rel = "urn:atompub-server:default"
+
+func workspaceURL(ws *Workspace) string {
+	if ws == nil {
+		return ""
+	}
+	for _, l := range ws.Links {
+		if l.Relation == "edit" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+func workspaceUUID(ws *Workspace) (u uuid.UUID, err error) {
+	if ws == nil {
+		err = fmt.Errorf("nil pointer dereference")
+	} else if ws_URL := workspaceURL(ws); ws_URL == "" {
+		err = fmt.Errorf("workspace without edit link")
+	} else if u, err = uuid.Parse(path.Base(ws_URL)); err != nil {
+		err = fmt.Errorf("invalid workspace id: %w", err)
+	}
+	return
+}
+
+func newWorkspace(uuid_string string, title *TextConstruct) *Workspace {
+	return &Workspace{
+		Title: TextConstruct{
+			XMLName: xml.Name{Space: atom_xmlns, Local: "title"},
+			Type:    title.Type,
+			Text:    title.Text,
+		},
+		Links: []Link{{
+			Href:     "/workspace/" + uuid_string,
+			Relation: "edit",
+		}},
+		Collections: make([]*Collection, 0, 32),
+	}
+}
+
+func isDefaultWorkspace(ws *Workspace) bool {
+	for _, l := range ws.Links {
+		if l.Relation == default_workspace_rel {
+			return true
+		}
+	}
+	return false
+}
+
+func markDefaultWorkspace(ws *Workspace) {
+	ws.Links = append(ws.Links, Link{
+		Href:     workspaceURL(ws),
+		Relation: default_workspace_rel,
+	})
+}
+
+// the persisted form of a workspace: a service document holding only
+// the workspace title and the hrefs of its collections
+func workspaceStub(ws *Workspace) *Service {
+	stub := Workspace{
+		Title:       ws.Title,
+		Links:       ws.Links,
+		Collections: make([]*Collection, 0, len(ws.Collections)),
+	}
+	for _, c := range ws.Collections {
+		if c != nil {
+			stub.Collections = append(stub.Collections, &Collection{Href: c.Href})
+		}
+	}
+	return &Service{Workspaces: []Workspace{stub}}
+}
+
+// rebuilds the service document from the workspacemap, the default
+// workspace first and the others ordered by title
+func (b *Backend) buildServiceDocument() {
+	keys := make([]string, 0, len(b.workspacemap))
+	for k := range b.workspacemap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i int, j int) bool {
+		ti, tj := b.workspacemap[keys[i]].Title.Text, b.workspacemap[keys[j]].Title.Text
+		if di, dj := isDefaultWorkspace(b.workspacemap[keys[i]]), isDefaultWorkspace(b.workspacemap[keys[j]]); di != dj {
+			return di
+		} else if ti == tj {
+			return keys[i] < keys[j]
+		}
+		return ti < tj
+	})
+	workspaces := make([]Workspace, 0, len(keys))
+	for _, k := range keys {
+		workspaces = append(workspaces, *b.workspacemap[k])
+	}
+	b.serviceDocument = &Service{Workspaces: workspaces}
+}
+
+// the workspace first in the service document
+func (b *Backend) defaultWorkspace() *Workspace {
+	return b.workspacemap[workspaceURL(&b.serviceDocument.Workspaces[0])]
+}
+
+// returns the workspace containing the collection at feed_URL
+func (b *Backend) workspaceOf(feed_URL string) (ws *Workspace) {
+	for _, w := range b.workspacemap {
+		for _, c := range w.Collections {
+			if c != nil && c.Href == feed_URL {
+				return w
+			}
+		}
+	}
+	return nil
+}
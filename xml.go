@@ -26,6 +26,8 @@ type Feed struct {
 
 	// APP
 	Collection *Collection `xml:"http://www.w3.org/2007/app collection"`
+
+	sources string // of a feed over many sources, their hash, for the ETag
 }
 
 type Entry struct {
@@ -48,6 +50,9 @@ type Entry struct {
 	// APP
 	Edited  *DateConstruct     `xml:"http://www.w3.org/2007/app edited"`
 	Control *PublishingControl `xml:"http://www.w3.org/2007/app control"`
+
+	// RFC 4685
+	InReplyTo []InReplyTo `xml:"http://purl.org/syndication/thread/1.0 in-reply-to"`
 }
 
 // similar to Feed
@@ -95,6 +100,19 @@ type Link struct {
 	HrefLang string `xml:"hreflang,attr"`
 	Title    string `xml:"title,attr"`
 	Length   uint64 `xml:"length,attr"`
+
+	// RFC 4685, on links with rel="replies"
+	ThreadCount   uint64 `xml:"http://purl.org/syndication/thread/1.0 count,attr"`
+	ThreadUpdated string `xml:"http://purl.org/syndication/thread/1.0 updated,attr"`
+}
+
+// RFC 4685
+type InReplyTo struct {
+	XMLName xml.Name `xml:"http://purl.org/syndication/thread/1.0 in-reply-to"`
+	Ref     string   `xml:"ref,attr"` // atom:id of the parent
+	Href    string   `xml:"href,attr"`
+	Type    string   `xml:"type,attr"`
+	Source  string   `xml:"source,attr"`
 }
 
 type Category struct {
@@ -143,6 +161,7 @@ type Service struct {
 type Workspace struct {
 	XMLName     xml.Name      `xml:"http://www.w3.org/2007/app workspace"`
 	Title       TextConstruct `xml:"http://www.w3.org/2005/Atom title"`
+	Links       []Link        `xml:"http://www.w3.org/2005/Atom link"` // rel="edit" points to /workspace/{uuid}
 	Collections []*Collection `xml:"collection"`
 }
 